@@ -1,83 +1,265 @@
 package api
 
 import (
+	crand "crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"github.com/Richard87/wg-vpn-server/config"
 	"github.com/Richard87/wg-vpn-server/database"
-	"github.com/alexedwards/argon2id"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gofiber/fiber/v2"
+	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
+const (
+	authCookie    = "auth"
+	refreshCookie = "refresh"
+)
+
 func Authenticate(c *fiber.Ctx) error {
 	var login = Login{}
 	if err := c.BodyParser(&login); err != nil {
-		c.Status(http.StatusBadRequest)
-		return nil
+		return errBadRequest("Invalid login request")
 	}
 
 	if login.Password == "" {
-		c.Status(http.StatusUnauthorized)
-		return nil
+		return errUnauthorized()
+	}
+
+	limitKeys := []string{ipLimitKey(c.IP()), userLimitKey(login.Username)}
+	if wait := loginRetryAfter(limitKeys...); wait > 0 {
+		return tooManyAttempts(c, wait)
 	}
 
 	var user = database.User{}
-	database.Connection.Find(&user, "username = ?", login.Username)
-	if user.Username == "" {
-		c.Status(http.StatusUnauthorized)
-		return nil
+	if err := database.Connection.Find(&user, "username = ?", login.Username).Error; err != nil {
+		return errDatabase(err)
 	}
 
-	match, err := argon2id.ComparePasswordAndHash(login.Password, user.Hash)
-	if err != nil {
-		return fmt.Errorf("could not check password hash!: %s", err)
+	// Unknown, locked and single sign-on users are still checked against a dummy hash, so they can't be told apart by timing
+	hash := user.Hash
+	if user.ID == 0 || user.Locked() || config.Config.DisableLocalLogin {
+		hash = ""
+	}
+
+	match, ok := checkPassword(login.Password, hash)
+	if !ok {
+		return NewError(http.StatusServiceUnavailable, CodeUnavailable, "Too many logins, try again later")
 	}
 
 	if !match {
-		c.Status(http.StatusUnauthorized)
-		return nil
+		loginFailed(limitKeys...)
+		if user.ID != 0 && !user.Locked() {
+			if err := user.RegisterFailedLogin(); err != nil {
+				log.Printf("API: Could not register failed login for %s: %s", user.Username, err)
+			}
+		}
+		return errUnauthorized()
+	}
+
+	loginSucceeded(limitKeys...)
+	if err := user.ResetFailedLogins(); err != nil {
+		return errDatabase(err)
+	}
+
+	if user.TotpEnabled {
+		response, err := newMfaToken(&user)
+		if err != nil {
+			return err
+		}
+		return c.JSON(response)
 	}
 
+	response, err := startSession(c, &user)
+	if err != nil {
+		return err
+	}
+	return c.JSON(response)
+}
+
+// Refresh exchanges the refresh cookie for a new access token, and rotates the refresh token
+func Refresh(c *fiber.Ctx) error {
+	refreshToken := c.Cookies(refreshCookie)
+	if refreshToken == "" {
+		return errUnauthorized()
+	}
+
+	hash := database.HashToken(refreshToken)
+	session := database.Session{}
+	if err := database.Connection.Where("token_hash = ? OR previous_hash = ?", hash, hash).Limit(1).Find(&session).Error; err != nil {
+		return errDatabase(err)
+	}
+	if session.ID == 0 || !session.Active() {
+		clearAuthCookies(c)
+		return errUnauthorized()
+	}
+
+	// A refresh token that has already been rotated is being reused, somebody else has a copy of it
+	if session.TokenHash != hash {
+		log.Printf("API: Refresh token reused for session %d, revoking session", session.ID)
+		now := time.Now()
+		if err := database.Connection.Model(&session).Update("revoked_at", &now).Error; err != nil {
+			return errDatabase(err)
+		}
+		clearAuthCookies(c)
+		return errUnauthorized()
+	}
+
+	user := database.User{}
+	if err := database.Connection.Find(&user, session.UserID).Error; err != nil {
+		return errDatabase(err)
+	}
+	if user.ID == 0 {
+		clearAuthCookies(c)
+		return errUnauthorized()
+	}
+
+	newRefreshToken, err := generateToken()
+	if err != nil {
+		return fmt.Errorf("could not generate refresh token: %s", err)
+	}
+
+	session.PreviousHash = session.TokenHash
+	session.TokenHash = database.HashToken(newRefreshToken)
+	session.ExpiresAt = time.Now().Add(config.Current().HttpsRefreshTokenTtl)
+	if err = database.Connection.Save(&session).Error; err != nil {
+		return errDatabase(err)
+	}
+
+	response, err := issueTokens(c, &user, &session, newRefreshToken)
+	if err != nil {
+		return err
+	}
+	return c.JSON(response)
+}
+
+// Logout revokes the current session and clears the auth cookies
+func Logout(c *fiber.Ctx) error {
+	if refreshToken := c.Cookies(refreshCookie); refreshToken != "" {
+		err := database.Connection.Model(&database.Session{}).
+			Where("token_hash = ? AND revoked_at IS NULL", database.HashToken(refreshToken)).
+			Update("revoked_at", time.Now()).Error
+		if err != nil {
+			return errDatabase(err)
+		}
+	}
+
+	clearAuthCookies(c)
+	return c.SendStatus(http.StatusNoContent)
+}
+
+// startSession creates a new login session for user, and sets the auth cookies
+func startSession(c *fiber.Ctx, user *database.User) (LoginResponse, error) {
+	refreshToken, err := generateToken()
+	if err != nil {
+		return LoginResponse{}, fmt.Errorf("could not generate refresh token: %s", err)
+	}
+
+	session := database.Session{
+		UserID:    user.ID,
+		TokenHash: database.HashToken(refreshToken),
+		ExpiresAt: time.Now().Add(config.Current().HttpsRefreshTokenTtl),
+	}
+	if err = database.Connection.Create(&session).Error; err != nil {
+		return LoginResponse{}, errDatabase(err)
+	}
+
+	return issueTokens(c, user, &session, refreshToken)
+}
+
+func issueTokens(c *fiber.Ctx, user *database.User, session *database.Session, refreshToken string) (LoginResponse, error) {
+	expires := time.Now().Add(config.Current().HttpsAccessTokenTtl)
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": login.Username,
-		"exp":      time.Now().Add(time.Minute * 115).UnixNano(),
+		"username": user.Username,
+		"sid":      session.ID,
+		"iat":      time.Now().Unix(),
+		"exp":      expires.Unix(),
 	})
 
-	tokenString, err := token.SignedString(config.Config.HttpsJwtSigningKey)
+	key := activeSigningKey()
+	token.Header["kid"] = key.Kid
+
+	tokenString, err := token.SignedString(key.Secret)
 	if err != nil {
-		return fmt.Errorf("could not sign jwt: %s", err)
+		return LoginResponse{}, fmt.Errorf("could not sign jwt: %s", err)
 	}
 
 	parts := strings.Split(tokenString, ".")
 
 	c.Cookie(&fiber.Cookie{
-		Name:     "auth",
+		Name:     authCookie,
 		Value:    parts[2],
-		MaxAge:   3600 * 2,
-		Expires:  time.Now().Add(time.Hour * 2),
+		MaxAge:   int(config.Current().HttpsAccessTokenTtl.Seconds()),
+		Expires:  expires,
 		Secure:   true,
 		HTTPOnly: true,
 		SameSite: "lax",
 	})
+	c.Cookie(&fiber.Cookie{
+		Name:     refreshCookie,
+		Value:    refreshToken,
+		MaxAge:   int(time.Until(session.ExpiresAt).Seconds()),
+		Expires:  session.ExpiresAt,
+		Secure:   true,
+		HTTPOnly: true,
+		SameSite: "strict",
+	})
 
-	return c.JSON(LoginResponse{Token: parts[0] + "." + parts[1]})
+	return LoginResponse{Token: parts[0] + "." + parts[1], ExpiresAt: expires}, nil
+}
+
+func clearAuthCookies(c *fiber.Ctx) {
+	for _, name := range []string{authCookie, refreshCookie} {
+		c.Cookie(&fiber.Cookie{
+			Name:     name,
+			Value:    "",
+			MaxAge:   -1,
+			Expires:  time.Unix(0, 0),
+			Secure:   true,
+			HTTPOnly: true,
+			SameSite: "lax",
+		})
+	}
+}
+
+func tooManyAttempts(c *fiber.Ctx, wait time.Duration) error {
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return NewError(http.StatusTooManyRequests, CodeTooManyRequests, "Too many failed logins, try again later")
+}
+
+func generateToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := crand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
 }
 
 func NewAuthenticationMiddleware() fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		authorization := c.Get("Authorization")
-		signature := c.Cookies("auth")
+		signature := c.Cookies(authCookie)
+		if certificate := clientCertificate(c); certificate != nil && authorization == "" {
+			return authenticateClientCertificate(c, certificate)
+		}
+
 		authPars := strings.Split(authorization, " ")
 		if len(authPars) != 2 {
-			return c.Status(http.StatusUnauthorized).Format("Unauthorized")
+			return errUnauthorized()
+		}
+
+		if strings.EqualFold(authPars[0], "bearer") && strings.HasPrefix(authPars[1], database.ApiTokenPrefix) {
+			return authenticateApiToken(c, authPars[1])
 		}
 
 		jwtParts := strings.Split(authPars[1], ".")
 		if signature == "" || len(jwtParts) != 2 {
-			return c.Status(http.StatusUnauthorized).Format("Unauthorized")
+			return errUnauthorized()
 		}
 
 		tokenString := fmt.Sprintf("%s.%s.%s", jwtParts[0], jwtParts[1], signature)
@@ -85,13 +267,104 @@ func NewAuthenticationMiddleware() fiber.Handler {
 			if token.Header["alg"] != "HS256" {
 				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 			}
-			return config.Config.HttpsJwtSigningKey, nil
+			kid, _ := token.Header["kid"].(string)
+			return verificationKey(kid)
 		})
 		if err != nil || !token.Valid {
-			return c.Status(http.StatusForbidden).Format("Forbidden")
+			return errForbidden("Forbidden")
+		}
+
+		// Sessions are checked on every request, so revoking them takes effect immediately
+		claims, _ := token.Claims.(jwt.MapClaims)
+		sid, _ := claims["sid"].(float64)
+		session := database.Session{}
+		if err = database.Connection.Find(&session, uint(sid)).Error; err != nil {
+			return errDatabase(err)
+		}
+		if session.ID == 0 || !session.Active() {
+			return errForbidden("Forbidden")
+		}
+
+		user := database.User{}
+		if err = database.Connection.Find(&user, session.UserID).Error; err != nil {
+			return errDatabase(err)
+		}
+		if user.ID == 0 {
+			return errForbidden("Forbidden")
+		}
+
+		// Sessions without two-factor authentication can only be used to enroll, when the role requires it
+		if user.RequiresTotp() && !user.TotpEnabled && !strings.HasPrefix(c.Path(), "/api/totp") {
+			return NewError(http.StatusForbidden, CodeTotpRequired, "Two-factor authentication required")
 		}
 
 		c.Locals("jwt", token)
+		c.Locals("user", &user)
+		c.Locals("scope", database.ScopeWrite)
+		return c.Next()
+	}
+}
+
+func authenticateApiToken(c *fiber.Ctx, plainToken string) error {
+	token := database.ApiToken{}
+	if err := database.Connection.Where("hash = ?", database.HashToken(plainToken)).Limit(1).Find(&token).Error; err != nil {
+		return errDatabase(err)
+	}
+	if token.ID == 0 || token.Expired() {
+		return errForbidden("Forbidden")
+	}
+
+	if token.Scope != database.ScopeWrite && c.Method() != http.MethodGet && c.Method() != http.MethodHead {
+		return errForbidden("Token is read-only")
+	}
+
+	user := database.User{}
+	if err := database.Connection.Find(&user, token.UserID).Error; err != nil {
+		return errDatabase(err)
+	}
+	if user.ID == 0 {
+		return errForbidden("Forbidden")
+	}
+	// Tokens skip the second factor, so they only work once the user has enrolled when the role requires it
+	if user.RequiresTotp() && !user.TotpEnabled {
+		return NewError(http.StatusForbidden, CodeTotpRequired, "Two-factor authentication required")
+	}
+
+	now := time.Now()
+	if err := database.Connection.Model(&token).UpdateColumn("last_used_at", &now).Error; err != nil {
+		return errDatabase(err)
+	}
+
+	c.Locals("user", &user)
+	c.Locals("scope", token.Scope)
+	return c.Next()
+}
+
+// RequireScope only lets API tokens with scope through, logins and client certificates can do everything.
+// Routes that return private keys need a write token, a read-only token would be enough to take over the server.
+func RequireScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Locals("scope") != scope {
+			return errForbidden(fmt.Sprintf("Token needs the %s scope", scope))
+		}
 		return c.Next()
 	}
 }
+
+// RequireRole only lets users with one of the given roles through
+func RequireRole(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, ok := c.Locals("user").(*database.User)
+		if !ok {
+			return errUnauthorized()
+		}
+
+		for _, role := range roles {
+			if user.Role == role {
+				return c.Next()
+			}
+		}
+
+		return errForbidden("Forbidden")
+	}
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/backup"
+	"github.com/Richard87/wg-vpn-server/database"
+	"github.com/gofiber/fiber/v2"
+	"log"
+	"net/http"
+	"time"
+)
+
+// GetBackup downloads a backup of users, clients and the server private key, encrypted with -backup-passphrase-file if set
+func GetBackup(c *fiber.Ctx) error {
+	user := c.Locals("user").(*database.User)
+
+	passphrase, err := backup.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+
+	archive := &bytes.Buffer{}
+	if _, err = backup.Create(archive, passphrase); err != nil {
+		return fmt.Errorf("could not create backup: %s", err)
+	}
+
+	log.Printf("API: %s downloaded a backup (encrypted: %t)", user.Username, passphrase != nil)
+	c.Attachment(fmt.Sprintf("wg-vpn-server-%s.backup", time.Now().UTC().Format("20060102-150405")))
+	c.Set(fiber.HeaderContentType, "application/octet-stream")
+	return c.Status(http.StatusOK).Send(archive.Bytes())
+}
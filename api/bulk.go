@@ -0,0 +1,37 @@
+package api
+
+import (
+	"bytes"
+	"github.com/Richard87/wg-vpn-server/wireguard"
+	"github.com/gofiber/fiber/v2"
+	"net/http"
+)
+
+// CreateClients creates many clients from a JSON list or CSV, either all of them or none.
+// The response has a result per row, and a base64 zip with a config for every client.
+func CreateClients(c *fiber.Ctx) error {
+	network, err := requestNetwork(c)
+	if err != nil {
+		return err
+	}
+	rows, err := wireguard.ParseBulk(bytes.NewReader(c.Body()))
+	if err != nil {
+		return errBadRequest(err.Error())
+	}
+
+	result, err := wireguard.Provision(network, rows, c.Query("dryRun") == "true")
+	if err != nil {
+		return changeError(err)
+	}
+
+	status := http.StatusOK
+	if result.Created {
+		status = http.StatusCreated
+	}
+	for _, row := range result.Rows {
+		if row.Status == wireguard.BulkInvalid {
+			status = http.StatusUnprocessableEntity
+		}
+	}
+	return c.Status(status).JSON(result)
+}
@@ -0,0 +1,261 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/config"
+	"github.com/Richard87/wg-vpn-server/database"
+	"github.com/gofiber/fiber/v2"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	clientCAs []*x509.Certificate
+	// revokedCertificates holds the revoked serial numbers from -https-client-crl, per issuer
+	revokedCertificates = struct {
+		sync.RWMutex
+		serials map[string]map[string]bool
+		modTime time.Time
+	}{}
+)
+
+// configureClientCertificates lets clients authenticate with certificates signed by -https-client-ca
+func configureClientCertificates(tlsConfig *tls.Config) {
+	if config.Config.HttpsClientCa == "" {
+		return
+	}
+
+	bundle, err := os.ReadFile(config.Config.HttpsClientCa)
+	if err != nil {
+		log.Fatalf("API: Could not read client CA bundle: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			log.Fatalf("API: Invalid certificate in client CA bundle: %s", err)
+		}
+		pool.AddCert(ca)
+		clientCAs = append(clientCAs, ca)
+	}
+	if len(clientCAs) == 0 {
+		log.Fatalf("API: No certificates found in client CA bundle %s", config.Config.HttpsClientCa)
+	}
+
+	tlsConfig.ClientCAs = pool
+	if len(config.Current().HttpsClientCertUsers) == 0 {
+		log.Printf("API: No -https-client-cert-user mappings, client certificates can not log in")
+	}
+	switch config.Config.HttpsClientAuth {
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		log.Fatalf("API: -https-client-auth must be optional or require, got %s", config.Config.HttpsClientAuth)
+	}
+
+	if config.Config.HttpsClientCrl != "" {
+		if err := loadCrl(); err != nil {
+			log.Fatalf("API: Could not load client CRL: %s", err)
+		}
+		go func() {
+			for range time.Tick(time.Minute) {
+				if err := loadCrl(); err != nil {
+					log.Printf("API: Could not reload client CRL, keeping the current one: %s", err)
+				}
+			}
+		}()
+		tlsConfig.VerifyPeerCertificate = verifyNotRevoked
+	}
+}
+
+// loadCrl reads every CRL in -https-client-crl (PEM or DER), only CRLs signed by a client CA are accepted
+func loadCrl() error {
+	stat, err := os.Stat(config.Config.HttpsClientCrl)
+	if err != nil {
+		return err
+	}
+
+	revokedCertificates.RLock()
+	unchanged := stat.ModTime().Equal(revokedCertificates.modTime)
+	revokedCertificates.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	content, err := os.ReadFile(config.Config.HttpsClientCrl)
+	if err != nil {
+		return err
+	}
+
+	var lists [][]byte
+	for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			lists = append(lists, block.Bytes)
+		}
+	}
+	if len(lists) == 0 {
+		lists = append(lists, content)
+	}
+
+	serials := map[string]map[string]bool{}
+	for _, raw := range lists {
+		crl, err := x509.ParseDERCRL(raw)
+		if err != nil {
+			return err
+		}
+
+		issuer, err := crlIssuer(crl)
+		if err != nil {
+			return err
+		}
+		if crl.HasExpired(time.Now()) {
+			log.Printf("API: Client CRL from %s has expired, please update it", issuer.Subject)
+		}
+
+		key := string(issuer.RawSubject)
+		if serials[key] == nil {
+			serials[key] = map[string]bool{}
+		}
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			serials[key][revoked.SerialNumber.String()] = true
+		}
+	}
+
+	revokedCertificates.Lock()
+	revokedCertificates.serials = serials
+	revokedCertificates.modTime = stat.ModTime()
+	revokedCertificates.Unlock()
+	return nil
+}
+
+func crlIssuer(crl *pkix.CertificateList) (*x509.Certificate, error) {
+	for _, ca := range clientCAs {
+		if ca.CheckCRLSignature(crl) == nil {
+			return ca, nil
+		}
+	}
+	return nil, fmt.Errorf("CRL from %s is not signed by a client CA", crl.TBSCertList.Issuer)
+}
+
+func verifyNotRevoked(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	revokedCertificates.RLock()
+	defer revokedCertificates.RUnlock()
+
+	for _, chain := range verifiedChains {
+		for _, certificate := range chain {
+			if revokedCertificates.serials[string(certificate.RawIssuer)][certificate.SerialNumber.String()] {
+				return fmt.Errorf("certificate %s has been revoked", certificate.Subject)
+			}
+		}
+	}
+	return nil
+}
+
+// clientCertificate returns the verified client certificate of the connection, if any
+func clientCertificate(c *fiber.Ctx) *x509.Certificate {
+	state := c.Context().TLSConnectionState()
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+func certificateIdentities(certificate *x509.Certificate) []string {
+	identities := []string{certificate.Subject.CommonName}
+	identities = append(identities, certificate.EmailAddresses...)
+	identities = append(identities, certificate.DNSNames...)
+	for _, uri := range certificate.URIs {
+		identities = append(identities, uri.String())
+	}
+	return identities
+}
+
+// certificateUser maps a client certificate to the user of the first identity listed in -https-client-cert-user.
+// Certificates without a mapping are refused, even when an identity matches a username, so a certificate can never
+// log in as an existing user.
+func certificateUser(certificate *x509.Certificate) (*database.User, error) {
+	identities := certificateIdentities(certificate)
+
+	for _, mapping := range config.Current().HttpsClientCertUsers {
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		for _, identity := range identities {
+			if identity != "" && identity == parts[0] {
+				return certificateMappedUser(identity, parts[1])
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no -https-client-cert-user mapping for certificate %s", certificate.Subject)
+}
+
+func certificateMappedUser(identity string, role string) (*database.User, error) {
+	subject := "cert:" + identity
+
+	user := database.User{}
+	if err := database.Connection.Where("subject = ?", subject).Limit(1).Find(&user).Error; err != nil {
+		return nil, errDatabase(err)
+	}
+	if user.ID == 0 {
+		existing := database.User{}
+		if err := database.Connection.Where("username = ?", identity).Limit(1).Find(&existing).Error; err != nil {
+			return nil, errDatabase(err)
+		}
+		if existing.ID != 0 {
+			return nil, fmt.Errorf("username %s is already used by another user", identity)
+		}
+
+		user = database.User{Username: identity, Role: role, Subject: subject}
+		if err := database.Connection.Create(&user).Error; err != nil {
+			return nil, errDatabase(err)
+		}
+		log.Printf("API: Created user %s for client certificate", identity)
+		return &user, nil
+	}
+
+	if user.Role != role {
+		user.Role = role
+		if err := database.Connection.Save(&user).Error; err != nil {
+			return nil, errDatabase(err)
+		}
+	}
+	return &user, nil
+}
+
+// authenticateClientCertificate logs in the user of the certificate. The CRL is checked on every request as well, a
+// keep-alive connection would keep a certificate revoked after the handshake working otherwise.
+func authenticateClientCertificate(c *fiber.Ctx, certificate *x509.Certificate) error {
+	if err := verifyNotRevoked(nil, c.Context().TLSConnectionState().VerifiedChains); err != nil {
+		log.Printf("API: Client certificate refused: %s", err)
+		return errForbidden("Forbidden")
+	}
+
+	user, err := certificateUser(certificate)
+	if apiError := (&Error{}); errors.As(err, &apiError) {
+		return err
+	}
+	if err != nil {
+		log.Printf("API: Client certificate refused: %s", err)
+		return errForbidden("Forbidden")
+	}
+
+	c.Locals("user", user)
+	c.Locals("scope", database.ScopeWrite)
+	return c.Next()
+}
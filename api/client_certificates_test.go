@@ -0,0 +1,211 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"embed"
+	"github.com/Richard87/wg-vpn-server/config"
+	"github.com/Richard87/wg-vpn-server/database"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func useCertificateUsers(t *testing.T, mappings ...string) {
+	previous := config.Current().HttpsClientCertUsers
+	config.Current().HttpsClientCertUsers = mappings
+	t.Cleanup(func() {
+		config.Current().HttpsClientCertUsers = previous
+	})
+}
+
+func TestCertificateWithoutMappingIsRefused(t *testing.T) {
+	useCertificateUsers(t)
+	admin := database.User{Username: "cert-admin", Role: "admin"}
+	if err := database.Connection.Create(&admin).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		database.Connection.Unscoped().Delete(&admin)
+	})
+
+	certificate := &x509.Certificate{Subject: pkix.Name{CommonName: "cert-admin"}, DNSNames: []string{"cert-admin"}}
+	if user, err := certificateUser(certificate); err == nil {
+		t.Fatalf("A certificate without a mapping logged in as %s", user.Username)
+	}
+}
+
+func TestMappedCertificateGetsItsOwnUser(t *testing.T) {
+	useCertificateUsers(t, "ansible.example.com=user", "cert-taken=admin")
+	taken := database.User{Username: "cert-taken", Role: "user"}
+	if err := database.Connection.Create(&taken).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		database.Connection.Unscoped().Where("username IN ?", []string{"cert-taken", "ansible.example.com"}).Delete(&database.User{})
+	})
+
+	certificate := &x509.Certificate{Subject: pkix.Name{CommonName: "Ansible"}, DNSNames: []string{"ansible.example.com"}}
+	user, err := certificateUser(certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "ansible.example.com" || user.Role != "user" || user.Subject != "cert:ansible.example.com" {
+		t.Fatalf("Unexpected user for the certificate: %+v", user)
+	}
+
+	// A mapping can not take over a user that already exists
+	certificate = &x509.Certificate{Subject: pkix.Name{CommonName: "cert-taken"}}
+	if user, err = certificateUser(certificate); err == nil {
+		t.Fatalf("A mapped certificate logged in as the existing user %s", user.Username)
+	}
+}
+
+// issueCertificate signs template with parent, or self-signs it when parent is nil
+func issueCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key
+}
+
+// writeCrl signs a CRL with the revoked serials, and loads it like the reload every minute does
+func writeCrl(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, number int64, serials ...*big.Int) {
+	var revoked []pkix.RevokedCertificate
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: time.Now()})
+	}
+	crl, err := x509.CreateRevocationList(crand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(number),
+		ThisUpdate:          time.Now().Add(-time.Minute),
+		NextUpdate:          time.Now().Add(time.Hour),
+		RevokedCertificates: revoked,
+	}, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(config.Config.HttpsClientCrl, crl, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The CRL is only read again when the file changed
+	modTime := time.Now().Add(time.Duration(number) * time.Second)
+	if err = os.Chtimes(config.Config.HttpsClientCrl, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err = loadCrl(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificateRevokedDuringTheConnectionIsRefused(t *testing.T) {
+	useCertificateUsers(t, "cert-laptop=user")
+	t.Cleanup(func() {
+		database.Connection.Unscoped().Where("username = ?", "cert-laptop").Delete(&database.User{})
+	})
+
+	ca, caKey := issueCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test client CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil, nil)
+	server, serverKey := issueCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	client, clientKey := issueCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "cert-laptop"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	previousCAs, previousCrl := clientCAs, config.Config.HttpsClientCrl
+	clientCAs = []*x509.Certificate{ca}
+	config.Config.HttpsClientCrl = filepath.Join(t.TempDir(), "client.crl")
+	t.Cleanup(func() {
+		clientCAs, config.Config.HttpsClientCrl = previousCAs, previousCrl
+		revokedCertificates.Lock()
+		revokedCertificates.serials = nil
+		revokedCertificates.modTime = time.Time{}
+		revokedCertificates.Unlock()
+	})
+	writeCrl(t, ca, caKey, 1)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates:          []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}},
+		ClientCAs:             pool,
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		VerifyPeerCertificate: verifyNotRevoked,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter(embed.FS{})
+	go func() {
+		_ = router.Listener(listener)
+	}()
+	t.Cleanup(func() {
+		_ = router.Shutdown()
+	})
+
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}},
+	}}}
+	defer httpClient.CloseIdleConnections()
+	// get returns the status, and if the request reused the connection of the previous one
+	get := func() (int, bool) {
+		reused := false
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused }}
+		request, err := http.NewRequest(http.MethodGet, "https://"+listener.Addr().String()+"/api/tokens", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := httpClient.Do(request.WithContext(httptrace.WithClientTrace(request.Context(), trace)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.StatusCode, reused
+	}
+
+	if status, _ := get(); status != http.StatusOK {
+		t.Fatalf("The certificate returned %d before it was revoked", status)
+	}
+	writeCrl(t, ca, caKey, 2, client.SerialNumber)
+	status, reused := get()
+	if !reused {
+		t.Fatal("The second request used a new connection")
+	}
+	if status != http.StatusForbidden {
+		t.Fatalf("The revoked certificate returned %d on the open connection", status)
+	}
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/database"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clientQuery is parsed from the GET /api/clients query string:
+//
+//	?limit=100&offset=0                    page size (max 1000) and position
+//	?name=lap                              name contains, case insensitive
+//	?group=ops                             exact group
+//	?network=iot                           clients of one network, set by /api/networks/:network/clients
+//	?online=true&disabled=false&expired=false
+//	?sort=name|created|handshake|traffic   prefix with - to sort descending, created is the default
+type clientQuery struct {
+	limit      int
+	offset     int
+	name       string
+	group      string
+	network    *uint
+	online     *bool
+	disabled   *bool
+	expired    *bool
+	sort       string
+	descending bool
+}
+
+var clientSortKeys = map[string]bool{"name": true, "created": true, "handshake": true, "traffic": true}
+
+func newClientQuery(c *fiber.Ctx) (*clientQuery, error) {
+	query := &clientQuery{
+		limit: defaultClientsLimit,
+		name:  strings.TrimSpace(c.Query("name")),
+		group: c.Query("group"),
+		sort:  c.Query("sort", "created"),
+	}
+
+	var err error
+	if value := c.Query("limit"); value != "" {
+		if query.limit, err = strconv.Atoi(value); err != nil || query.limit < 1 || query.limit > maxClientsLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxClientsLimit)
+		}
+	}
+	if value := c.Query("offset"); value != "" {
+		if query.offset, err = strconv.Atoi(value); err != nil || query.offset < 0 {
+			return nil, fmt.Errorf("offset must be 0 or more")
+		}
+	}
+	for name, target := range map[string]**bool{"online": &query.online, "disabled": &query.disabled, "expired": &query.expired} {
+		value := c.Query(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be true or false", name)
+		}
+		*target = &parsed
+	}
+
+	if strings.HasPrefix(query.sort, "-") {
+		query.sort, query.descending = query.sort[1:], true
+	}
+	if !clientSortKeys[query.sort] {
+		return nil, fmt.Errorf("sort must be name, created, handshake or traffic")
+	}
+	return query, nil
+}
+
+// needsStats is true when the filters or sort key are only known by the device
+func (q *clientQuery) needsStats() bool {
+	return q.online != nil || q.sort == "handshake" || q.sort == "traffic"
+}
+
+// filter applies the filters that are stored in the database
+func (q *clientQuery) filter() *gorm.DB {
+	db := database.Connection.Model(&database.Client{})
+	if q.name != "" {
+		escaped := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(strings.ToLower(q.name))
+		db = db.Where("LOWER(name) LIKE ? ESCAPE '!'", "%"+escaped+"%")
+	}
+	if q.group != "" {
+		db = db.Where("client_group = ?", q.group)
+	}
+	if q.network != nil {
+		db = db.Where("network_id = ?", *q.network)
+	}
+	if q.disabled != nil {
+		db = db.Where("disabled = ?", *q.disabled)
+	}
+	if q.expired != nil && *q.expired {
+		db = db.Where("expires_at IS NOT NULL AND expires_at <= ?", time.Now())
+	} else if q.expired != nil {
+		db = db.Where("(expires_at IS NULL OR expires_at > ?)", time.Now())
+	}
+	return db
+}
+
+func (q *clientQuery) order() string {
+	direction := ""
+	if q.descending {
+		direction = " DESC"
+	}
+	if q.sort == "name" {
+		return "name" + direction + ", id" + direction
+	}
+	return "id" + direction
+}
+
+// less sorts by the device stats, clients without a handshake come first
+func (q *clientQuery) less(a *ClientResponse, b *ClientResponse) bool {
+	if q.descending {
+		a, b = b, a
+	}
+	switch q.sort {
+	case "handshake":
+		if a.LatestHandshake == nil || b.LatestHandshake == nil {
+			return a.LatestHandshake == nil && b.LatestHandshake != nil
+		}
+		return a.LatestHandshake.Before(*b.LatestHandshake)
+	case "traffic":
+		return a.SentBytes+a.ReceivedBytes < b.SentBytes+b.ReceivedBytes
+	case "name":
+		return a.Name < b.Name
+	}
+	return a.ID < b.ID
+}
@@ -1,96 +1,436 @@
 package api
 
 import (
+	"errors"
 	"github.com/Richard87/wg-vpn-server/database"
 	"github.com/Richard87/wg-vpn-server/wireguard"
 	"github.com/gofiber/fiber/v2"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 )
 
 type ClientResponse struct {
 	database.Client
-	LatestHandshake string `json:"latestHandshake"`
-	Endpoint        string `json:"endpoint"`
-	SentBytes       int64  `json:"sentBytes"`
-	ReceivedBytes   int64  `json:"receivedBytes"`
+	LatestHandshake *time.Time `json:"latestHandshake"`
+	Endpoint        string     `json:"endpoint"`
+	SentBytes       int64      `json:"sentBytes"`
+	ReceivedBytes   int64      `json:"receivedBytes"`
+	Online          bool       `json:"online"`
+	// KeyExpiresAt and DaysUntilKeyRotation are null when keys of the group do not expire
+	KeyExpiresAt         *time.Time `json:"keyExpiresAt"`
+	DaysUntilKeyRotation *int       `json:"daysUntilKeyRotation"`
 }
 
+type ClientsResponse struct {
+	Items []ClientResponse `json:"items"`
+	// Total is the number of clients matching the filters
+	Total  int64        `json:"total"`
+	Limit  int          `json:"limit"`
+	Offset int          `json:"offset"`
+	Totals ClientTotals `json:"totals"`
+}
+
+// ClientTotals counts every client, regardless of the filters
+type ClientTotals struct {
+	Clients  int64 `json:"clients"`
+	Online   int64 `json:"online"`
+	Disabled int64 `json:"disabled"`
+	Expired  int64 `json:"expired"`
+}
+
+const (
+	defaultClientsLimit = 100
+	maxClientsLimit     = 1000
+)
+
+func newClientResponse(client database.Client, stats wireguard.PeerStats) ClientResponse {
+	response := ClientResponse{
+		Client:          client,
+		LatestHandshake: stats.LatestHandshake,
+		Endpoint:        stats.Endpoint,
+		SentBytes:       stats.SentBytes,
+		ReceivedBytes:   stats.ReceivedBytes,
+		Online:          stats.Online(),
+		KeyExpiresAt:    client.KeyExpiresAt(),
+	}
+	if response.KeyExpiresAt != nil {
+		// Started days left, 0 or negative when the key expired
+		days := int(math.Ceil(time.Until(*response.KeyExpiresAt).Hours() / 24))
+		response.DaysUntilKeyRotation = &days
+	}
+	return response
+}
+
+// GetClients returns a page of clients, see clientQuery for the filters and sort keys.
+// /api/clients lists every network unless ?network= is given.
 func GetClients(c *fiber.Ctx) error {
+	query, err := newClientQuery(c)
+	if err != nil {
+		return errBadRequest(err.Error())
+	}
+	if c.Params("network") != "" {
+		network, err := requestNetwork(c)
+		if err != nil {
+			return err
+		}
+		query.network = &network.ID
+	} else if name := c.Query("network"); name != "" {
+		network, err := wireguard.GetNetwork(name)
+		if errors.Is(err, wireguard.ErrNetworkNotFound) {
+			return errBadRequest("Unknown network " + name)
+		}
+		if err != nil {
+			return errDatabase(err)
+		}
+		query.network = &network.ID
+	}
+
+	stats, err := wireguard.GetPeerStats()
+	if err != nil {
+		return errWireGuard(err)
+	}
 
-	clients := make([]database.Client, 100)
-	database.Connection.Find(&clients)
-
-	response := make([]ClientResponse, 100)
-	for _, c := range clients {
-		res := ClientResponse{
-			Client:          c,
-			LatestHandshake: "2021-01-09T21:15:37.189Z",
-			Endpoint:        "77.18.62.145:15427",
-			SentBytes:       32165498,
-			ReceivedBytes:   132546,
+	response := ClientsResponse{
+		Items:  []ClientResponse{},
+		Limit:  query.limit,
+		Offset: query.offset,
+	}
+
+	var clients []database.Client
+	if query.needsStats() {
+		// The online status, handshakes and traffic are only known by the device, so the page is cut out here
+		if err = query.filter().Find(&clients).Error; err != nil {
+			return errDatabase(err)
+		}
+		for _, client := range clients {
+			item := newClientResponse(client, stats[client.PublicKey])
+			if query.online == nil || item.Online == *query.online {
+				response.Items = append(response.Items, item)
+			}
+		}
+		sort.SliceStable(response.Items, func(i, j int) bool {
+			return query.less(&response.Items[i], &response.Items[j])
+		})
+
+		response.Total = int64(len(response.Items))
+		if query.offset >= len(response.Items) {
+			response.Items = []ClientResponse{}
+		} else {
+			end := query.offset + query.limit
+			if end > len(response.Items) {
+				end = len(response.Items)
+			}
+			response.Items = response.Items[query.offset:end]
+		}
+	} else {
+		if err = query.filter().Count(&response.Total).Error; err != nil {
+			return errDatabase(err)
+		}
+		err = query.filter().Order(query.order()).Limit(query.limit).Offset(query.offset).Find(&clients).Error
+		if err != nil {
+			return errDatabase(err)
+		}
+		for _, client := range clients {
+			response.Items = append(response.Items, newClientResponse(client, stats[client.PublicKey]))
 		}
-		response = append(response, res)
 	}
 
+	if response.Totals, err = clientTotals(stats); err != nil {
+		return errDatabase(err)
+	}
 	return c.Status(http.StatusOK).JSON(response)
 }
 
+func clientTotals(stats map[string]wireguard.PeerStats) (ClientTotals, error) {
+	totals := ClientTotals{}
+	if err := database.Connection.Model(&database.Client{}).Count(&totals.Clients).Error; err != nil {
+		return totals, err
+	}
+	if err := database.Connection.Model(&database.Client{}).Where("disabled = ?", true).Count(&totals.Disabled).Error; err != nil {
+		return totals, err
+	}
+	if err := database.Connection.Model(&database.Client{}).Where("expires_at <= ?", time.Now()).Count(&totals.Expired).Error; err != nil {
+		return totals, err
+	}
+	for _, peer := range stats {
+		if peer.Online() {
+			totals.Online++
+		}
+	}
+	return totals, nil
+}
+
+// CreateClient adds a client to the network, the default network for /api/clients
 func CreateClient(c *fiber.Ctx) error {
+	network, err := requestNetwork(c)
+	if err != nil {
+		return err
+	}
 	var newClient = new(database.Client)
 	if err := c.BodyParser(newClient); err != nil {
-		return c.Status(http.StatusBadRequest).Format("Bad request")
+		return errBadRequest("Bad request")
 	}
+	if err := validateClient(network, newClient); err != nil {
+		return err
+	}
+	newClient.NetworkID = network.ID
+	// The UI renders the config with the key from GetConfig, which is the next key during a rotation
+	serverKey, _ := network.ConfigKey()
+	newClient.ServerKey = serverKey.String()
 
-	//TODO: Validate IP
-
-	database.Connection.Create(newClient)
-	wireguard.AddClient(newClient)
+	var existing int64
+	err = database.Connection.Model(&database.Client{}).
+		Where("public_key = ? OR allowed_ip4 = ?", newClient.PublicKey, newClient.AllowedIp4).
+		Count(&existing).Error
+	if err != nil {
+		return errDatabase(err)
+	}
+	if existing > 0 {
+		return errConflict("The public key or ip is already used by another client")
+	}
 
-	return c.Status(http.StatusOK).JSON(&ClientResponse{
-		Client:          *newClient,
-		LatestHandshake: "2021-01-09T21:15:37.189Z",
-		Endpoint:        "77.18.62.145:15427",
-		SentBytes:       32165498,
-		ReceivedBytes:   132546,
+	err = wireguard.Change(func(tx *gorm.DB) ([]database.Client, error) {
+		if err := tx.Create(newClient).Error; err != nil {
+			return nil, err
+		}
+		return []database.Client{*newClient}, nil
+	}, func(tx *gorm.DB) error {
+		return tx.Unscoped().Delete(newClient).Error
 	})
+	if err != nil {
+		return changeError(err)
+	}
+
+	return c.Status(http.StatusOK).JSON(newClientResponse(*newClient, wireguard.PeerStats{}))
 }
 
-func GetClient(c *fiber.Ctx) error {
-	id := c.Params("id")
-	if id == "" {
-		return c.Status(http.StatusBadRequest).Format("Bad request")
+// validateClient checks every field of a new client of the network, and reports all invalid fields at once
+func validateClient(network *wireguard.Network, client *database.Client) error {
+	invalid := validationErrors{}
+	client.Name = strings.TrimSpace(client.Name)
+	if client.Name == "" {
+		invalid.add("name", "name is required")
+	}
+
+	_, subnet, err := net.ParseCIDR(network.Subnet)
+	if err != nil {
+		return err
+	}
+	gateway := make(net.IP, len(subnet.IP))
+	copy(gateway, subnet.IP)
+	gateway[len(gateway)-1]++
+	ip, ipNet, err := net.ParseCIDR(client.AllowedIp4)
+	switch {
+	case err != nil || ip.To4() == nil || ipNet.String() != client.AllowedIp4 || !strings.HasSuffix(client.AllowedIp4, "/32"):
+		invalid.add("allowedIp4", "allowedIp4 must be a single address like 10.0.0.2/32")
+	case !subnet.Contains(ip):
+		invalid.add("allowedIp4", "allowedIp4 must be inside %s", network.Subnet)
+	case ip.Equal(gateway):
+		invalid.add("allowedIp4", "%s is reserved for the server", client.AllowedIp4)
+	}
+
+	if _, err := wgtypes.ParseKey(client.PublicKey); err != nil {
+		invalid.add("publicKey", "publicKey must be a base64 encoded WireGuard key")
+	}
+	for _, cidr := range strings.Split(client.AllowedIps, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			invalid.add("allowedIps", "%s is not a network like 192.168.1.0/24", cidr)
+		}
+	}
+	if client.PersistentKeepalive < 0 || client.PersistentKeepalive > 65535 {
+		invalid.add("persistentKeepalive", "persistentKeepalive must be between 0 and 65535 seconds")
+	}
+	return invalid.err()
+}
+
+// findClient loads the client in the id parameter
+func findClient(c *fiber.Ctx) (*database.Client, error) {
+	id, err := paramID(c)
+	if err != nil {
+		return nil, err
+	}
+
+	query := database.Connection.Limit(1)
+	// Under /networks/:network the client has to belong to that network
+	if c.Params("network") != "" {
+		network, err := requestNetwork(c)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("network_id = ?", network.ID)
 	}
 
 	client := new(database.Client)
-	database.Connection.Find(client, id)
-	if client.PublicKey == "" {
-		return c.Status(http.StatusNotFound).Format("Not found")
+	if err = query.Find(client, id).Error; err != nil {
+		return nil, errDatabase(err)
+	}
+	if client.ID == 0 {
+		return nil, errNotFound()
 	}
+	return client, nil
+}
 
-	var response = ClientResponse{
-		Client:          *client,
-		LatestHandshake: "2021-01-09T21:15:37.189Z",
-		Endpoint:        "77.18.62.145:15427",
-		SentBytes:       32165498,
-		ReceivedBytes:   132546,
+func GetClient(c *fiber.Ctx) error {
+	client, err := findClient(c)
+	if err != nil {
+		return err
 	}
 
-	return c.Status(http.StatusOK).JSON(response)
+	stats, err := wireguard.GetPeerStats()
+	if err != nil {
+		return errWireGuard(err)
+	}
+
+	return c.Status(http.StatusOK).JSON(newClientResponse(*client, stats[client.PublicKey]))
 }
 
-func DeleteClient(c *fiber.Ctx) error {
-	id := c.Params("id")
-	if id == "" {
-		return c.Status(http.StatusBadRequest).Format("Bad request")
+// DisableClient removes the client from the device, it is kept in the database
+func DisableClient(c *fiber.Ctx) error {
+	return setClientDisabled(c, true)
+}
+
+// EnableClient adds a disabled client to the device again, unless it expired.
+// Clients with a key that is too old are enabled by rotating the key.
+func EnableClient(c *fiber.Ctx) error {
+	return setClientDisabled(c, false)
+}
+
+func setClientDisabled(c *fiber.Ctx, disabled bool) error {
+	client, err := findClient(c)
+	if err != nil {
+		return err
+	}
+	if !disabled && client.KeyExpired() {
+		return errConflict("The key of the client is older than the maximum key age, rotate it to enable the client")
 	}
 
-	client := new(database.Client)
-	database.Connection.Find(client, id)
-	if client.PublicKey == "" {
-		return c.Status(http.StatusNotFound).Format("Not found")
+	previous := map[string]interface{}{"disabled": client.Disabled, "disabled_reason": client.DisabledReason}
+	err = wireguard.Change(func(tx *gorm.DB) ([]database.Client, error) {
+		return []database.Client{*client}, tx.Model(client).Updates(map[string]interface{}{
+			"disabled":        disabled,
+			"disabled_reason": "",
+		}).Error
+	}, func(tx *gorm.DB) error {
+		return tx.Model(client).Updates(previous).Error
+	})
+	if err != nil {
+		return changeError(err)
+	}
+
+	log.Printf("API: Set client %s disabled: %t", client.Name, disabled)
+	return c.Status(http.StatusOK).JSON(newClientResponse(*client, wireguard.PeerStats{}))
+}
+
+// GetClientConfig renders the wg-quick config of a client, the private key is only known to the client
+func GetClientConfig(c *fiber.Ctx) error {
+	client, err := findClient(c)
+	if err != nil {
+		return err
+	}
+
+	network, err := wireguard.ClientNetwork(client)
+	if err != nil {
+		return errDatabase(err)
+	}
+	conf := wireguard.RenderClientConf(network, client, "")
+	if err = wireguard.RecordConfig(network, client); err != nil {
+		return errDatabase(err)
 	}
 
-	wireguard.RemoveClient(client)
-	database.Connection.Delete(client)
+	c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+	return c.Status(http.StatusOK).Send(conf)
+}
+
+type RotateKeyRequest struct {
+	// PublicKey is the new key of the client, a key pair is generated when it is empty
+	PublicKey string `json:"publicKey"`
+}
+
+type RotateKeyResponse struct {
+	Client ClientResponse `json:"client"`
+	// Config is the wg-quick config with the new key, it has the private key when GeneratedKey is set
+	Config       string `json:"config"`
+	GeneratedKey bool   `json:"generatedKey"`
+}
+
+// RotateClientKey gives the client a new key, the id, ip and settings are kept
+func RotateClientKey(c *fiber.Ctx) error {
+	client, err := findClient(c)
+	if err != nil {
+		return err
+	}
+	request := RotateKeyRequest{}
+	if len(c.Body()) > 0 {
+		if err = c.BodyParser(&request); err != nil {
+			return errBadRequest("Bad request")
+		}
+	}
+	request.PublicKey = strings.TrimSpace(request.PublicKey)
+
+	privateKey, err := wireguard.RotateClientKey(client, request.PublicKey)
+	switch {
+	case errors.Is(err, wireguard.ErrInvalidKey):
+		invalid := validationErrors{}
+		invalid.add("publicKey", "publicKey must be a base64 encoded WireGuard key")
+		return invalid.err()
+	case errors.Is(err, wireguard.ErrKeyUsed):
+		return errConflict("The public key is already used by a client")
+	case err != nil:
+		return changeError(err)
+	}
+
+	if err = database.Connection.First(client, client.ID).Error; err != nil {
+		return errDatabase(err)
+	}
+	network, err := wireguard.ClientNetwork(client)
+	if err != nil {
+		return errDatabase(err)
+	}
+	return c.Status(http.StatusOK).JSON(RotateKeyResponse{
+		Client:       newClientResponse(*client, wireguard.PeerStats{}),
+		Config:       string(wireguard.RenderClientConf(network, client, privateKey)),
+		GeneratedKey: privateKey != "",
+	})
+}
+
+func DeleteClient(c *fiber.Ctx) error {
+	client, err := findClient(c)
+	if err != nil {
+		return err
+	}
+
+	// Deleted permanently, the ip and public key are unique and can be used again
+	deleted := *client
+	err = wireguard.Change(func(tx *gorm.DB) ([]database.Client, error) {
+		return []database.Client{deleted}, tx.Unscoped().Delete(client).Error
+	}, func(tx *gorm.DB) error {
+		return tx.Create(&deleted).Error
+	})
+	if err != nil {
+		return changeError(err)
+	}
 	return c.Status(http.StatusNoContent).JSON(nil)
 }
+
+// changeError tells a device that rejected a change apart from a database failure
+func changeError(err error) error {
+	deviceError := &wireguard.DeviceError{}
+	apiError := &Error{}
+	switch {
+	case errors.As(err, &apiError):
+		return err
+	case errors.As(err, &deviceError):
+		return errWireGuard(err)
+	}
+	return errDatabase(err)
+}
@@ -1,23 +1,27 @@
 package api
 
 import (
-	"github.com/Richard87/wg-vpn-server/config"
 	"github.com/Richard87/wg-vpn-server/database"
 	"github.com/gofiber/fiber/v2"
 	"log"
 	"net"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 const MTU = 1420
 
 type Config struct {
+	Network          string `json:"network"`
 	Endpoint         string `json:"endpoint"`
 	NextAvailableIp4 string `json:"nextAvailableIp4"`
 	PublicKey        string `json:"publicKey"`
 	RecommendedDNS   string `json:"recommendedDNS"`
 	Mtu              int    `json:"mtu"`
+	// NextPublicKey and NextEndpoint are set during a server key rotation, new configs should use them
+	NextPublicKey string `json:"nextPublicKey,omitempty"`
+	NextEndpoint  string `json:"nextEndpoint,omitempty"`
 }
 
 type Login struct {
@@ -25,7 +29,10 @@ type Login struct {
 	Password string `json:"password"`
 }
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token       string    `json:"token,omitempty"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	MfaRequired bool      `json:"mfaRequired,omitempty"`
+	MfaToken    string    `json:"mfaToken,omitempty"`
 }
 
 func inc(ip net.IP) {
@@ -37,8 +44,8 @@ func inc(ip net.IP) {
 	}
 }
 
-func findAvailableIps() []string {
-	ip, ipnet, err := net.ParseCIDR(config.Config.ClientsSubnet)
+func findAvailableIps(subnet string) []string {
+	ip, ipnet, err := net.ParseCIDR(subnet)
 	if err != nil {
 		return []string{}
 	}
@@ -64,8 +71,14 @@ func remove(s []string, r string) []string {
 	}
 	return s
 }
+
+// GetConfig returns the server settings for a new client of the network
 func GetConfig(c *fiber.Ctx) error {
-	ips := findAvailableIps()
+	network, err := requestNetwork(c)
+	if err != nil {
+		return err
+	}
+	ips := findAvailableIps(network.Subnet)
 	if len(ips) <= 1 {
 		log.Print("No IP's in range!")
 	}
@@ -73,7 +86,9 @@ func GetConfig(c *fiber.Ctx) error {
 	ips = ips[1:]
 
 	clients := []database.Client{}
-	database.Connection.Find(&clients)
+	if err := database.Connection.Where("network_id = ?", network.ID).Find(&clients).Error; err != nil {
+		return errDatabase(err)
+	}
 	for _, c := range clients {
 		remove(ips, c.AllowedIp4)
 	}
@@ -83,12 +98,19 @@ func GetConfig(c *fiber.Ctx) error {
 		nextAvailableIp4 = ips[0]
 	}
 
-	return c.Status(http.StatusOK).JSON(Config{
-		Endpoint:         config.Config.WgEndpoint + ":" + strconv.Itoa(config.Config.WgListenPort),
+	response := Config{
+		Network:          network.Name,
+		Endpoint:         network.Endpoint + ":" + strconv.Itoa(network.ListenPort),
 		NextAvailableIp4: nextAvailableIp4,
-		PublicKey:        config.Config.WgPublicKey.String(),
-		RecommendedDNS:   config.Config.WgRecommendedDns,
+		PublicKey:        network.PublicKey,
+		RecommendedDNS:   network.Dns,
 		Mtu:              MTU,
-	})
+	}
+	if next := network.NextPublicKey(); next != nil {
+		response.NextPublicKey = next.String()
+		response.NextEndpoint = network.ConfigEndpoint()
+	}
+
+	return c.Status(http.StatusOK).JSON(response)
 
 }
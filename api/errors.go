@@ -0,0 +1,173 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Error codes, clients should check the code and not the message
+const (
+	CodeBadRequest       = "bad_request"
+	CodeValidation       = "validation_failed"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeTotpRequired     = "totp_required"
+	CodeNotFound         = "not_found"
+	CodeConflict         = "conflict"
+	CodeTooManyRequests  = "too_many_requests"
+	CodeUnavailable      = "unavailable"
+	CodeIdentityProvider = "identity_provider_error"
+	CodeDatabase         = "database_error"
+	CodeWireGuard        = "wireguard_error"
+	CodeInternal         = "internal_error"
+)
+
+// ErrorResponse is the body of every error response
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	Fields    []FieldError `json:"fields,omitempty"`
+	RequestID string       `json:"requestId"`
+}
+
+// FieldError explains why a field of the request body is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error is returned by handlers, and turned into an ErrorResponse by ErrorHandler
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Fields  []FieldError
+	// cause is logged, but not sent to the caller
+	cause error
+}
+
+func (e *Error) Error() string {
+	if e.cause != nil {
+		return fmt.Sprintf("%s: %s", e.Message, e.cause)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+func NewError(status int, code string, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func errBadRequest(message string) *Error {
+	return NewError(http.StatusBadRequest, CodeBadRequest, message)
+}
+
+func errUnauthorized() *Error {
+	return NewError(http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+}
+
+func errForbidden(message string) *Error {
+	return NewError(http.StatusForbidden, CodeForbidden, message)
+}
+
+func errNotFound() *Error {
+	return NewError(http.StatusNotFound, CodeNotFound, "Not found")
+}
+
+func errConflict(message string) *Error {
+	return NewError(http.StatusConflict, CodeConflict, message)
+}
+
+// paramID parses the id parameter of the route
+func paramID(c *fiber.Ctx) (uint, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil || id == 0 {
+		return 0, errBadRequest("Invalid id")
+	}
+	return uint(id), nil
+}
+
+// validationErrors collects the invalid fields of a request
+type validationErrors []FieldError
+
+func (v *validationErrors) add(field string, format string, args ...interface{}) {
+	*v = append(*v, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// err is nil when every field is valid
+func (v validationErrors) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return &Error{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    CodeValidation,
+		Message: "The request has invalid fields",
+		Fields:  v,
+	}
+}
+
+// errDatabase hides the query from the caller, the details are logged with the request id
+func errDatabase(err error) *Error {
+	return &Error{Status: http.StatusInternalServerError, Code: CodeDatabase, Message: "Database error", cause: err}
+}
+
+// errWireGuard is returned when the device could not be configured, the message says why
+func errWireGuard(err error) *Error {
+	return &Error{Status: http.StatusBadGateway, Code: CodeWireGuard, Message: "WireGuard error: " + err.Error(), cause: err}
+}
+
+// ErrorHandler writes every error returned by a handler as an ErrorResponse
+func ErrorHandler(c *fiber.Ctx, err error) error {
+	apiError := &Error{}
+	fiberError := &fiber.Error{}
+	switch {
+	case errors.As(err, &apiError):
+	case errors.As(err, &fiberError):
+		apiError = &Error{Status: fiberError.Code, Code: fiberCode(fiberError.Code), Message: fiberError.Message}
+	default:
+		apiError = &Error{Status: http.StatusInternalServerError, Code: CodeInternal, Message: "Internal server error", cause: err}
+	}
+
+	requestID, _ := c.Locals("requestid").(string)
+	if apiError.Status >= http.StatusInternalServerError {
+		log.Printf("API: %s %s failed (request %s): %s", c.Method(), c.Path(), requestID, apiError)
+	}
+
+	return c.Status(apiError.Status).JSON(ErrorResponse{Error: ErrorBody{
+		Code:      apiError.Code,
+		Message:   apiError.Message,
+		Fields:    apiError.Fields,
+		RequestID: requestID,
+	}})
+}
+
+// fiberCode maps the errors of fiber itself, like unknown routes or bodies that are too large
+func fiberCode(status int) string {
+	switch status {
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed, http.StatusRequestEntityTooLarge, http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusTooManyRequests:
+		return CodeTooManyRequests
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	}
+	return CodeInternal
+}
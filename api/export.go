@@ -0,0 +1,24 @@
+package api
+
+import (
+	"github.com/Richard87/wg-vpn-server/wireguard"
+	"github.com/gofiber/fiber/v2"
+	"net/http"
+)
+
+// ExportWgConf renders the device of a network as a wg-quick (default) or ?format=setconf configuration, including
+// the private key
+func ExportWgConf(c *fiber.Ctx) error {
+	network, err := requestNetwork(c)
+	if err != nil {
+		return err
+	}
+	conf, err := wireguard.RenderConf(network, c.Query("format", wireguard.FormatWgQuick))
+	if err != nil {
+		return errBadRequest(err.Error())
+	}
+
+	c.Attachment(network.DeviceName + ".conf")
+	c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+	return c.Status(http.StatusOK).Send(conf)
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"github.com/Richard87/wg-vpn-server/wireguard"
+	"github.com/gofiber/fiber/v2"
+	"log"
+	"net/http"
+)
+
+// ImportConf creates clients from a wg-quick configuration in the request body.
+// ?dryRun=true only reports the result, ?adoptPrivateKey=true also takes over the [Interface] private key.
+func ImportConf(c *fiber.Ctx) error {
+	conf, err := wireguard.ParseConf(bytes.NewReader(c.Body()))
+	if err != nil {
+		return errBadRequest(err.Error())
+	}
+
+	result, err := wireguard.Import(conf, wireguard.ImportOptions{
+		AdoptPrivateKey: c.Query("adoptPrivateKey") == "true",
+		DryRun:          c.Query("dryRun") == "true",
+	})
+	if deviceError := (&wireguard.DeviceError{}); errors.As(err, &deviceError) {
+		return errWireGuard(err)
+	} else if err != nil {
+		return NewError(http.StatusUnprocessableEntity, CodeValidation, err.Error())
+	}
+
+	if result.AdoptedPrivateKey && !result.DryRun {
+		if err = wireguard.Sync(); errors.Is(err, wireguard.ErrDeviceNotRunning) {
+			log.Printf("API: %s, the adopted key is used from the next start", err)
+		} else if err != nil {
+			return errWireGuard(err)
+		}
+	}
+
+	return c.Status(http.StatusOK).JSON(result)
+}
@@ -0,0 +1,31 @@
+package api
+
+import (
+	"embed"
+	"github.com/Richard87/wg-vpn-server/config"
+	"github.com/Richard87/wg-vpn-server/database"
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+// TestMain runs the tests against a new sqlite database and key files in a temporary data folder
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "wg-vpn-server-api-")
+	if err != nil {
+		log.Fatalf("Could not create data folder: %s", err)
+	}
+	if os.Getenv("WG_VPN_TEST_LOG") == "" {
+		log.SetOutput(io.Discard)
+	}
+
+	config.InitCommand([]string{"-data-dir", dir, "-wg-endpoint", "vpn.example.com"})
+	database.InitDatabase()
+	initSigningKeys()
+	Router = newRouter(embed.FS{})
+
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"errors"
+	"github.com/Richard87/wg-vpn-server/config"
+	"github.com/Richard87/wg-vpn-server/wireguard"
+	"github.com/gofiber/fiber/v2"
+	"net"
+	"net/http"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+var networkName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// requestNetwork is the network in the :network parameter, the default network for routes without it
+func requestNetwork(c *fiber.Ctx) (*wireguard.Network, error) {
+	name := c.Params("network", wireguard.DefaultNetwork)
+	network, err := wireguard.GetNetwork(name)
+	if errors.Is(err, wireguard.ErrNetworkNotFound) {
+		return nil, errNotFound()
+	}
+	if err != nil {
+		return nil, errDatabase(err)
+	}
+	return network, nil
+}
+
+func GetNetworks(c *fiber.Ctx) error {
+	networks, err := wireguard.GetNetworks()
+	if err != nil {
+		return errDatabase(err)
+	}
+	return c.Status(http.StatusOK).JSON(networks)
+}
+
+func GetNetwork(c *fiber.Ctx) error {
+	network, err := requestNetwork(c)
+	if err != nil {
+		return err
+	}
+	return c.Status(http.StatusOK).JSON(network)
+}
+
+// CreateNetwork adds a network with a new key pair, its device is started right away
+func CreateNetwork(c *fiber.Ctx) error {
+	request := wireguard.NewNetwork{}
+	if err := c.BodyParser(&request); err != nil {
+		return errBadRequest("Bad request")
+	}
+
+	networks, err := wireguard.GetNetworks()
+	if err != nil {
+		return errDatabase(err)
+	}
+	for _, network := range networks {
+		if network.Name == strings.TrimSpace(request.Name) {
+			return errConflict("A network with this name already exists")
+		}
+	}
+	if err = validateNetwork(&request, networks); err != nil {
+		return err
+	}
+
+	network, err := wireguard.CreateNetwork(request)
+	if err != nil {
+		return changeError(err)
+	}
+	return c.Status(http.StatusCreated).JSON(network)
+}
+
+// validateNetwork checks every field of a new network, the device, port and subnet must differ from the other networks
+func validateNetwork(request *wireguard.NewNetwork, networks []wireguard.Network) error {
+	invalid := validationErrors{}
+	request.Name = strings.TrimSpace(request.Name)
+	if !networkName.MatchString(request.Name) {
+		invalid.add("name", "name must be up to 32 lowercase letters, digits, - or _")
+	}
+
+	request.DeviceName = strings.TrimSpace(request.DeviceName)
+	switch {
+	case request.DeviceName == "" || len(request.DeviceName) > 15 || strings.ContainsAny(request.DeviceName, "/ "):
+		invalid.add("deviceName", "deviceName must be an interface name of up to 15 characters")
+	case runtime.GOOS == "darwin" && !strings.HasPrefix(request.DeviceName, "utun"):
+		invalid.add("deviceName", "deviceName must be utun[0-9]* on Mac")
+	}
+
+	if request.ListenPort < 1 || request.ListenPort > 65535 {
+		invalid.add("listenPort", "listenPort must be between 1 and 65535")
+	}
+
+	_, subnet, err := net.ParseCIDR(request.Subnet)
+	if err != nil || subnet.IP.To4() == nil || subnet.String() != request.Subnet {
+		invalid.add("subnet", "subnet must be an IPv4 network like 10.1.0.0/24")
+		subnet = nil
+	} else if ones, _ := subnet.Mask.Size(); ones > 30 {
+		invalid.add("subnet", "subnet must have room for the server and clients, /30 or larger")
+	}
+
+	for _, network := range networks {
+		if network.DeviceName == request.DeviceName {
+			invalid.add("deviceName", "%s is used by network %s", request.DeviceName, network.Name)
+		}
+		if network.ListenPort == request.ListenPort {
+			invalid.add("listenPort", "port %d is used by network %s", request.ListenPort, network.Name)
+		}
+		_, other, err := net.ParseCIDR(network.Subnet)
+		if subnet != nil && err == nil && (other.Contains(subnet.IP) || subnet.Contains(other.IP)) {
+			invalid.add("subnet", "%s overlaps %s of network %s", request.Subnet, network.Subnet, network.Name)
+		}
+	}
+
+	if request.Endpoint = strings.TrimSpace(request.Endpoint); request.Endpoint == "" {
+		request.Endpoint = config.Current().WgEndpoint
+	}
+	if request.Dns = strings.TrimSpace(request.Dns); request.Dns == "" {
+		request.Dns = config.Current().WgRecommendedDns
+	}
+	return invalid.err()
+}
+
+// DeleteNetwork stops the device of a network without clients and removes it
+func DeleteNetwork(c *fiber.Ctx) error {
+	network, err := requestNetwork(c)
+	if err != nil {
+		return err
+	}
+	if network.Default {
+		return errConflict("The default network is configured with the -wg-* options, and can not be deleted")
+	}
+
+	err = wireguard.DeleteNetwork(network)
+	if errors.Is(err, wireguard.ErrNetworkNotEmpty) {
+		return errConflict("The network still has clients, delete them first")
+	}
+	if err != nil {
+		return errDatabase(err)
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
@@ -0,0 +1,458 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/config"
+	"github.com/Richard87/wg-vpn-server/database"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gofiber/fiber/v2"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcCookie = "oidc"
+	// oidcJwksRefresh is how often an unknown kid may fetch the key set of the provider again
+	oidcJwksRefresh = time.Minute
+)
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcJwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type oidcTokenResponse struct {
+	IdToken string `json:"id_token"`
+	Error   string `json:"error"`
+}
+
+type AuthMethods struct {
+	LocalLogin bool `json:"localLogin"`
+	Sso        bool `json:"sso"`
+}
+
+var (
+	oidcHttpClient = &http.Client{Timeout: 10 * time.Second}
+	oidcProvider   = struct {
+		sync.Mutex
+		discovery *oidcDiscovery
+		keys      map[string]interface{}
+		fetchedAt time.Time
+	}{}
+)
+
+func GetAuthMethods(c *fiber.Ctx) error {
+	return c.JSON(AuthMethods{
+		LocalLogin: !config.Config.DisableLocalLogin,
+		Sso:        config.Config.OidcIssuer != "",
+	})
+}
+
+// OidcLogin redirects to the identity provider, using the authorization code flow with PKCE
+func OidcLogin(c *fiber.Ctx) error {
+	if config.Config.OidcIssuer == "" {
+		return errNotFound()
+	}
+
+	discovery, err := getOidcDiscovery()
+	if err != nil {
+		log.Printf("API: Could not discover OIDC provider: %s", err)
+		return NewError(http.StatusBadGateway, CodeIdentityProvider, "Identity provider unavailable")
+	}
+
+	state, err := generateToken()
+	if err != nil {
+		return err
+	}
+	nonce, err := generateToken()
+	if err != nil {
+		return err
+	}
+	verifier, err := generateToken()
+	if err != nil {
+		return err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcCookie,
+		Value:    state + "." + nonce + "." + verifier,
+		MaxAge:   600,
+		Expires:  time.Now().Add(10 * time.Minute),
+		Secure:   true,
+		HTTPOnly: true,
+		SameSite: "lax",
+	})
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", config.Config.OidcClientId)
+	query.Set("redirect_uri", oidcRedirectUrl(c))
+	query.Set("scope", config.Config.OidcScopes)
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return c.Redirect(discovery.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// OidcCallback exchanges the authorization code, verifies the ID token and logs the user in
+func OidcCallback(c *fiber.Ctx) error {
+	if config.Config.OidcIssuer == "" {
+		return errNotFound()
+	}
+
+	cookie := strings.Split(c.Cookies(oidcCookie), ".")
+	c.ClearCookie(oidcCookie)
+	if len(cookie) != 3 || c.Query("state") != cookie[0] {
+		return errBadRequest("Invalid state")
+	}
+	if e := c.Query("error"); e != "" {
+		log.Printf("API: OIDC login failed: %s (%s)", e, c.Query("error_description"))
+		return errUnauthorized()
+	}
+
+	idToken, err := exchangeOidcCode(c.Query("code"), cookie[2], oidcRedirectUrl(c))
+	if err != nil {
+		log.Printf("API: Could not exchange OIDC code: %s", err)
+		return errUnauthorized()
+	}
+
+	claims, err := verifyIdToken(idToken, cookie[1])
+	if err != nil {
+		log.Printf("API: Invalid OIDC ID token: %s", err)
+		return errUnauthorized()
+	}
+
+	user, err := oidcUser(claims)
+	if apiError := (&Error{}); errors.As(err, &apiError) {
+		return err
+	}
+	if err != nil {
+		log.Printf("API: OIDC login refused: %s", err)
+		return errForbidden("Forbidden")
+	}
+
+	// The identity provider does not replace the second factor, the UI asks for the code like after a password
+	if user.TotpEnabled {
+		response, err := newMfaToken(user)
+		if err != nil {
+			return err
+		}
+		c.Cookie(&fiber.Cookie{
+			Name:     mfaCookie,
+			Value:    response.MfaToken,
+			MaxAge:   int(mfaTokenTtl.Seconds()),
+			Expires:  time.Now().Add(mfaTokenTtl),
+			Secure:   true,
+			HTTPOnly: true,
+			SameSite: "strict",
+		})
+		return c.Redirect("/?sso=1&mfa=1", http.StatusFound)
+	}
+
+	if _, err = startSession(c, user); err != nil {
+		return err
+	}
+
+	// The UI picks up the session with the refresh cookie
+	return c.Redirect("/?sso=1", http.StatusFound)
+}
+
+func oidcRedirectUrl(c *fiber.Ctx) string {
+	if config.Config.OidcRedirectUrl != "" {
+		return config.Config.OidcRedirectUrl
+	}
+	return c.BaseURL() + "/oidc/callback"
+}
+
+func getOidcDiscovery() (*oidcDiscovery, error) {
+	oidcProvider.Lock()
+	defer oidcProvider.Unlock()
+
+	if oidcProvider.discovery != nil {
+		return oidcProvider.discovery, nil
+	}
+
+	discovery := &oidcDiscovery{}
+	wellKnown := strings.TrimSuffix(config.Config.OidcIssuer, "/") + "/.well-known/openid-configuration"
+	if err := getJson(wellKnown, discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != config.Config.OidcIssuer {
+		return nil, fmt.Errorf("issuer mismatch, expected %s got %s", config.Config.OidcIssuer, discovery.Issuer)
+	}
+
+	oidcProvider.discovery = discovery
+	return discovery, nil
+}
+
+func exchangeOidcCode(code string, verifier string, redirectUrl string) (string, error) {
+	discovery, err := getOidcDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectUrl)
+	form.Set("code_verifier", verifier)
+
+	request, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(url.QueryEscape(config.Config.OidcClientId), url.QueryEscape(config.Config.OidcClientSecret))
+
+	response, err := oidcHttpClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	tokens := oidcTokenResponse{}
+	if err = json.NewDecoder(response.Body).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("invalid token response: %w", err)
+	}
+	if response.StatusCode != http.StatusOK || tokens.Error != "" {
+		return "", fmt.Errorf("token endpoint returned %d: %s", response.StatusCode, tokens.Error)
+	}
+	if tokens.IdToken == "" {
+		return "", fmt.Errorf("no id_token in token response")
+	}
+
+	return tokens.IdToken, nil
+}
+
+func verifyIdToken(idToken string, nonce string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return getOidcKey(kid)
+	})
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if !claims.VerifyIssuer(config.Config.OidcIssuer, true) {
+		return nil, fmt.Errorf("unexpected issuer: %v", claims["iss"])
+	}
+	if !claimContains(claims["aud"], config.Config.OidcClientId) {
+		return nil, fmt.Errorf("unexpected audience: %v", claims["aud"])
+	}
+	if claims["nonce"] != nonce {
+		return nil, fmt.Errorf("nonce mismatch")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("token does not expire")
+	}
+
+	return claims, nil
+}
+
+// getOidcKey finds the provider key for kid, the key set is fetched again when a key is unknown,
+// at most once per oidcJwksRefresh so tokens with made up kids can not make us flood the provider
+func getOidcKey(kid string) (interface{}, error) {
+	oidcProvider.Lock()
+	key, ok := oidcProvider.keys[kid]
+	recent := time.Since(oidcProvider.fetchedAt) < oidcJwksRefresh
+	if !ok && !recent {
+		oidcProvider.fetchedAt = time.Now()
+	}
+	oidcProvider.Unlock()
+	if ok {
+		return key, nil
+	}
+	if recent {
+		return nil, fmt.Errorf("unknown key: %s", kid)
+	}
+
+	discovery, err := getOidcDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	jwks := struct {
+		Keys []oidcJwk `json:"keys"`
+	}{}
+	if err = getJson(discovery.JwksUri, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range jwks.Keys {
+		publicKey, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("API: Skipping OIDC key %s: %s", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = publicKey
+	}
+
+	oidcProvider.Lock()
+	oidcProvider.keys = keys
+	oidcProvider.Unlock()
+
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown key: %s", kid)
+	}
+	return key, nil
+}
+
+func (k oidcJwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+}
+
+// oidcUser finds or creates the user for the ID token, and updates its role from the groups claim on every login
+func oidcUser(claims jwt.MapClaims) (*database.User, error) {
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("missing sub claim")
+	}
+
+	username, _ := claims[config.Config.OidcUsernameClaim].(string)
+	if username == "" {
+		username = subject
+	}
+
+	role := config.Current().OidcDefaultRole
+	for _, mapping := range config.Current().OidcRoles {
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) == 2 && claimContains(claims[config.Config.OidcGroupsClaim], parts[0]) {
+			role = parts[1]
+			break
+		}
+	}
+	if role == "" {
+		return nil, fmt.Errorf("%s is not in any group with access", username)
+	}
+
+	user := database.User{}
+	if err := database.Connection.Where("subject = ?", subject).Limit(1).Find(&user).Error; err != nil {
+		return nil, errDatabase(err)
+	}
+	if user.ID == 0 {
+		existing := database.User{}
+		if err := database.Connection.Where("username = ?", username).Limit(1).Find(&existing).Error; err != nil {
+			return nil, errDatabase(err)
+		}
+		if existing.ID != 0 {
+			return nil, fmt.Errorf("username %s is already used by another user", username)
+		}
+
+		user = database.User{Username: username, Role: role, Subject: subject}
+		if err := database.Connection.Create(&user).Error; err != nil {
+			return nil, errDatabase(err)
+		}
+		log.Printf("API: Created user %s from single sign-on", username)
+		return &user, nil
+	}
+
+	if user.Role != role {
+		user.Role = role
+		if err := database.Connection.Save(&user).Error; err != nil {
+			return nil, errDatabase(err)
+		}
+	}
+
+	return &user, nil
+}
+
+// claimContains checks a claim that can be either a string or a list of strings
+func claimContains(claim interface{}, value string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == value
+	case []interface{}:
+		for _, item := range v {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getJson(url string, target interface{}) error {
+	response, err := oidcHttpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", url, response.StatusCode)
+	}
+	return json.NewDecoder(response.Body).Decode(target)
+}
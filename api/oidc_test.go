@@ -0,0 +1,371 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/Richard87/wg-vpn-server/config"
+	"github.com/Richard87/wg-vpn-server/database"
+	"github.com/dgrijalva/jwt-go"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	mockClientId     = "wg-vpn-server"
+	mockClientSecret = "secret"
+)
+
+// mockOidcProvider is an identity provider with discovery, a key set and a token endpoint that checks PKCE.
+// authorize stands in for the login page of the provider.
+type mockOidcProvider struct {
+	server       *httptest.Server
+	key          *rsa.PrivateKey
+	jwksRequests int32
+
+	sync.Mutex
+	subject  string
+	username string
+	groups   []string
+	codes    map[string]mockOidcCode
+}
+
+type mockOidcCode struct {
+	challenge   string
+	nonce       string
+	redirectUri string
+}
+
+func newMockOidcProvider(t *testing.T) *mockOidcProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockOidcProvider{key: key, codes: map[string]mockOidcCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                p.server.URL,
+			AuthorizationEndpoint: p.server.URL + "/authorize",
+			TokenEndpoint:         p.server.URL + "/token",
+			JwksUri:               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&p.jwksRequests, 1)
+		_ = json.NewEncoder(w).Encode(map[string][]oidcJwk{"keys": {{
+			Kid: "k1",
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	previous := *config.Config
+	config.Config.OidcIssuer = p.server.URL
+	config.Config.OidcClientId = mockClientId
+	config.Config.OidcClientSecret = mockClientSecret
+	config.Current().OidcRoles = config.StringsFlag{"vpn-admins=admin"}
+	config.Current().OidcDefaultRole = ""
+	t.Cleanup(func() {
+		*config.Config = previous
+		resetOidcProvider()
+	})
+	resetOidcProvider()
+	return p
+}
+
+func resetOidcProvider() {
+	oidcProvider.Lock()
+	oidcProvider.discovery = nil
+	oidcProvider.keys = nil
+	oidcProvider.fetchedAt = time.Time{}
+	oidcProvider.Unlock()
+}
+
+func (p *mockOidcProvider) token(w http.ResponseWriter, r *http.Request) {
+	fail := func(reason string) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(oidcTokenResponse{Error: reason})
+	}
+	if id, secret, ok := r.BasicAuth(); !ok || id != mockClientId || secret != mockClientSecret {
+		fail("invalid_client")
+		return
+	}
+	if r.FormValue("grant_type") != "authorization_code" {
+		fail("unsupported_grant_type")
+		return
+	}
+
+	p.Lock()
+	code, ok := p.codes[r.FormValue("code")]
+	delete(p.codes, r.FormValue("code"))
+	p.Unlock()
+	if !ok || code.redirectUri != r.FormValue("redirect_uri") {
+		fail("invalid_grant")
+		return
+	}
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != code.challenge {
+		fail("invalid_grant")
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(oidcTokenResponse{IdToken: p.idToken("k1", code.nonce)})
+}
+
+func (p *mockOidcProvider) idToken(kid string, nonce string) string {
+	p.Lock()
+	claims := jwt.MapClaims{
+		"iss":                p.server.URL,
+		"aud":                mockClientId,
+		"sub":                p.subject,
+		"preferred_username": p.username,
+		"groups":             p.groups,
+		"nonce":              nonce,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(time.Minute).Unix(),
+	}
+	p.Unlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		panic(err)
+	}
+	return signed
+}
+
+// authorize checks the authorization request like the provider would, and returns the code for the callback
+func (p *mockOidcProvider) authorize(t *testing.T, location string) url.Values {
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location, p.server.URL+"/authorize?") {
+		t.Fatalf("Redirected to %s, expected the authorization endpoint", location)
+	}
+	query := u.Query()
+	if query.Get("response_type") != "code" || query.Get("client_id") != mockClientId {
+		t.Fatalf("Unexpected authorization request: %s", query.Encode())
+	}
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("Authorization request without PKCE: %s", query.Encode())
+	}
+
+	code, err := generateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Lock()
+	p.codes[code] = mockOidcCode{
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+		redirectUri: query.Get("redirect_uri"),
+	}
+	p.Unlock()
+
+	return url.Values{"code": {code}, "state": {query.Get("state")}}
+}
+
+func (p *mockOidcProvider) setUser(subject string, username string, groups ...string) {
+	p.Lock()
+	defer p.Unlock()
+	p.subject = subject
+	p.username = username
+	p.groups = groups
+}
+
+// login runs the authorization code flow, tamper can change the callback before it is sent
+func (p *mockOidcProvider) login(t *testing.T, tamper func(query url.Values, cookie *http.Cookie)) *http.Response {
+	response, err := Router.Test(httptest.NewRequest(http.MethodGet, "/oidc/login", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusFound {
+		t.Fatalf("Login returned %d, expected a redirect", response.StatusCode)
+	}
+	cookie := findCookie(response, oidcCookie)
+	if cookie == nil {
+		t.Fatal("Login did not set the oidc cookie")
+	}
+
+	query := p.authorize(t, response.Header.Get("Location"))
+	if tamper != nil {
+		tamper(query, cookie)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/oidc/callback?"+query.Encode(), nil)
+	request.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	response, err = Router.Test(request, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func findCookie(response *http.Response, name string) *http.Cookie {
+	for _, cookie := range response.Cookies() {
+		if cookie.Name == name && cookie.Value != "" {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func findSsoUser(t *testing.T, subject string) *database.User {
+	user := database.User{}
+	if err := database.Connection.Where("subject = ?", subject).Limit(1).Find(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.ID == 0 {
+		return nil
+	}
+	return &user
+}
+
+func TestOidcLoginCreatesUserWithGroupRole(t *testing.T) {
+	p := newMockOidcProvider(t)
+	p.setUser("sub-alice", "alice", "staff", "vpn-admins")
+
+	response := p.login(t, nil)
+	if response.StatusCode != http.StatusFound || response.Header.Get("Location") != "/?sso=1" {
+		t.Fatalf("Callback returned %d to %s, expected a redirect to the UI", response.StatusCode, response.Header.Get("Location"))
+	}
+	if findCookie(response, refreshCookie) == nil {
+		t.Fatal("Callback did not start a session")
+	}
+
+	user := findSsoUser(t, "sub-alice")
+	if user == nil || user.Username != "alice" || user.Role != "admin" {
+		t.Fatalf("Expected alice to be created as admin, got %+v", user)
+	}
+
+	// The role follows the groups on every login
+	config.Current().OidcDefaultRole = "user"
+	p.setUser("sub-alice", "alice", "staff")
+	if response = p.login(t, nil); response.StatusCode != http.StatusFound {
+		t.Fatalf("Second login returned %d", response.StatusCode)
+	}
+	if user = findSsoUser(t, "sub-alice"); user.Role != "user" {
+		t.Fatalf("Expected the role to change to user, got %s", user.Role)
+	}
+}
+
+func TestOidcLoginWithoutGroupIsRefused(t *testing.T) {
+	p := newMockOidcProvider(t)
+	p.setUser("sub-bob", "bob", "staff")
+
+	if response := p.login(t, nil); response.StatusCode != http.StatusForbidden {
+		t.Fatalf("Callback returned %d, expected 403", response.StatusCode)
+	}
+	if findSsoUser(t, "sub-bob") != nil {
+		t.Fatal("A user was created without a role")
+	}
+}
+
+func TestOidcLoginChecksStateAndVerifier(t *testing.T) {
+	p := newMockOidcProvider(t)
+	p.setUser("sub-carol", "carol", "vpn-admins")
+
+	response := p.login(t, func(query url.Values, cookie *http.Cookie) {
+		query.Set("state", "forged")
+	})
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Callback with another state returned %d, expected 400", response.StatusCode)
+	}
+
+	response = p.login(t, func(query url.Values, cookie *http.Cookie) {
+		parts := strings.Split(cookie.Value, ".")
+		cookie.Value = parts[0] + "." + parts[1] + ".forged"
+	})
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Callback with another code verifier returned %d, expected 401", response.StatusCode)
+	}
+	if findSsoUser(t, "sub-carol") != nil {
+		t.Fatal("A user was created by a failed login")
+	}
+}
+
+func TestOidcUnknownKeyFetchesKeySetOnce(t *testing.T) {
+	p := newMockOidcProvider(t)
+	p.setUser("sub-dave", "dave", "vpn-admins")
+
+	for i := 0; i < 3; i++ {
+		if _, err := verifyIdToken(p.idToken("unknown", "nonce"), "nonce"); err == nil {
+			t.Fatal("A token signed with an unknown key was accepted")
+		}
+	}
+	if requests := atomic.LoadInt32(&p.jwksRequests); requests != 1 {
+		t.Fatalf("The key set was fetched %d times, expected 1", requests)
+	}
+
+	if _, err := verifyIdToken(p.idToken("k1", "nonce"), "nonce"); err != nil {
+		t.Fatalf("Valid token was refused: %s", err)
+	}
+}
+
+func TestOidcLoginAsksForTotp(t *testing.T) {
+	p := newMockOidcProvider(t)
+	p.setUser("sub-erin", "erin", "vpn-admins")
+	if response := p.login(t, nil); response.StatusCode != http.StatusFound {
+		t.Fatalf("First login returned %d", response.StatusCode)
+	}
+
+	secret := []byte("12345678901234567890")
+	user := findSsoUser(t, "sub-erin")
+	err := database.Connection.Model(user).Updates(map[string]interface{}{
+		"totp_secret":  base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret),
+		"totp_enabled": true,
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := p.login(t, nil)
+	if response.StatusCode != http.StatusFound || response.Header.Get("Location") != "/?sso=1&mfa=1" {
+		t.Fatalf("Callback returned %d to %s, expected a redirect to the code prompt", response.StatusCode, response.Header.Get("Location"))
+	}
+	if findCookie(response, refreshCookie) != nil {
+		t.Fatal("A session was started without the second factor")
+	}
+	mfa := findCookie(response, mfaCookie)
+	if mfa == nil {
+		t.Fatal("Callback did not set the mfa cookie")
+	}
+
+	verify := func(code string) *http.Response {
+		request := httptest.NewRequest(http.MethodPost, "/authenticate/totp", strings.NewReader(`{"code":"`+code+`"}`))
+		request.Header.Set("Content-Type", "application/json")
+		request.AddCookie(&http.Cookie{Name: mfa.Name, Value: mfa.Value})
+		response, err := Router.Test(request, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	if response = verify("000000"); response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("A wrong code returned %d, expected 401", response.StatusCode)
+	}
+	if response = verify(totpCode(secret, time.Now().Unix()/totpPeriod)); response.StatusCode != http.StatusOK {
+		t.Fatalf("The right code returned %d, expected 200", response.StatusCode)
+	}
+	if findCookie(response, refreshCookie) == nil {
+		t.Fatal("No session was started after the second factor")
+	}
+}
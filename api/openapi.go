@@ -0,0 +1,74 @@
+package api
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//go:embed openapi.json
+var openApiSpec []byte
+
+var routeParam = regexp.MustCompile(`:(\w+)`)
+
+// GetOpenApi serves the OpenAPI 3 document of this API. openapi.json describes every route, update it together
+// with the handlers.
+func GetOpenApi(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Status(http.StatusOK).Send(openApiSpec)
+}
+
+// checkOpenApi logs the routes that are missing from openapi.json, and the documented routes that do not exist
+func checkOpenApi() {
+	for _, problem := range openApiDrift(Router) {
+		log.Printf("API: %s", problem)
+	}
+}
+
+// openApiDrift compares the routes of router with the operations in openapi.json
+func openApiDrift(router *fiber.App) []string {
+	spec := struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}{}
+	if err := json.Unmarshal(openApiSpec, &spec); err != nil {
+		return []string{fmt.Sprintf("Invalid openapi.json: %s", err)}
+	}
+
+	var problems []string
+	routes := map[string]bool{}
+	for _, stack := range router.Stack() {
+		for _, route := range stack {
+			// Middleware is mounted on / and /api, HEAD is added for every GET
+			if route.Path == "/" || route.Path == "/api" || route.Method == http.MethodHead || route.Method == http.MethodOptions {
+				continue
+			}
+			path := routeParam.ReplaceAllString(route.Path, "{$1}")
+			method := strings.ToLower(route.Method)
+			routes[method+" "+path] = true
+			if _, ok := spec.Paths[path][method]; !ok {
+				problems = append(problems, fmt.Sprintf("%s %s is missing from openapi.json", route.Method, path))
+			}
+		}
+	}
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			// Path items also hold parameters and descriptions
+			if !operationMethods[method] {
+				continue
+			}
+			if !routes[method+" "+path] {
+				problems = append(problems, fmt.Sprintf("%s %s is in openapi.json, but there is no such route", strings.ToUpper(method), path))
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+var operationMethods = map[string]bool{"get": true, "put": true, "post": true, "delete": true, "patch": true}
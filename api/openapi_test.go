@@ -0,0 +1,448 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/database"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// contract checks responses of the router against openapi.json
+type contract struct {
+	t     *testing.T
+	spec  map[string]interface{}
+	token string
+}
+
+func newContract(t *testing.T) *contract {
+	spec := map[string]interface{}{}
+	if err := json.Unmarshal(openApiSpec, &spec); err != nil {
+		t.Fatalf("Invalid openapi.json: %s", err)
+	}
+
+	user := &database.User{Username: "contract", Role: "admin"}
+	if err := database.Connection.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	plain := database.ApiTokenPrefix + "contractcontractcontract"
+	token := &database.ApiToken{UserID: user.ID, Name: "contract", Prefix: plain[:12], Hash: database.HashToken(plain), Scope: database.ScopeWrite}
+	if err := database.Connection.Create(token).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		database.Connection.Unscoped().Delete(token)
+		database.Connection.Unscoped().Delete(user)
+	})
+
+	return &contract{t: t, spec: spec, token: plain}
+}
+
+// operation finds the documented operation of a request, literal paths win over paths with parameters
+func (c *contract) operation(method string, path string) (string, map[string]interface{}) {
+	paths := c.spec["paths"].(map[string]interface{})
+	var templates []string
+	for template := range paths {
+		templates = append(templates, template)
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		return strings.Count(templates[i], "{") < strings.Count(templates[j], "{")
+	})
+
+	for _, template := range templates {
+		pattern := "^" + regexp.MustCompile(`\{[^}]+}`).ReplaceAllString(template, "[^/]+") + "$"
+		if !regexp.MustCompile(pattern).MatchString(path) {
+			continue
+		}
+		if operation, ok := paths[template].(map[string]interface{})[strings.ToLower(method)]; ok {
+			return method + " " + template, operation.(map[string]interface{})
+		}
+	}
+	return "", nil
+}
+
+// request sends a request through the router, checks that the status is documented and that the body matches the
+// documented schema. It returns the status and the decoded JSON body.
+func (c *contract) request(method string, target string, body interface{}) (int, interface{}) {
+	c.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	request := httptest.NewRequest(method, target, reader)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	response, err := Router.Test(request, -1)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	raw, err := io.ReadAll(response.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	path := strings.SplitN(target, "?", 2)[0]
+	name, operation := c.operation(method, path)
+	if operation == nil {
+		c.t.Fatalf("%s %s is not in openapi.json", method, path)
+	}
+
+	documented, ok := operation["responses"].(map[string]interface{})[fmt.Sprint(response.StatusCode)]
+	if !ok {
+		c.t.Fatalf("%s returned %d, which is not documented: %s", name, response.StatusCode, raw)
+	}
+	content, _ := c.resolve(documented.(map[string]interface{}))["content"].(map[string]interface{})
+	if len(content) == 0 {
+		if len(raw) > 0 && response.StatusCode != http.StatusFound {
+			c.t.Errorf("%s %d has no documented body, but returned %s", name, response.StatusCode, raw)
+		}
+		return response.StatusCode, nil
+	}
+
+	mediaType := strings.SplitN(response.Header.Get("Content-Type"), ";", 2)[0]
+	media, ok := content[mediaType].(map[string]interface{})
+	if !ok {
+		c.t.Fatalf("%s %d returned %s, which is not documented", name, response.StatusCode, mediaType)
+	}
+	if mediaType != "application/json" {
+		return response.StatusCode, nil
+	}
+
+	var decoded interface{}
+	if err = json.Unmarshal(raw, &decoded); err != nil {
+		c.t.Fatalf("%s %d returned invalid JSON: %s", name, response.StatusCode, err)
+	}
+	if schema, ok := media["schema"].(map[string]interface{}); ok {
+		for _, problem := range c.validate(schema, decoded, "body") {
+			c.t.Errorf("%s %d: %s", name, response.StatusCode, problem)
+		}
+	}
+	return response.StatusCode, decoded
+}
+
+func (c *contract) resolve(schema map[string]interface{}) map[string]interface{} {
+	ref, ok := schema["$ref"].(string)
+	if !ok {
+		return schema
+	}
+	var resolved interface{} = c.spec
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		resolved = resolved.(map[string]interface{})[part]
+	}
+	if resolved == nil {
+		c.t.Fatalf("Unknown $ref %s", ref)
+	}
+	return c.resolve(resolved.(map[string]interface{}))
+}
+
+// merge resolves schema, and combines the objects of allOf into one
+func (c *contract) merge(schema map[string]interface{}) map[string]interface{} {
+	schema = c.resolve(schema)
+	all, ok := schema["allOf"].([]interface{})
+	if !ok {
+		return schema
+	}
+
+	merged := map[string]interface{}{"type": "object"}
+	properties := map[string]interface{}{}
+	var required []interface{}
+	own := map[string]interface{}{}
+	for key, value := range schema {
+		if key != "allOf" {
+			own[key] = value
+		}
+	}
+	for _, part := range append(all, own) {
+		part := c.merge(part.(map[string]interface{}))
+		partProperties, _ := part["properties"].(map[string]interface{})
+		for name, property := range partProperties {
+			properties[name] = property
+		}
+		if list, ok := part["required"].([]interface{}); ok {
+			required = append(required, list...)
+		}
+		if part["nullable"] != nil {
+			merged["nullable"] = part["nullable"]
+		}
+	}
+	merged["properties"] = properties
+	merged["required"] = required
+	return merged
+}
+
+// validate checks the parts of JSON schema that openapi.json uses, objects may not have undocumented properties
+func (c *contract) validate(schema map[string]interface{}, value interface{}, at string) []string {
+	schema = c.merge(schema)
+	var problems []string
+	if value == nil {
+		if nullable, _ := schema["nullable"].(bool); !nullable && schema["type"] != nil {
+			problems = append(problems, fmt.Sprintf("%s is null", at))
+		}
+		return problems
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return append(problems, fmt.Sprintf("%s is not an object", at))
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s.%s is missing", at, name))
+			}
+		}
+		properties, documented := schema["properties"].(map[string]interface{})
+		for name, property := range object {
+			if propertySchema, ok := properties[name].(map[string]interface{}); ok {
+				problems = append(problems, c.validate(propertySchema, property, at+"."+name)...)
+			} else if documented && schema["additionalProperties"] == nil {
+				problems = append(problems, fmt.Sprintf("%s.%s is not documented", at, name))
+			}
+		}
+	case "array":
+		list, ok := value.([]interface{})
+		if !ok {
+			return append(problems, fmt.Sprintf("%s is not an array", at))
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range list {
+				problems = append(problems, c.validate(items, item, fmt.Sprintf("%s[%d]", at, i))...)
+			}
+		}
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return append(problems, fmt.Sprintf("%s is not a string", at))
+		}
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			found := false
+			for _, allowed := range enum {
+				found = found || allowed == text
+			}
+			if !found {
+				problems = append(problems, fmt.Sprintf("%s %q is not one of %v", at, text, enum))
+			}
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, text); err != nil {
+				problems = append(problems, fmt.Sprintf("%s %q is not a date-time", at, text))
+			}
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(text) {
+			problems = append(problems, fmt.Sprintf("%s %q does not match %s", at, text, pattern))
+		}
+	case "integer":
+		if number, ok := value.(float64); !ok || number != math.Trunc(number) {
+			problems = append(problems, fmt.Sprintf("%s is not an integer", at))
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			problems = append(problems, fmt.Sprintf("%s is not a number", at))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			problems = append(problems, fmt.Sprintf("%s is not a boolean", at))
+		}
+	}
+	return problems
+}
+
+func publicKey(t *testing.T) string {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.PublicKey().String()
+}
+
+func field(t *testing.T, body interface{}, path ...string) interface{} {
+	var value interface{} = body
+	for _, name := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			t.Fatalf("No %s in %v", strings.Join(path, "."), body)
+		}
+		value = object[name]
+	}
+	return value
+}
+
+func TestOpenApiMatchesRoutes(t *testing.T) {
+	for _, problem := range openApiDrift(Router) {
+		t.Error(problem)
+	}
+}
+
+func TestContractClients(t *testing.T) {
+	c := newContract(t)
+
+	c.request(http.MethodGet, "/api/config", nil)
+	_, created := c.request(http.MethodPost, "/api/clients", map[string]interface{}{
+		"name":       "contract-laptop",
+		"allowedIp4": "10.0.0.20/32",
+		"publicKey":  publicKey(t),
+		"group":      "ops",
+	})
+	id := fmt.Sprint(field(t, created, "ID"))
+	t.Cleanup(func() {
+		database.Connection.Unscoped().Where("name LIKE ?", "contract-%").Delete(&database.Client{})
+	})
+
+	c.request(http.MethodGet, "/api/clients?limit=10&sort=-name&group=ops", nil)
+	c.request(http.MethodGet, "/api/clients/"+id, nil)
+	c.request(http.MethodGet, "/api/clients/"+id+"/config", nil)
+	c.request(http.MethodPost, "/api/clients/"+id+"/disable", nil)
+	c.request(http.MethodPost, "/api/clients/"+id+"/enable", nil)
+	c.request(http.MethodPost, "/api/clients/"+id+"/rotate-key", map[string]string{})
+	c.request(http.MethodPost, "/api/clients/bulk?dryRun=true", []map[string]string{{"name": "contract-phone"}, {"name": ""}})
+
+	// A change the device kept rejecting is reported in the status
+	failed := &database.OutboxEntry{ClientID: 999, PublicKey: publicKey(t), Attempts: 10, LastError: "rejected"}
+	if err := database.Connection.Create(failed).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		database.Connection.Unscoped().Delete(failed)
+	})
+	if _, status := c.request(http.MethodGet, "/api/status", nil); len(field(t, status, "failedChanges").([]interface{})) != 1 {
+		t.Fatalf("The failed change is not in the status: %v", status)
+	}
+	c.request(http.MethodGet, "/api/export/wg-conf", nil)
+	c.request(http.MethodGet, "/api/rotation", nil)
+
+	if status, _ := c.request(http.MethodDelete, "/api/clients/"+id, nil); status != http.StatusNoContent {
+		t.Fatalf("Deleting the client returned %d", status)
+	}
+	if status, _ := c.request(http.MethodGet, "/api/clients/"+id, nil); status != http.StatusNotFound {
+		t.Fatalf("A deleted client returned %d", status)
+	}
+	if status, _ := c.request(http.MethodPost, "/api/clients", map[string]string{"name": "contract-invalid"}); status != http.StatusUnprocessableEntity {
+		t.Fatalf("An invalid client returned %d", status)
+	}
+}
+
+func TestContractNetworks(t *testing.T) {
+	c := newContract(t)
+	t.Cleanup(func() {
+		database.Connection.Unscoped().Where("name = ?", "contract").Delete(&database.Network{})
+	})
+
+	c.request(http.MethodGet, "/api/networks", nil)
+	if status, _ := c.request(http.MethodPost, "/api/networks", map[string]interface{}{
+		"name":       "contract",
+		"deviceName": "wgcontract",
+		"listenPort": 51899,
+		"subnet":     "10.99.0.0/24",
+	}); status != http.StatusCreated {
+		t.Fatalf("Creating a network returned %d", status)
+	}
+	c.request(http.MethodGet, "/api/networks/contract", nil)
+	c.request(http.MethodGet, "/api/networks/contract/config", nil)
+	c.request(http.MethodGet, "/api/networks/contract/clients", nil)
+	c.request(http.MethodGet, "/api/networks/contract/status", nil)
+	c.request(http.MethodGet, "/api/networks/contract/export/wg-conf", nil)
+
+	_, created := c.request(http.MethodPost, "/api/networks/contract/clients", map[string]interface{}{
+		"name":       "contract-network-laptop",
+		"allowedIp4": "10.99.0.20/32",
+		"publicKey":  publicKey(t),
+	})
+	client := "/api/networks/contract/clients/" + fmt.Sprint(field(t, created, "ID"))
+	t.Cleanup(func() {
+		database.Connection.Unscoped().Where("name = ?", "contract-network-laptop").Delete(&database.Client{})
+	})
+	c.request(http.MethodGet, client, nil)
+	c.request(http.MethodGet, client+"/config", nil)
+	c.request(http.MethodPost, client+"/disable", nil)
+	c.request(http.MethodPost, client+"/enable", nil)
+	c.request(http.MethodPost, client+"/rotate-key", map[string]string{})
+	// The client is not in the default network
+	other := "/api/networks/default/clients/" + fmt.Sprint(field(t, created, "ID"))
+	if status, _ := c.request(http.MethodGet, other, nil); status != http.StatusNotFound {
+		t.Fatalf("A client of another network returned %d", status)
+	}
+	if status, _ := c.request(http.MethodDelete, other, nil); status != http.StatusNotFound {
+		t.Fatalf("Deleting a client of another network returned %d", status)
+	}
+
+	// A rotation of the network leaves the default network alone
+	_, rotation := c.request(http.MethodPost, "/api/networks/contract/rotation", nil)
+	if field(t, rotation, "network") != "contract" || field(t, rotation, "inProgress") != true {
+		t.Fatalf("The rotation did not start: %v", rotation)
+	}
+	if _, status := c.request(http.MethodGet, "/api/rotation", nil); field(t, status, "inProgress") != false {
+		t.Fatalf("The default network is rotated too: %v", status)
+	}
+	if status, _ := c.request(http.MethodPost, "/api/networks/contract/rotation", nil); status != http.StatusConflict {
+		t.Fatalf("Starting a second rotation returned %d", status)
+	}
+	if status, _ := c.request(http.MethodPost, "/api/networks/contract/rotation/complete", nil); status != http.StatusConflict {
+		t.Fatalf("Completing while the client has an old config returned %d", status)
+	}
+	c.request(http.MethodGet, client+"/config", nil)
+	next := field(t, rotation, "nextPublicKey")
+	if status, rotation := c.request(http.MethodPost, "/api/networks/contract/rotation/complete", nil); status != http.StatusOK || field(t, rotation, "publicKey") != next {
+		t.Fatalf("Completing the rotation returned %d: %v", status, rotation)
+	}
+	c.request(http.MethodPost, "/api/networks/contract/rotation", nil)
+	c.request(http.MethodGet, "/api/networks/contract/rotation", nil)
+	c.request(http.MethodDelete, "/api/networks/contract/rotation", nil)
+	c.request(http.MethodDelete, "/api/networks/contract/rotation", nil)
+
+	c.request(http.MethodDelete, client, nil)
+	if status, _ := c.request(http.MethodDelete, "/api/networks/contract", nil); status != http.StatusNoContent {
+		t.Fatalf("Deleting the network returned %d", status)
+	}
+	c.request(http.MethodGet, "/api/networks/contract", nil)
+}
+
+func TestContractUsersAndTokens(t *testing.T) {
+	c := newContract(t)
+	t.Cleanup(func() {
+		database.Connection.Unscoped().Where("username = ?", "contract-alice").Delete(&database.User{})
+	})
+
+	c.request(http.MethodGet, "/api/users", nil)
+	_, user := c.request(http.MethodPost, "/api/users", map[string]string{
+		"username": "contract-alice",
+		"password": "correct-horse-battery-staple",
+		"role":     "user",
+	})
+	id := fmt.Sprint(field(t, user, "id"))
+	c.request(http.MethodPut, "/api/users/"+id+"/password", map[string]string{"password": "another-correct-horse-battery"})
+	c.request(http.MethodPost, "/api/users/"+id+"/unlock", nil)
+	c.request(http.MethodDelete, "/api/users/"+id+"/sessions", nil)
+	c.request(http.MethodDelete, "/api/users/"+id, nil)
+
+	_, token := c.request(http.MethodPost, "/api/tokens", map[string]string{"name": "contract-ci", "scope": "read"})
+	c.request(http.MethodGet, "/api/tokens", nil)
+	c.request(http.MethodDelete, "/api/tokens/"+fmt.Sprint(field(t, token, "id")), nil)
+
+	c.request(http.MethodGet, "/auth-methods", nil)
+	c.request(http.MethodGet, "/api/openapi.json", nil)
+	c.request(http.MethodPost, "/authenticate", map[string]string{"username": "contract", "password": "wrong"})
+
+	c.token = ""
+	if status, _ := c.request(http.MethodGet, "/api/clients", nil); status != http.StatusUnauthorized {
+		t.Fatalf("A request without login returned %d", status)
+	}
+}
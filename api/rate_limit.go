@@ -0,0 +1,139 @@
+package api
+
+import (
+	"github.com/Richard87/wg-vpn-server/database"
+	"github.com/alexedwards/argon2id"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	loginFreeAttempts = 3
+	loginMaxBackoff   = 15 * time.Minute
+	loginForgetAfter  = time.Hour
+	hashCheckTimeout  = 5 * time.Second
+)
+
+type loginAttempts struct {
+	failures     int
+	blockedUntil time.Time
+	lastFailure  time.Time
+}
+
+// loginLimiter slows down repeated failed logins from the same IP or for the same username,
+// the delay doubles for every failure after loginFreeAttempts
+var loginLimiter = struct {
+	sync.Mutex
+	attempts map[string]*loginAttempts
+}{attempts: map[string]*loginAttempts{}}
+
+var (
+	// Password hashing uses every CPU, so only a few checks are allowed to run at the same time
+	hashSlots = make(chan struct{}, 2)
+	dummyHash = struct {
+		sync.Once
+		hash string
+	}{}
+)
+
+func ipLimitKey(ip string) string {
+	return "ip:" + ip
+}
+
+func userLimitKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+// loginRetryAfter returns how long the caller has to wait before trying again with any of keys
+func loginRetryAfter(keys ...string) time.Duration {
+	loginLimiter.Lock()
+	defer loginLimiter.Unlock()
+
+	var wait time.Duration
+	for _, key := range keys {
+		if attempt, ok := loginLimiter.attempts[key]; ok {
+			if remaining := time.Until(attempt.blockedUntil); remaining > wait {
+				wait = remaining
+			}
+		}
+	}
+	return wait
+}
+
+func loginFailed(keys ...string) {
+	loginLimiter.Lock()
+	defer loginLimiter.Unlock()
+
+	for _, key := range keys {
+		attempt, ok := loginLimiter.attempts[key]
+		if !ok || time.Since(attempt.lastFailure) > loginForgetAfter {
+			attempt = &loginAttempts{}
+			loginLimiter.attempts[key] = attempt
+		}
+
+		attempt.failures++
+		attempt.lastFailure = time.Now()
+		if attempt.failures > loginFreeAttempts {
+			backoff := time.Duration(math.Pow(2, float64(attempt.failures-loginFreeAttempts-1))) * time.Second
+			if backoff > loginMaxBackoff || backoff <= 0 {
+				backoff = loginMaxBackoff
+			}
+			attempt.blockedUntil = time.Now().Add(backoff)
+		}
+	}
+}
+
+func loginSucceeded(keys ...string) {
+	loginLimiter.Lock()
+	defer loginLimiter.Unlock()
+
+	for _, key := range keys {
+		delete(loginLimiter.attempts, key)
+	}
+}
+
+func cleanupLoginAttempts() {
+	for range time.Tick(10 * time.Minute) {
+		loginLimiter.Lock()
+		for key, attempt := range loginLimiter.attempts {
+			if time.Since(attempt.lastFailure) > loginForgetAfter {
+				delete(loginLimiter.attempts, key)
+			}
+		}
+		loginLimiter.Unlock()
+	}
+}
+
+// checkPassword compares password to hash, with a limited number of concurrent checks.
+// An empty hash is compared against a dummy hash, so unknown users take as long as known users.
+func checkPassword(password string, hash string) (bool, bool) {
+	select {
+	case hashSlots <- struct{}{}:
+		defer func() { <-hashSlots }()
+	case <-time.After(hashCheckTimeout):
+		return false, false
+	}
+
+	dummyHash.Do(func() {
+		var err error
+		dummyHash.hash, err = database.HashPassword("dummy password for unknown users")
+		if err != nil {
+			log.Fatalf("API: Could not create dummy hash: %s", err)
+		}
+	})
+
+	if hash == "" {
+		_, _ = argon2id.ComparePasswordAndHash(password, dummyHash.hash)
+		return false, true
+	}
+
+	match, err := argon2id.ComparePasswordAndHash(password, hash)
+	if err != nil {
+		log.Printf("API: Could not check password hash: %s", err)
+		return false, true
+	}
+	return match, true
+}
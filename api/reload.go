@@ -0,0 +1,41 @@
+package api
+
+import (
+	"github.com/Richard87/wg-vpn-server/config"
+	"github.com/gofiber/fiber/v2"
+	"net/http"
+	"time"
+)
+
+// ReloadConfig re-reads the configuration, like SIGHUP, and reports which changes need a restart
+func ReloadConfig(c *fiber.Ctx) error {
+	result, err := config.Reload()
+	if result == nil && err != nil {
+		return NewError(http.StatusUnprocessableEntity, CodeValidation, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.Status(http.StatusOK).JSON(result)
+}
+
+// applyReload swaps the CORS handler and certificate after the configuration changed
+func applyReload(changed map[string]bool) error {
+	if changed["https-cors"] {
+		corsHandler.Store(newCorsHandler())
+	}
+
+	if (changed["https-crt"] || changed["https-key"]) && len(config.Config.AcmeDomains) == 0 {
+		certificateStore.Lock()
+		certificateStore.crtModTime = time.Time{}
+		certificateStore.keyModTime = time.Time{}
+		certificateStore.Unlock()
+
+		if err := initCertificate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"errors"
+	"github.com/Richard87/wg-vpn-server/wireguard"
+	"github.com/gofiber/fiber/v2"
+	"net/http"
+)
+
+// GetRotation shows the progress of a server key rotation of the network, and which clients still need a new config
+func GetRotation(c *fiber.Ctx) error {
+	network, err := requestNetwork(c)
+	if err != nil {
+		return err
+	}
+	rotation, err := wireguard.GetRotation(network)
+	if err != nil {
+		return errDatabase(err)
+	}
+	return c.Status(http.StatusOK).JSON(rotation)
+}
+
+// StartRotation generates the next server key of the network, client configs use it from now on
+func StartRotation(c *fiber.Ctx) error {
+	network, err := requestNetwork(c)
+	if err != nil {
+		return err
+	}
+	rotation, err := wireguard.StartRotation(network)
+	if errors.Is(err, wireguard.ErrRotationInProgress) {
+		return errConflict("A server key rotation is already in progress")
+	}
+	if err != nil {
+		return err
+	}
+	return c.Status(http.StatusCreated).JSON(rotation)
+}
+
+// CompleteRotation switches the network to the next key, ?force=true also when some clients have an old config
+func CompleteRotation(c *fiber.Ctx) error {
+	network, err := requestNetwork(c)
+	if err != nil {
+		return err
+	}
+	rotation, err := wireguard.CompleteRotation(network, c.Query("force") == "true")
+	switch {
+	case errors.Is(err, wireguard.ErrNoRotation):
+		return errConflict("No server key rotation in progress")
+	case errors.Is(err, wireguard.ErrClientsPending):
+		return errConflict(err.Error())
+	case err != nil:
+		return errWireGuard(err)
+	}
+	return c.Status(http.StatusOK).JSON(rotation)
+}
+
+// CancelRotation keeps the current server key of the network, and removes the next one
+func CancelRotation(c *fiber.Ctx) error {
+	network, err := requestNetwork(c)
+	if err != nil {
+		return err
+	}
+	err = wireguard.CancelRotation(network)
+	if errors.Is(err, wireguard.ErrNoRotation) {
+		return errConflict("No server key rotation in progress")
+	}
+	if err != nil {
+		return errWireGuard(err)
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
@@ -1,59 +1,151 @@
 package api
 
 import (
+	"crypto/tls"
 	"embed"
 	"fmt"
 	"github.com/Richard87/wg-vpn-server/config"
+	"github.com/Richard87/wg-vpn-server/database"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/compress"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/filesystem"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"io/fs"
 	"log"
 	"net/http"
+	"sync/atomic"
 )
 
 var Router *fiber.App
 
 func Run(embeddedFiles embed.FS) {
+	initSigningKeys()
+	go cleanupLoginAttempts()
 
-	Router = fiber.New(fiber.Config{
+	Router = newRouter(embeddedFiles)
+	config.OnReload(applyReload)
+	checkOpenApi()
+
+	listener, err := tls.Listen("tcp", "0.0.0.0:"+config.Config.HttpsPort, newTlsConfig())
+	if err != nil {
+		log.Fatalf("API: Could not listen on %s: %s", config.Config.HttpsPort, err)
+	}
+
+	go func() {
+		err := Router.Listener(listener)
+		if err != nil {
+			log.Fatalf("API: Could not start: %s", err)
+		}
+	}()
+}
+
+// newRouter sets up the middleware and every route, the UI is served from ui/build in embeddedFiles
+func newRouter(embeddedFiles embed.FS) *fiber.App {
+	router := fiber.New(fiber.Config{
 		DisableStartupMessage: true,
+		ErrorHandler:          ErrorHandler,
 	})
-	Router.Use(logger.New())
-	Router.Use(compress.New(compress.Config{
-		Level: compress.LevelBestSpeed,
+	// The request id is sent back in X-Request-ID and in every error response, and logged with the request
+	router.Use(requestid.New())
+	router.Use(logger.New(logger.Config{
+		Format: "[${time}] ${locals:requestid} ${status} - ${latency} ${method} ${path}\n",
 	}))
-	Router.Use(cors.New(cors.Config{
-		AllowOrigins:     fmt.Sprintf(fmt.Sprintf("https://localhost:%s, %s", config.Config.HttpsPort, config.Config.HttpsCors)),
-		AllowHeaders:     "Origin, Content-Type, Accept, X-Requested-With, Authorization, Access-Control-Allow-Origin",
-		AllowMethods:     "GET, HEAD, POST, PUT, OPTIONS, DELETE",
-		AllowCredentials: true,
+	router.Use(compress.New(compress.Config{
+		Level: compress.LevelBestSpeed,
 	}))
+	corsHandler.Store(newCorsHandler())
+	router.Use(func(c *fiber.Ctx) error {
+		return corsHandler.Load().(fiber.Handler)(c)
+	})
 	assets, err := fs.Sub(embeddedFiles, "ui/build")
 	if err != nil {
 		log.Fatalf("Could not load UI: %s", err)
 	}
-	Router.Post("/authenticate", Authenticate)
+	router.Post("/authenticate", Authenticate)
+	router.Post("/authenticate/totp", AuthenticateTotp)
+	router.Post("/refresh", Refresh)
+	router.Post("/logout", Logout)
+	router.Get("/auth-methods", GetAuthMethods)
+	router.Get("/oidc/login", OidcLogin)
+	router.Get("/oidc/callback", OidcCallback)
+	router.Get("/api/openapi.json", GetOpenApi)
 
-	authRoutes := Router.Group("/api", NewAuthenticationMiddleware())
+	authRoutes := router.Group("/api", NewAuthenticationMiddleware())
 	authRoutes.Get("/clients", GetClients)
 	authRoutes.Post("/clients", CreateClient)
+	authRoutes.Post("/clients/bulk", CreateClients)
 	authRoutes.Get("/clients/:id", GetClient)
+	authRoutes.Get("/clients/:id/config", RequireScope(database.ScopeWrite), GetClientConfig)
+	authRoutes.Post("/clients/:id/disable", DisableClient)
+	authRoutes.Post("/clients/:id/enable", EnableClient)
+	authRoutes.Post("/clients/:id/rotate-key", RotateClientKey)
 	authRoutes.Delete("/clients/:id", DeleteClient)
 	authRoutes.Get("/config", GetConfig)
+	authRoutes.Get("/status", GetStatus)
+	authRoutes.Get("/users", RequireRole("admin"), GetUsers)
+	authRoutes.Post("/users", RequireRole("admin"), CreateUser)
+	authRoutes.Put("/users/:id/password", RequireRole("admin"), SetUserPassword)
+	authRoutes.Delete("/users/:id", RequireRole("admin"), DeleteUser)
+	authRoutes.Post("/users/:id/unlock", RequireRole("admin"), UnlockUser)
+	authRoutes.Delete("/users/:id/sessions", RequireRole("admin"), RevokeUserSessions)
+	authRoutes.Delete("/users/:id/totp", RequireRole("admin"), ResetUserTotp)
+	authRoutes.Post("/totp/enroll", EnrollTotp)
+	authRoutes.Post("/totp/verify", VerifyTotp)
+	authRoutes.Delete("/totp", DisableTotp)
+	authRoutes.Get("/tokens", GetTokens)
+	authRoutes.Post("/tokens", CreateToken)
+	authRoutes.Delete("/tokens/:id", DeleteToken)
+	authRoutes.Post("/reload", RequireRole("admin"), ReloadConfig)
+	authRoutes.Get("/backup", RequireRole("admin"), RequireScope(database.ScopeWrite), GetBackup)
+	authRoutes.Post("/import", RequireRole("admin"), ImportConf)
+	authRoutes.Get("/export/wg-conf", RequireRole("admin"), RequireScope(database.ScopeWrite), ExportWgConf)
+	authRoutes.Get("/rotation", RequireRole("admin"), GetRotation)
+	authRoutes.Post("/rotation", RequireRole("admin"), StartRotation)
+	authRoutes.Post("/rotation/complete", RequireRole("admin"), CompleteRotation)
+	authRoutes.Delete("/rotation", RequireRole("admin"), CancelRotation)
+	authRoutes.Get("/networks", GetNetworks)
+	authRoutes.Post("/networks", RequireRole("admin"), CreateNetwork)
+	authRoutes.Get("/networks/:network", GetNetwork)
+	authRoutes.Delete("/networks/:network", RequireRole("admin"), DeleteNetwork)
+	authRoutes.Get("/networks/:network/clients", GetClients)
+	authRoutes.Post("/networks/:network/clients", CreateClient)
+	authRoutes.Post("/networks/:network/clients/bulk", CreateClients)
+	authRoutes.Get("/networks/:network/clients/:id", GetClient)
+	authRoutes.Get("/networks/:network/clients/:id/config", RequireScope(database.ScopeWrite), GetClientConfig)
+	authRoutes.Post("/networks/:network/clients/:id/disable", DisableClient)
+	authRoutes.Post("/networks/:network/clients/:id/enable", EnableClient)
+	authRoutes.Post("/networks/:network/clients/:id/rotate-key", RotateClientKey)
+	authRoutes.Delete("/networks/:network/clients/:id", DeleteClient)
+	authRoutes.Get("/networks/:network/config", GetConfig)
+	authRoutes.Get("/networks/:network/status", GetStatus)
+	authRoutes.Get("/networks/:network/export/wg-conf", RequireRole("admin"), RequireScope(database.ScopeWrite), ExportWgConf)
+	authRoutes.Get("/networks/:network/rotation", RequireRole("admin"), GetRotation)
+	authRoutes.Post("/networks/:network/rotation", RequireRole("admin"), StartRotation)
+	authRoutes.Post("/networks/:network/rotation/complete", RequireRole("admin"), CompleteRotation)
+	authRoutes.Delete("/networks/:network/rotation", RequireRole("admin"), CancelRotation)
 
-	Router.Use("/", filesystem.New(filesystem.Config{
+	router.Use("/", filesystem.New(filesystem.Config{
 		Root: http.FS(assets),
 	}))
+	// Unknown routes get the error envelope too, instead of the plain text of fiber
+	router.Use(func(c *fiber.Ctx) error {
+		return errNotFound()
+	})
+	return router
+}
 
-	go func() {
-		err := Router.Listen("0.0.0.0:" + config.Config.HttpsPort)
-		if err != nil {
-			log.Fatalf("API: Could not start: %s", err)
-		}
-	}()
+// corsHandler is replaced when -https-cors changes
+var corsHandler atomic.Value
+
+func newCorsHandler() fiber.Handler {
+	return cors.New(cors.Config{
+		AllowOrigins:     fmt.Sprintf(fmt.Sprintf("https://localhost:%s, %s", config.Config.HttpsPort, config.Current().HttpsCors)),
+		AllowHeaders:     "Origin, Content-Type, Accept, X-Requested-With, Authorization, Access-Control-Allow-Origin",
+		AllowMethods:     "GET, HEAD, POST, PUT, OPTIONS, DELETE",
+		AllowCredentials: true,
+	})
 }
 
 func Close() {
@@ -0,0 +1,260 @@
+package api
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/config"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const signingKeySize = 32
+
+type signingKey struct {
+	Kid       string     `json:"kid"`
+	Secret    []byte     `json:"secret"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RetiredAt *time.Time `json:"retiredAt,omitempty"`
+}
+
+type signingKeyFile struct {
+	Keys []signingKey `json:"keys"`
+}
+
+var signingKeys = struct {
+	sync.RWMutex
+	keys     []signingKey
+	readOnly bool
+	modTime  time.Time
+}{}
+
+// initSigningKeys loads the JWT signing keys from disk, creating the key file if it is missing.
+// The file is either a keyring written by this server, or a raw secret (for example a mounted secret),
+// which is used as the only key and never rotated.
+func initSigningKeys() {
+	if _, err := os.Stat(config.Config.HttpsJwtKeys); os.IsNotExist(err) {
+		key, err := newSigningKey()
+		if err != nil {
+			log.Fatalf("API: Could not generate JWT signing key: %s", err)
+		}
+		if err = writeSigningKeys([]signingKey{key}); err != nil {
+			log.Fatalf("API: Could not save JWT signing key: %s", err)
+		}
+	}
+
+	if err := loadSigningKeys(); err != nil {
+		log.Fatalf("API: Could not load JWT signing keys: %s", err)
+	}
+	if err := rotateSigningKeys(); err != nil {
+		log.Printf("API: Could not rotate JWT signing key: %s", err)
+	}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			if err := loadSigningKeys(); err != nil {
+				log.Printf("API: Could not reload JWT signing keys: %s", err)
+			}
+			if err := rotateSigningKeys(); err != nil {
+				log.Printf("API: Could not rotate JWT signing key: %s", err)
+			}
+		}
+	}()
+}
+
+func loadSigningKeys() error {
+	stat, err := os.Stat(config.Config.HttpsJwtKeys)
+	if err != nil {
+		return err
+	}
+
+	signingKeys.RLock()
+	unchanged := stat.ModTime().Equal(signingKeys.modTime)
+	signingKeys.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	content, err := os.ReadFile(config.Config.HttpsJwtKeys)
+	if err != nil {
+		return err
+	}
+
+	var keys []signingKey
+	readOnly := false
+	if strings.HasPrefix(strings.TrimSpace(string(content)), "{") {
+		var file signingKeyFile
+		if err := json.Unmarshal(content, &file); err != nil {
+			return fmt.Errorf("invalid key file %s: %w", config.Config.HttpsJwtKeys, err)
+		}
+		keys = file.Keys
+	} else {
+		key, err := parseRawSigningKey(content)
+		if err != nil {
+			return err
+		}
+		keys = []signingKey{key}
+		readOnly = true
+	}
+
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys found in %s", config.Config.HttpsJwtKeys)
+	}
+	for _, key := range keys {
+		if len(key.Secret) < signingKeySize {
+			return fmt.Errorf("key %s is too short, must be at least %d bytes", key.Kid, signingKeySize)
+		}
+	}
+
+	signingKeys.Lock()
+	signingKeys.keys = keys
+	signingKeys.readOnly = readOnly
+	signingKeys.modTime = stat.ModTime()
+	signingKeys.Unlock()
+	return nil
+}
+
+func parseRawSigningKey(content []byte) (signingKey, error) {
+	raw := strings.TrimSpace(string(content))
+	secret, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		secret = []byte(raw)
+	}
+	if len(secret) < signingKeySize {
+		return signingKey{}, fmt.Errorf("key in %s is too short, must be at least %d bytes", config.Config.HttpsJwtKeys, signingKeySize)
+	}
+
+	sum := sha256.Sum256(secret)
+	return signingKey{Kid: hex.EncodeToString(sum[:4]), Secret: secret}, nil
+}
+
+// rotateSigningKeys retires the active key when it is older than -https-jwt-rotate,
+// and drops retired keys once their grace period is over.
+func rotateSigningKeys() error {
+	if config.Current().HttpsJwtRotate <= 0 {
+		return nil
+	}
+
+	if !signingKeyExpired() {
+		return nil
+	}
+
+	// Several instances may share the key file, only one of them should rotate it
+	lockFile := config.Config.HttpsJwtKeys + ".lock"
+	if stat, err := os.Stat(lockFile); err == nil && time.Since(stat.ModTime()) > 5*time.Minute {
+		_ = os.Remove(lockFile)
+	}
+	lock, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if os.IsExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_ = lock.Close()
+	defer os.Remove(lockFile)
+
+	// Another instance may have rotated the key since it was loaded, so the file is read again with the lock held
+	signingKeys.Lock()
+	signingKeys.modTime = time.Time{}
+	signingKeys.Unlock()
+	if err = loadSigningKeys(); err != nil {
+		return err
+	}
+	if !signingKeyExpired() {
+		return nil
+	}
+	signingKeys.RLock()
+	keys := append([]signingKey{}, signingKeys.keys...)
+	signingKeys.RUnlock()
+
+	key, err := newSigningKey()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	rotated := []signingKey{key}
+	for _, k := range keys {
+		if k.RetiredAt == nil {
+			k.RetiredAt = &now
+		}
+		if time.Since(*k.RetiredAt) < config.Current().HttpsJwtGrace {
+			rotated = append(rotated, k)
+		}
+	}
+
+	if err = writeSigningKeys(rotated); err != nil {
+		return err
+	}
+	log.Printf("API: Rotated JWT signing key (new kid: %s)", key.Kid)
+	return loadSigningKeys()
+}
+
+// signingKeyExpired is true when the active key is older than -https-jwt-rotate, raw secrets never expire
+func signingKeyExpired() bool {
+	signingKeys.RLock()
+	defer signingKeys.RUnlock()
+	return !signingKeys.readOnly && time.Since(signingKeys.keys[0].CreatedAt) >= config.Current().HttpsJwtRotate
+}
+
+func writeSigningKeys(keys []signingKey) error {
+	content, err := json.MarshalIndent(signingKeyFile{Keys: keys}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := config.Config.HttpsJwtKeys + ".tmp"
+	if err = os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, config.Config.HttpsJwtKeys)
+}
+
+func newSigningKey() (signingKey, error) {
+	secret := make([]byte, signingKeySize)
+	if _, err := crand.Read(secret); err != nil {
+		return signingKey{}, err
+	}
+
+	kid := make([]byte, 8)
+	if _, err := crand.Read(kid); err != nil {
+		return signingKey{}, err
+	}
+
+	return signingKey{
+		Kid:       hex.EncodeToString(kid),
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// activeSigningKey returns the key new tokens are signed with
+func activeSigningKey() signingKey {
+	signingKeys.RLock()
+	defer signingKeys.RUnlock()
+	return signingKeys.keys[0]
+}
+
+// verificationKey returns the secret for kid, as long as the key is active or within its grace period
+func verificationKey(kid string) ([]byte, error) {
+	signingKeys.RLock()
+	defer signingKeys.RUnlock()
+
+	for _, key := range signingKeys.keys {
+		if key.Kid != kid {
+			continue
+		}
+		if key.RetiredAt != nil && time.Since(*key.RetiredAt) > config.Current().HttpsJwtGrace {
+			return nil, fmt.Errorf("signing key %s has expired", kid)
+		}
+		return key.Secret, nil
+	}
+
+	return nil, fmt.Errorf("unknown signing key: %s", kid)
+}
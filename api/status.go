@@ -0,0 +1,20 @@
+package api
+
+import (
+	"github.com/Richard87/wg-vpn-server/wireguard"
+	"github.com/gofiber/fiber/v2"
+	"net/http"
+)
+
+// GetStatus reports the device of the network, the default network for /api/status
+func GetStatus(c *fiber.Ctx) error {
+	network, err := requestNetwork(c)
+	if err != nil {
+		return err
+	}
+	status, err := wireguard.GetNetworkStatus(network)
+	if err != nil {
+		return errWireGuard(err)
+	}
+	return c.Status(http.StatusOK).JSON(status)
+}
@@ -0,0 +1,237 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	certificateReloadInterval = 10 * time.Second
+	// selfSignedValidity is how long a generated certificate is valid, it is replaced selfSignedRenewBefore it expires
+	selfSignedValidity     = 365 * 24 * time.Hour
+	selfSignedRenewBefore  = 30 * 24 * time.Hour
+	selfSignedOrganization = "WG VPN Server"
+)
+
+// certificateStore serves the certificate from -https-crt and -https-key, and reloads it when the files change
+var certificateStore = struct {
+	sync.RWMutex
+	certificate *tls.Certificate
+	crtModTime  time.Time
+	keyModTime  time.Time
+}{}
+
+func newTlsConfig() *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	configureClientCertificates(tlsConfig)
+
+	if len(config.Config.AcmeDomains) > 0 {
+		manager := newAcmeManager()
+		tlsConfig.GetCertificate = manager.GetCertificate
+		tlsConfig.NextProtos = []string{"http/1.1", acme.ALPNProto}
+		return tlsConfig
+	}
+
+	if err := initCertificate(); err != nil {
+		log.Fatalf("API: Could not load certificate: %s", err)
+	}
+	go func() {
+		for range time.Tick(certificateReloadInterval) {
+			if err := loadCertificate(); err != nil {
+				log.Printf("API: Could not reload certificate, keeping the current one: %s", err)
+			}
+			if err := renewSelfSignedCertificate(); err != nil {
+				log.Printf("API: Could not renew self-signed certificate: %s", err)
+			}
+		}
+	}()
+
+	tlsConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		certificateStore.RLock()
+		defer certificateStore.RUnlock()
+		return certificateStore.certificate, nil
+	}
+	return tlsConfig
+}
+
+func newAcmeManager() *autocert.Manager {
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	if config.Config.AcmeCaBundle != "" {
+		bundle, err := os.ReadFile(config.Config.AcmeCaBundle)
+		if err != nil {
+			log.Fatalf("API: Could not read ACME CA bundle: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			log.Fatalf("API: No certificates found in ACME CA bundle %s", config.Config.AcmeCaBundle)
+		}
+		httpClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(config.Config.AcmeCacheDir),
+		HostPolicy: autocert.HostWhitelist(config.Config.AcmeDomains...),
+		Email:      config.Config.AcmeEmail,
+		Client: &acme.Client{
+			DirectoryURL: config.Config.AcmeDirectory,
+			HTTPClient:   httpClient,
+		},
+	}
+
+	if config.Config.AcmeHttpPort != "" {
+		go func() {
+			err := http.ListenAndServe("0.0.0.0:"+config.Config.AcmeHttpPort, manager.HTTPHandler(nil))
+			if err != nil {
+				log.Fatalf("API: Could not start ACME http challenge server: %s", err)
+			}
+		}()
+	}
+
+	log.Printf("API: Using ACME certificates for %v from %s", config.Config.AcmeDomains, config.Config.AcmeDirectory)
+	return manager
+}
+
+// initCertificate generates a self-signed certificate when both the certificate and key are missing
+func initCertificate() error {
+	cfg := config.Current()
+	_, crtErr := os.Stat(cfg.HttpsCrt)
+	_, keyErr := os.Stat(cfg.HttpsKey)
+	if os.IsNotExist(crtErr) && os.IsNotExist(keyErr) {
+		log.Printf("API: Generating self-signed certificate %s", cfg.HttpsCrt)
+		if err := generateSelfSignedCertificate(selfSignedValidity); err != nil {
+			return err
+		}
+	}
+
+	return loadCertificate()
+}
+
+// renewSelfSignedCertificate replaces the certificate before it expires when it was generated by this server,
+// certificates from anywhere else are left alone
+func renewSelfSignedCertificate() error {
+	certificateStore.RLock()
+	certificate := certificateStore.certificate
+	certificateStore.RUnlock()
+	if certificate == nil || len(certificate.Certificate) == 0 {
+		return nil
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return err
+	}
+	generated := leaf.Issuer.String() == leaf.Subject.String() &&
+		len(leaf.Subject.Organization) == 1 && leaf.Subject.Organization[0] == selfSignedOrganization
+	if !generated || time.Until(leaf.NotAfter) > selfSignedRenewBefore {
+		return nil
+	}
+
+	log.Printf("API: Renewing self-signed certificate %s, it expires %s", config.Current().HttpsCrt, leaf.NotAfter.Format(time.RFC3339))
+	if err = generateSelfSignedCertificate(selfSignedValidity); err != nil {
+		return err
+	}
+	return loadCertificate()
+}
+
+func loadCertificate() error {
+	cfg := config.Current()
+	crtStat, err := os.Stat(cfg.HttpsCrt)
+	if err != nil {
+		return err
+	}
+	keyStat, err := os.Stat(cfg.HttpsKey)
+	if err != nil {
+		return err
+	}
+
+	certificateStore.RLock()
+	unchanged := crtStat.ModTime().Equal(certificateStore.crtModTime) && keyStat.ModTime().Equal(certificateStore.keyModTime)
+	certificateStore.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(cfg.HttpsCrt, cfg.HttpsKey)
+	if err != nil {
+		return err
+	}
+
+	certificateStore.Lock()
+	reloaded := certificateStore.certificate != nil
+	certificateStore.certificate = &certificate
+	certificateStore.crtModTime = crtStat.ModTime()
+	certificateStore.keyModTime = keyStat.ModTime()
+	certificateStore.Unlock()
+
+	if reloaded {
+		log.Printf("API: Reloaded certificate %s", cfg.HttpsCrt)
+	}
+	return nil
+}
+
+func generateSelfSignedCertificate(validity time.Duration) error {
+	cfg := config.Current()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := crand.Int(crand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{selfSignedOrganization}, CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if ip := net.ParseIP(cfg.WgEndpoint); ip != nil {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	} else if cfg.WgEndpoint != "" {
+		template.DNSNames = append(template.DNSNames, cfg.WgEndpoint)
+	}
+
+	der, err := x509.CreateCertificate(crand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("could not create certificate: %w", err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("could not encode key: %w", err)
+	}
+
+	if err = os.WriteFile(cfg.HttpsKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(cfg.HttpsCrt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/Richard87/wg-vpn-server/config"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const acmeTestDomain = "wg.example.test"
+
+// useCertificateFiles points -https-crt and -https-key to a temporary folder, and resets the loaded certificate
+func useCertificateFiles(t *testing.T) {
+	dir := t.TempDir()
+	previous := *config.Config
+	config.Current().HttpsCrt = filepath.Join(dir, "server_crt.pem")
+	config.Current().HttpsKey = filepath.Join(dir, "server_key.pem")
+	t.Cleanup(func() {
+		*config.Config = previous
+		certificateStore.Lock()
+		certificateStore.certificate = nil
+		certificateStore.crtModTime = time.Time{}
+		certificateStore.keyModTime = time.Time{}
+		certificateStore.Unlock()
+	})
+}
+
+func loadedLeaf(t *testing.T) *x509.Certificate {
+	certificateStore.RLock()
+	defer certificateStore.RUnlock()
+	leaf, err := x509.ParseCertificate(certificateStore.certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+func TestSelfSignedCertificateIsRenewed(t *testing.T) {
+	useCertificateFiles(t)
+	if err := generateSelfSignedCertificate(10 * 24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	expiring := loadedLeaf(t)
+
+	if err := renewSelfSignedCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	renewed := loadedLeaf(t)
+	if renewed.SerialNumber.Cmp(expiring.SerialNumber) == 0 {
+		t.Fatal("The certificate was not renewed")
+	}
+	if time.Until(renewed.NotAfter) < selfSignedValidity-time.Hour {
+		t.Fatalf("The renewed certificate expires %s", renewed.NotAfter)
+	}
+
+	// A renewed certificate is left alone until it expires again
+	if err := renewSelfSignedCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if loadedLeaf(t).SerialNumber.Cmp(renewed.SerialNumber) != 0 {
+		t.Fatal("A valid certificate was replaced")
+	}
+}
+
+func TestOtherCertificatesAreNotRenewed(t *testing.T) {
+	useCertificateFiles(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{Organization: []string{"Example"}, CommonName: "vpn.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     []string{"vpn.example.com"},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(config.Current().HttpsKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(config.Current().HttpsCrt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = loadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = renewSelfSignedCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if loadedLeaf(t).SerialNumber.Int64() != 42 {
+		t.Fatal("A certificate of the operator was replaced")
+	}
+}
+
+// TestAcmeCertificate gets a certificate from a local ACME server like Pebble, it is skipped without one:
+//
+//	PEBBLE_VA_ALWAYS_VALID=1 pebble -config test/config/pebble-config.json
+//	WG_VPN_TEST_ACME_DIRECTORY=https://localhost:14000/dir WG_VPN_TEST_ACME_CA=test/certs/pebble.minica.pem go test ./api -run Acme
+//
+// When the ACME server validates challenges, WG_VPN_TEST_ACME_LISTEN is the address it reaches the tls-alpn-01
+// challenge of wg.example.test on.
+func TestAcmeCertificate(t *testing.T) {
+	directory := os.Getenv("WG_VPN_TEST_ACME_DIRECTORY")
+	if directory == "" {
+		t.Skip("WG_VPN_TEST_ACME_DIRECTORY is not set")
+	}
+	listen := os.Getenv("WG_VPN_TEST_ACME_LISTEN")
+	if listen == "" {
+		listen = "127.0.0.1:0"
+	}
+
+	previous := *config.Config
+	t.Cleanup(func() {
+		*config.Config = previous
+	})
+	config.Config.AcmeDomains = config.StringsFlag{acmeTestDomain}
+	config.Config.AcmeDirectory = directory
+	config.Config.AcmeCaBundle = os.Getenv("WG_VPN_TEST_ACME_CA")
+	config.Config.AcmeEmail = "admin@example.test"
+	config.Config.AcmeCacheDir = t.TempDir()
+	config.Config.AcmeHttpPort = ""
+
+	listener, err := tls.Listen("tcp", listen, newTlsConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = conn.(*tls.Conn).Handshake()
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	dialer := &net.Dialer{Timeout: time.Minute}
+	conn, err := tls.DialWithDialer(dialer, "tcp", listener.Addr().String(), &tls.Config{
+		ServerName:         acmeTestDomain,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("Handshake failed, no certificate was issued: %s", err)
+	}
+	defer conn.Close()
+
+	leaf := conn.ConnectionState().PeerCertificates[0]
+	if err = leaf.VerifyHostname(acmeTestDomain); err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Issuer.String() == leaf.Subject.String() {
+		t.Fatal("Got a self-signed certificate instead of one from the ACME server")
+	}
+	if _, err = os.Stat(filepath.Join(config.Config.AcmeCacheDir, acmeTestDomain)); err != nil {
+		t.Fatalf("The certificate was not cached: %s", err)
+	}
+}
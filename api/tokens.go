@@ -0,0 +1,127 @@
+package api
+
+import (
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/database"
+	"github.com/gofiber/fiber/v2"
+	"net/http"
+	"time"
+)
+
+type CreateTokenRequest struct {
+	Name      string     `json:"name"`
+	Scope     string     `json:"scope"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// TokenResponse is an API token without its hash
+type TokenResponse struct {
+	ID         uint       `json:"id"`
+	UserID     uint       `json:"userId"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scope      string     `json:"scope"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+type CreateTokenResponse struct {
+	TokenResponse
+	Token string `json:"token"`
+}
+
+func newTokenResponse(token database.ApiToken) TokenResponse {
+	return TokenResponse{
+		ID:         token.ID,
+		UserID:     token.UserID,
+		Name:       token.Name,
+		Prefix:     token.Prefix,
+		Scope:      token.Scope,
+		CreatedAt:  token.CreatedAt,
+		ExpiresAt:  token.ExpiresAt,
+		LastUsedAt: token.LastUsedAt,
+	}
+}
+
+func GetTokens(c *fiber.Ctx) error {
+	user := c.Locals("user").(*database.User)
+
+	tokens := []database.ApiToken{}
+	if err := database.Connection.Where("user_id = ?", user.ID).Find(&tokens).Error; err != nil {
+		return errDatabase(err)
+	}
+
+	response := make([]TokenResponse, 0, len(tokens))
+	for _, token := range tokens {
+		response = append(response, newTokenResponse(token))
+	}
+	return c.Status(http.StatusOK).JSON(response)
+}
+
+func CreateToken(c *fiber.Ctx) error {
+	user := c.Locals("user").(*database.User)
+
+	request := CreateTokenRequest{}
+	if err := c.BodyParser(&request); err != nil {
+		return errBadRequest("Bad request")
+	}
+	if request.Scope == "" {
+		request.Scope = database.ScopeRead
+	}
+
+	invalid := validationErrors{}
+	if request.Name == "" {
+		invalid.add("name", "name is required")
+	}
+	if request.Scope != database.ScopeRead && request.Scope != database.ScopeWrite {
+		invalid.add("scope", "scope must be read or write")
+	}
+	if request.ExpiresAt != nil && request.ExpiresAt.Before(time.Now()) {
+		invalid.add("expiresAt", "expiresAt must be in the future")
+	}
+	if err := invalid.err(); err != nil {
+		return err
+	}
+
+	secret, err := generateToken()
+	if err != nil {
+		return fmt.Errorf("could not generate api token: %s", err)
+	}
+	plainToken := database.ApiTokenPrefix + secret
+
+	token := database.ApiToken{
+		UserID:    user.ID,
+		Name:      request.Name,
+		Prefix:    plainToken[:len(database.ApiTokenPrefix)+6],
+		Hash:      database.HashToken(plainToken),
+		Scope:     request.Scope,
+		ExpiresAt: request.ExpiresAt,
+	}
+	if err = database.Connection.Create(&token).Error; err != nil {
+		return errDatabase(err)
+	}
+
+	return c.Status(http.StatusCreated).JSON(CreateTokenResponse{TokenResponse: newTokenResponse(token), Token: plainToken})
+}
+
+func DeleteToken(c *fiber.Ctx) error {
+	user := c.Locals("user").(*database.User)
+	id, err := paramID(c)
+	if err != nil {
+		return err
+	}
+
+	token := database.ApiToken{}
+	if err = database.Connection.Where("user_id = ?", user.ID).Limit(1).Find(&token, id).Error; err != nil {
+		return errDatabase(err)
+	}
+	if token.ID == 0 {
+		return errNotFound()
+	}
+
+	if err = database.Connection.Delete(&token).Error; err != nil {
+		return errDatabase(err)
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
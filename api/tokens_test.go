@@ -0,0 +1,100 @@
+package api
+
+import (
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/config"
+	"github.com/Richard87/wg-vpn-server/database"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// createApiToken stores an API token for user, and returns the plain token
+func createApiToken(t *testing.T, user *database.User, scope string) string {
+	plain := database.ApiTokenPrefix + user.Username + "-" + scope + "-token"
+	token := &database.ApiToken{UserID: user.ID, Name: scope, Prefix: plain[:12], Hash: database.HashToken(plain), Scope: scope}
+	if err := database.Connection.Create(token).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		database.Connection.Unscoped().Delete(token)
+	})
+	return plain
+}
+
+// createTestUser stores a user, which is deleted after the test
+func createTestUser(t *testing.T, username string, role string) *database.User {
+	user := &database.User{Username: username, Role: role}
+	if err := database.Connection.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		database.Connection.Unscoped().Delete(user)
+	})
+	return user
+}
+
+// tokenRequest sends a request authenticated with an API token through the router, and returns the status
+func tokenRequest(t *testing.T, token string, method string, target string) int {
+	request := httptest.NewRequest(method, target, nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := Router.Test(request, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode
+}
+
+func TestReadTokenCannotDownloadPrivateKeys(t *testing.T) {
+	admin := createTestUser(t, "token-admin", "admin")
+	read := createApiToken(t, admin, database.ScopeRead)
+	write := createApiToken(t, admin, database.ScopeWrite)
+
+	client := &database.Client{Name: "token-laptop", AllowedIp4: "10.0.0.40/32", PublicKey: publicKey(t)}
+	if err := database.Connection.Create(client).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		database.Connection.Unscoped().Delete(client)
+	})
+
+	for _, target := range []string{
+		"/api/backup",
+		fmt.Sprintf("/api/clients/%d/config", client.ID),
+		"/api/export/wg-conf",
+		"/api/networks/default/export/wg-conf",
+	} {
+		if status := tokenRequest(t, read, http.MethodGet, target); status != http.StatusForbidden {
+			t.Errorf("A read token got %d for %s", status, target)
+		}
+	}
+
+	if status := tokenRequest(t, read, http.MethodGet, "/api/clients"); status != http.StatusOK {
+		t.Fatalf("A read token got %d for the clients", status)
+	}
+	if status := tokenRequest(t, write, http.MethodGet, fmt.Sprintf("/api/clients/%d/config", client.ID)); status != http.StatusOK {
+		t.Fatalf("A write token got %d for a client config", status)
+	}
+}
+
+func TestTokenNeedsTotpWhenTheRoleRequiresIt(t *testing.T) {
+	previous := config.Current().Require2faRoles
+	config.Current().Require2faRoles = config.StringsFlag{"admin"}
+	t.Cleanup(func() {
+		config.Current().Require2faRoles = previous
+	})
+
+	// The token was created before the role required two-factor authentication
+	admin := createTestUser(t, "token-totp", "admin")
+	token := createApiToken(t, admin, database.ScopeRead)
+	if status := tokenRequest(t, token, http.MethodGet, "/api/clients"); status != http.StatusForbidden {
+		t.Fatalf("A token of a user without two-factor authentication got %d", status)
+	}
+
+	if err := database.Connection.Model(admin).Update("totp_enabled", true).Error; err != nil {
+		t.Fatal(err)
+	}
+	if status := tokenRequest(t, token, http.MethodGet, "/api/clients"); status != http.StatusOK {
+		t.Fatalf("A token of a user with two-factor authentication got %d", status)
+	}
+}
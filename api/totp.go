@@ -0,0 +1,314 @@
+package api
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/database"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpIssuer        = "WG VPN Server"
+	totpPeriod        = 30
+	totpDigits        = 6
+	recoveryCodeCount = 10
+	mfaTokenTtl       = 5 * time.Minute
+	// mfaCookie has the mfa token of single sign-on logins, which end with a redirect instead of a response body
+	mfaCookie = "mfa"
+)
+
+type TotpEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningUri string `json:"provisioningUri"`
+}
+
+type TotpCode struct {
+	Code string `json:"code"`
+}
+
+type TotpLogin struct {
+	MfaToken string `json:"mfaToken"`
+	Code     string `json:"code"`
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// EnrollTotp generates a new secret for the current user, it is not used until it is verified
+func EnrollTotp(c *fiber.Ctx) error {
+	user := c.Locals("user").(*database.User)
+	if user.TotpEnabled {
+		return errConflict("Two-factor authentication is already enabled")
+	}
+
+	secret := make([]byte, 20)
+	if _, err := crand.Read(secret); err != nil {
+		return fmt.Errorf("could not generate totp secret: %s", err)
+	}
+
+	user.TotpSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	if err := database.Connection.Model(user).Update("totp_secret", user.TotpSecret).Error; err != nil {
+		return errDatabase(err)
+	}
+
+	query := url.Values{}
+	query.Set("secret", user.TotpSecret)
+	query.Set("issuer", totpIssuer)
+	query.Set("period", fmt.Sprint(totpPeriod))
+	query.Set("digits", fmt.Sprint(totpDigits))
+	label := url.PathEscape(totpIssuer + ":" + user.Username)
+
+	return c.Status(http.StatusOK).JSON(TotpEnrollment{
+		Secret:          user.TotpSecret,
+		ProvisioningUri: "otpauth://totp/" + label + "?" + query.Encode(),
+	})
+}
+
+// VerifyTotp enables two-factor authentication when the code matches the enrolled secret
+func VerifyTotp(c *fiber.Ctx) error {
+	user := c.Locals("user").(*database.User)
+
+	request := TotpCode{}
+	if err := c.BodyParser(&request); err != nil {
+		return errBadRequest("Bad request")
+	}
+	if user.TotpEnabled || user.TotpSecret == "" {
+		return errConflict("Start enrollment first")
+	}
+	if !checkTotp(user, request.Code) {
+		return validationErrors{{Field: "code", Message: "the code is not valid"}}.err()
+	}
+
+	codes, err := generateRecoveryCodes(user)
+	if err != nil {
+		return errDatabase(err)
+	}
+
+	if err = database.Connection.Model(user).Update("totp_enabled", true).Error; err != nil {
+		return errDatabase(err)
+	}
+
+	log.Printf("API: Enabled two-factor authentication for %s", user.Username)
+	return c.Status(http.StatusOK).JSON(RecoveryCodes{RecoveryCodes: codes})
+}
+
+// DisableTotp turns off two-factor authentication for the current user, a valid code is required
+func DisableTotp(c *fiber.Ctx) error {
+	user := c.Locals("user").(*database.User)
+
+	request := TotpCode{}
+	if err := c.BodyParser(&request); err != nil {
+		return errBadRequest("Bad request")
+	}
+	if !user.TotpEnabled {
+		return errConflict("Two-factor authentication is not enabled")
+	}
+	if !checkTotp(user, request.Code) && !useRecoveryCode(user, request.Code) {
+		return validationErrors{{Field: "code", Message: "the code is not valid"}}.err()
+	}
+
+	if err := resetTotp(user); err != nil {
+		return errDatabase(err)
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
+
+// ResetUserTotp lets an admin remove two-factor authentication from a user that lost access
+func ResetUserTotp(c *fiber.Ctx) error {
+	user, err := findUser(c)
+	if err != nil {
+		return err
+	}
+
+	if err = resetTotp(user); err != nil {
+		return errDatabase(err)
+	}
+	if err = database.RevokeSessions(user.ID); err != nil {
+		return errDatabase(err)
+	}
+
+	log.Printf("API: Reset two-factor authentication for %s", user.Username)
+	return c.SendStatus(http.StatusNoContent)
+}
+
+// AuthenticateTotp completes a login for users with two-factor authentication
+func AuthenticateTotp(c *fiber.Ctx) error {
+	request := TotpLogin{}
+	if err := c.BodyParser(&request); err != nil {
+		return errBadRequest("Bad request")
+	}
+	if request.MfaToken == "" {
+		request.MfaToken = c.Cookies(mfaCookie)
+	}
+
+	token, err := jwt.Parse(request.MfaToken, func(token *jwt.Token) (interface{}, error) {
+		if token.Header["alg"] != "HS256" {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return verificationKey(kid)
+	})
+	if err != nil || !token.Valid {
+		return errUnauthorized()
+	}
+
+	claims, _ := token.Claims.(jwt.MapClaims)
+	userID, _ := claims["mfa"].(float64)
+	user := database.User{}
+	if err = database.Connection.Limit(1).Find(&user, uint(userID)).Error; err != nil {
+		return errDatabase(err)
+	}
+	if user.ID == 0 || !user.TotpEnabled || user.Locked() {
+		return errUnauthorized()
+	}
+
+	limitKeys := []string{ipLimitKey(c.IP()), userLimitKey(user.Username)}
+	if wait := loginRetryAfter(limitKeys...); wait > 0 {
+		return tooManyAttempts(c, wait)
+	}
+
+	if !checkTotp(&user, request.Code) && !useRecoveryCode(&user, request.Code) {
+		loginFailed(limitKeys...)
+		if err := user.RegisterFailedLogin(); err != nil {
+			log.Printf("API: Could not register failed login for %s: %s", user.Username, err)
+		}
+		return errUnauthorized()
+	}
+
+	loginSucceeded(limitKeys...)
+	if err := user.ResetFailedLogins(); err != nil {
+		return errDatabase(err)
+	}
+	c.ClearCookie(mfaCookie)
+
+	response, err := startSession(c, &user)
+	if err != nil {
+		return err
+	}
+	return c.JSON(response)
+}
+
+// newMfaToken proves the password was correct, it can only be exchanged for a session together with a TOTP code
+func newMfaToken(user *database.User) (LoginResponse, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"mfa": user.ID,
+		"exp": time.Now().Add(mfaTokenTtl).Unix(),
+	})
+
+	key := activeSigningKey()
+	token.Header["kid"] = key.Kid
+
+	tokenString, err := token.SignedString(key.Secret)
+	if err != nil {
+		return LoginResponse{}, fmt.Errorf("could not sign jwt: %s", err)
+	}
+
+	return LoginResponse{MfaRequired: true, MfaToken: tokenString}, nil
+}
+
+// checkTotp validates code against the current and adjacent time steps, each step can only be used once
+func checkTotp(user *database.User, code string) bool {
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(user.TotpSecret)
+	if err != nil || len(code) != totpDigits {
+		return false
+	}
+
+	counter := time.Now().Unix() / totpPeriod
+	for _, step := range []int64{counter - 1, counter, counter + 1} {
+		if step <= user.TotpLastCounter || !hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			continue
+		}
+
+		result := database.Connection.Model(&database.User{}).
+			Where("id = ? AND totp_last_counter < ?", user.ID, step).
+			Update("totp_last_counter", step)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return false
+		}
+
+		user.TotpLastCounter = step
+		return true
+	}
+
+	return false
+}
+
+func totpCode(secret []byte, counter int64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func generateRecoveryCodes(user *database.User) ([]string, error) {
+	var codes []string
+	var records []database.RecoveryCode
+	for i := 0; i < recoveryCodeCount; i++ {
+		random := make([]byte, 10)
+		if _, err := crand.Read(random); err != nil {
+			return nil, fmt.Errorf("could not generate recovery code: %s", err)
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(random))
+		code = code[:8] + "-" + code[8:]
+		codes = append(codes, code)
+		records = append(records, database.RecoveryCode{UserID: user.ID, Hash: database.HashToken(code)})
+	}
+
+	err := database.Connection.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&database.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&records).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not save recovery codes: %s", err)
+	}
+
+	return codes, nil
+}
+
+func useRecoveryCode(user *database.User, code string) bool {
+	result := database.Connection.Model(&database.RecoveryCode{}).
+		Where("user_id = ? AND hash = ? AND used_at IS NULL", user.ID, database.HashToken(strings.ToLower(strings.TrimSpace(code)))).
+		Update("used_at", time.Now())
+
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false
+	}
+
+	log.Printf("API: %s used a recovery code", user.Username)
+	return true
+}
+
+func resetTotp(user *database.User) error {
+	return database.Connection.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&database.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(user).Updates(map[string]interface{}{
+			"totp_secret":       "",
+			"totp_enabled":      false,
+			"totp_last_counter": 0,
+		}).Error
+	})
+}
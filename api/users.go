@@ -0,0 +1,186 @@
+package api
+
+import (
+	"errors"
+	"github.com/Richard87/wg-vpn-server/database"
+	"github.com/gofiber/fiber/v2"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type UserResponse struct {
+	ID           uint       `json:"id"`
+	Username     string     `json:"username"`
+	Role         string     `json:"role"`
+	Sso          bool       `json:"sso"`
+	TotpEnabled  bool       `json:"totpEnabled"`
+	FailedLogins int        `json:"failedLogins"`
+	Locked       bool       `json:"locked"`
+	LockedUntil  *time.Time `json:"lockedUntil"`
+}
+
+func newUserResponse(user database.User) UserResponse {
+	response := UserResponse{
+		ID:           user.ID,
+		Username:     user.Username,
+		Role:         user.Role,
+		Sso:          user.Subject != "",
+		TotpEnabled:  user.TotpEnabled,
+		FailedLogins: user.FailedLogins,
+		Locked:       user.Locked(),
+	}
+	if response.Locked {
+		response.LockedUntil = user.LockedUntil
+	}
+	return response
+}
+
+type CreateUserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+type PasswordRequest struct {
+	Password string `json:"password"`
+}
+
+func GetUsers(c *fiber.Ctx) error {
+	users := []database.User{}
+	if err := database.Connection.Find(&users).Error; err != nil {
+		return errDatabase(err)
+	}
+
+	response := make([]UserResponse, 0, len(users))
+	for _, user := range users {
+		response = append(response, newUserResponse(user))
+	}
+
+	return c.Status(http.StatusOK).JSON(response)
+}
+
+func CreateUser(c *fiber.Ctx) error {
+	request := CreateUserRequest{}
+	if err := c.BodyParser(&request); err != nil {
+		return errBadRequest("Bad request")
+	}
+
+	invalid := validationErrors{}
+	if username := strings.TrimSpace(request.Username); username == "" || strings.Contains(username, ":") {
+		invalid.add("username", "username is required and must not contain :")
+	}
+	if request.Password == "" {
+		invalid.add("password", "password is required")
+	}
+	if err := invalid.err(); err != nil {
+		return err
+	}
+
+	user, err := database.CreateUser(request.Username, request.Password, request.Role)
+	if errors.Is(err, database.ErrUserExists) {
+		return errConflict("User already exists")
+	}
+	if err != nil {
+		return errDatabase(err)
+	}
+
+	return c.Status(http.StatusCreated).JSON(newUserResponse(*user))
+}
+
+func SetUserPassword(c *fiber.Ctx) error {
+
+	request := PasswordRequest{}
+	if err := c.BodyParser(&request); err != nil {
+		return errBadRequest("Bad request")
+	}
+	if request.Password == "" {
+		return validationErrors{{Field: "password", Message: "password is required"}}.err()
+	}
+
+	user, err := findUser(c)
+	if err != nil {
+		return err
+	}
+
+	if err = user.SetPassword(request.Password); err != nil {
+		return errDatabase(err)
+	}
+	loginSucceeded(userLimitKey(user.Username))
+
+	log.Printf("API: Changed the password of %s", user.Username)
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func DeleteUser(c *fiber.Ctx) error {
+
+	user, err := findUser(c)
+	if err != nil {
+		return err
+	}
+	if user.ID == c.Locals("user").(*database.User).ID {
+		return errConflict("You can not delete yourself")
+	}
+
+	if err = database.DeleteUser(user); err != nil {
+		return errDatabase(err)
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func UnlockUser(c *fiber.Ctx) error {
+
+	user, err := findUser(c)
+	if err != nil {
+		return err
+	}
+
+	if err = user.ResetFailedLogins(); err != nil {
+		return errDatabase(err)
+	}
+	loginSucceeded(userLimitKey(user.Username))
+
+	log.Printf("API: Unlocked %s", user.Username)
+	return c.Status(http.StatusOK).JSON(newUserResponse(*user))
+}
+
+// RevokeUserSessions logs a user out everywhere, its API tokens are deleted too unless ?tokens=false
+func RevokeUserSessions(c *fiber.Ctx) error {
+
+	user, err := findUser(c)
+	if err != nil {
+		return err
+	}
+
+	if err = database.RevokeSessions(user.ID); err != nil {
+		return errDatabase(err)
+	}
+	if c.Query("tokens") == "false" {
+		log.Printf("API: Revoked all sessions of %s", user.Username)
+		return c.SendStatus(http.StatusNoContent)
+	}
+	if err = database.RevokeApiTokens(user.ID); err != nil {
+		return errDatabase(err)
+	}
+
+	log.Printf("API: Revoked all sessions and API tokens of %s", user.Username)
+	return c.SendStatus(http.StatusNoContent)
+}
+
+// findUser loads the user in the id parameter
+func findUser(c *fiber.Ctx) (*database.User, error) {
+	id, err := paramID(c)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &database.User{}
+	if err = database.Connection.Limit(1).Find(user, id).Error; err != nil {
+		return nil, errDatabase(err)
+	}
+	if user.ID == 0 {
+		return nil, errNotFound()
+	}
+	return user, nil
+}
@@ -0,0 +1,466 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/config"
+	"github.com/Richard87/wg-vpn-server/database"
+	"golang.org/x/crypto/argon2"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Format is increased when the archive layout changes, the schema version covers the tables
+const Format = 1
+
+const (
+	manifestFile      = "manifest.json"
+	configFile        = "config.yaml"
+	privateKeyFile    = "wg.private"
+	usersFile         = "tables/users.json"
+	clientsFile       = "tables/clients.json"
+	networksFile      = "tables/networks.json"
+	apiTokensFile     = "tables/api_tokens.json"
+	recoveryCodesFile = "tables/recovery_codes.json"
+)
+
+// encryptedMagic starts an encrypted archive, followed by the salt, the nonce and the AES-GCM sealed archive
+var encryptedMagic = []byte("WGVPNBACKUP1")
+
+const (
+	saltSize  = 16
+	nonceSize = 12
+)
+
+type Manifest struct {
+	Format        int       `json:"format"`
+	SchemaVersion int       `json:"schemaVersion"`
+	CreatedAt     time.Time `json:"createdAt"`
+	PublicKey     string    `json:"publicKey"`
+	Users         int       `json:"users"`
+	Clients       int       `json:"clients"`
+	Networks      int       `json:"networks"`
+}
+
+// apiTokenRecord includes the token hash, which is never part of the API responses
+type apiTokenRecord struct {
+	database.ApiToken
+	Hash string `json:"hash"`
+}
+
+// clientRecord includes the preshared key, which is never part of the API responses
+type clientRecord struct {
+	database.Client
+	PresharedKey string `json:"presharedKey"`
+}
+
+// networkRecord includes the private key of the network
+type networkRecord struct {
+	database.Network
+	PrivateKey string `json:"privateKey"`
+}
+
+type contents struct {
+	manifest      Manifest
+	privateKey    []byte
+	users         []database.User
+	clients       []clientRecord
+	networks      []networkRecord
+	apiTokens     []apiTokenRecord
+	recoveryCodes []database.RecoveryCode
+}
+
+// ReadPassphrase reads -backup-passphrase-file, backups are not encrypted without it
+func ReadPassphrase() ([]byte, error) {
+	if config.Current().BackupPassphraseFile == "" {
+		return nil, nil
+	}
+
+	passphrase, err := os.ReadFile(config.Current().BackupPassphraseFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read backup passphrase: %s", err)
+	}
+	passphrase = bytes.TrimSpace(passphrase)
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("backup passphrase file %s is empty", config.Current().BackupPassphraseFile)
+	}
+	return passphrase, nil
+}
+
+// Create writes users, clients, networks, API tokens, the server private key and the effective configuration to w.
+// Sessions are not included, everybody logs in again after a restore.
+func Create(w io.Writer, passphrase []byte) (*Manifest, error) {
+	version, err := database.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := os.ReadFile(config.Config.WgKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not read private key: %s", err)
+	}
+	key, err := wgtypes.ParseKey(strings.TrimSpace(string(privateKey)))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse private key: %s", err)
+	}
+
+	backup := contents{privateKey: privateKey}
+	if err = database.Connection.Find(&backup.users).Error; err != nil {
+		return nil, err
+	}
+	var clients []database.Client
+	if err = database.Connection.Find(&clients).Error; err != nil {
+		return nil, err
+	}
+	for _, client := range clients {
+		backup.clients = append(backup.clients, clientRecord{Client: client, PresharedKey: client.PresharedKey})
+	}
+	var networks []database.Network
+	if err = database.Connection.Find(&networks).Error; err != nil {
+		return nil, err
+	}
+	for _, network := range networks {
+		backup.networks = append(backup.networks, networkRecord{Network: network, PrivateKey: network.PrivateKey})
+	}
+	var tokens []database.ApiToken
+	if err = database.Connection.Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		backup.apiTokens = append(backup.apiTokens, apiTokenRecord{ApiToken: token, Hash: token.Hash})
+	}
+	if err = database.Connection.Find(&backup.recoveryCodes).Error; err != nil {
+		return nil, err
+	}
+
+	backup.manifest = Manifest{
+		Format:        Format,
+		SchemaVersion: version,
+		CreatedAt:     time.Now().UTC(),
+		PublicKey:     key.PublicKey().String(),
+		Users:         len(backup.users),
+		Clients:       len(backup.clients),
+		Networks:      len(backup.networks),
+	}
+
+	var settings bytes.Buffer
+	config.Current().Print(&settings)
+
+	archive := &bytes.Buffer{}
+	gz := gzip.NewWriter(archive)
+	tw := tar.NewWriter(gz)
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{manifestFile, backup.manifest},
+		{privateKeyFile, privateKey},
+		{configFile, settings.Bytes()},
+		{usersFile, backup.users},
+		{clientsFile, backup.clients},
+		{networksFile, backup.networks},
+		{apiTokensFile, backup.apiTokens},
+		{recoveryCodesFile, backup.recoveryCodes},
+	}
+	for _, file := range files {
+		content, ok := file.content.([]byte)
+		if !ok {
+			if content, err = json.MarshalIndent(file.content, "", "  "); err != nil {
+				return nil, err
+			}
+		}
+		header := &tar.Header{Name: file.name, Mode: 0600, Size: int64(len(content)), ModTime: backup.manifest.CreatedAt}
+		if err = tw.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err = tw.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	if err = gz.Close(); err != nil {
+		return nil, err
+	}
+
+	if passphrase != nil {
+		if archive, err = encrypt(archive.Bytes(), passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = io.Copy(w, archive)
+	return &backup.manifest, err
+}
+
+// Restore validates the archive, and replaces users, clients, networks, API tokens and the server private key with its
+// contents.
+// Every session is revoked.
+func Restore(r io.Reader, passphrase []byte) (*Manifest, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(raw, encryptedMagic) {
+		if passphrase == nil {
+			return nil, errors.New("the backup is encrypted, set -backup-passphrase-file")
+		}
+		if raw, err = decrypt(raw, passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	backup, err := read(raw)
+	if err != nil {
+		return nil, err
+	}
+	key, err := validate(backup)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup: %s", err)
+	}
+
+	err = database.Connection.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&database.Session{}, &database.RecoveryCode{}, &database.ApiToken{}, &database.Client{}, &database.Network{}, &database.User{}} {
+			if err := tx.Unscoped().Where("1 = 1").Delete(model).Error; err != nil {
+				return err
+			}
+		}
+
+		var clients []database.Client
+		for _, record := range backup.clients {
+			record.Client.PresharedKey = record.PresharedKey
+			clients = append(clients, record.Client)
+		}
+
+		// Backups made before networks were added have no networks file
+		var networks []database.Network
+		for _, record := range backup.networks {
+			record.Network.PrivateKey = record.PrivateKey
+			networks = append(networks, record.Network)
+		}
+
+		var tokens []database.ApiToken
+		for _, record := range backup.apiTokens {
+			record.ApiToken.Hash = record.Hash
+			tokens = append(tokens, record.ApiToken)
+		}
+
+		for _, rows := range []interface{}{backup.users, networks, clients, tokens, backup.recoveryCodes} {
+			if err := insert(tx, rows); err != nil {
+				return err
+			}
+		}
+
+		if tx.Dialector.Name() == "postgres" {
+			// Rows were inserted with their ids, the sequences have to continue after them
+			for _, table := range []string{"users", "networks", "clients", "api_tokens", "recovery_codes", "sessions"} {
+				err := tx.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s", table, table)).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not restore database: %s", err)
+	}
+
+	if err = os.WriteFile(config.Config.WgKey, backup.privateKey, 0600); err != nil {
+		return nil, fmt.Errorf("could not write private key: %s", err)
+	}
+	config.Config.WgPrivateKey = key
+	config.Config.WgPublicKey = key.PublicKey()
+
+	log.Printf("Restored backup from %s: %d users, %d clients, %d networks", backup.manifest.CreatedAt.Format(time.RFC3339), len(backup.users), len(backup.clients), len(backup.networks))
+	return &backup.manifest, nil
+}
+
+func insert(tx *gorm.DB, rows interface{}) error {
+	if reflect.ValueOf(rows).Len() == 0 {
+		return nil
+	}
+	return tx.Create(rows).Error
+}
+
+func read(raw []byte) (*contents, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("not a backup archive: %s", err)
+	}
+
+	backup := &contents{}
+	found := map[string]bool{}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read backup archive: %s", err)
+		}
+
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		var target interface{}
+		switch header.Name {
+		case manifestFile:
+			target = &backup.manifest
+		case privateKeyFile:
+			backup.privateKey = content
+		case usersFile:
+			target = &backup.users
+		case clientsFile:
+			target = &backup.clients
+		case networksFile:
+			target = &backup.networks
+		case apiTokensFile:
+			target = &backup.apiTokens
+		case recoveryCodesFile:
+			target = &backup.recoveryCodes
+		case configFile:
+			// The configuration is only included for reference, it comes from the config file, environment and flags
+		default:
+			return nil, fmt.Errorf("unexpected file %s in backup", header.Name)
+		}
+		found[header.Name] = true
+
+		if target != nil {
+			if err = json.Unmarshal(content, target); err != nil {
+				return nil, fmt.Errorf("could not parse %s: %s", header.Name, err)
+			}
+		}
+	}
+
+	for _, name := range []string{manifestFile, privateKeyFile, usersFile, clientsFile} {
+		if !found[name] {
+			return nil, fmt.Errorf("%s is missing from the backup", name)
+		}
+	}
+	return backup, nil
+}
+
+func validate(backup *contents) (wgtypes.Key, error) {
+	if backup.manifest.Format != Format {
+		return wgtypes.Key{}, fmt.Errorf("unsupported backup format %d", backup.manifest.Format)
+	}
+	if latest := database.LatestSchemaVersion(); backup.manifest.SchemaVersion > latest {
+		return wgtypes.Key{}, fmt.Errorf("the backup has schema version %d, this server supports %d", backup.manifest.SchemaVersion, latest)
+	}
+
+	key, err := wgtypes.ParseKey(strings.TrimSpace(string(backup.privateKey)))
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("invalid private key: %s", err)
+	}
+	if key.PublicKey().String() != backup.manifest.PublicKey {
+		return wgtypes.Key{}, fmt.Errorf("private key does not match public key %s", backup.manifest.PublicKey)
+	}
+
+	usernames := map[string]bool{}
+	for _, user := range backup.users {
+		if user.Username == "" || usernames[user.Username] {
+			return wgtypes.Key{}, fmt.Errorf("empty or duplicate username %q", user.Username)
+		}
+		usernames[user.Username] = true
+	}
+
+	networkIDs := map[uint]bool{0: true}
+	for _, network := range backup.networks {
+		if _, err := wgtypes.ParseKey(network.PrivateKey); err != nil {
+			return wgtypes.Key{}, fmt.Errorf("network %s has an invalid private key: %s", network.Name, err)
+		}
+		networkIDs[network.ID] = true
+	}
+
+	seen := map[string]bool{}
+	for _, client := range backup.clients {
+		if !networkIDs[client.NetworkID] {
+			return wgtypes.Key{}, fmt.Errorf("client %s belongs to network %d, which is not in the backup", client.Name, client.NetworkID)
+		}
+		if _, err := wgtypes.ParseKey(client.PublicKey); err != nil {
+			return wgtypes.Key{}, fmt.Errorf("client %s has an invalid public key: %s", client.Name, err)
+		}
+		if _, _, err := net.ParseCIDR(client.AllowedIp4); err != nil {
+			return wgtypes.Key{}, fmt.Errorf("client %s has an invalid ip: %s", client.Name, err)
+		}
+		if seen[client.PublicKey] || seen[client.AllowedIp4] {
+			return wgtypes.Key{}, fmt.Errorf("client %s has a duplicate public key or ip", client.Name)
+		}
+		seen[client.PublicKey] = true
+		seen[client.AllowedIp4] = true
+	}
+
+	return key, nil
+}
+
+func encryptionKey(passphrase []byte, salt []byte) []byte {
+	return argon2.IDKey(passphrase, salt, 3, 64*1024, 4, 32)
+}
+
+func encrypt(plaintext []byte, passphrase []byte) (*bytes.Buffer, error) {
+	salt := make([]byte, saltSize)
+	nonce := make([]byte, nonceSize)
+	if _, err := crand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(encryptionKey(passphrase, salt))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &bytes.Buffer{}
+	out.Write(encryptedMagic)
+	out.Write(salt)
+	out.Write(nonce)
+	out.Write(gcm.Seal(nil, nonce, plaintext, encryptedMagic))
+	return out, nil
+}
+
+func decrypt(raw []byte, passphrase []byte) ([]byte, error) {
+	raw = raw[len(encryptedMagic):]
+	if len(raw) < saltSize+nonceSize {
+		return nil, errors.New("the encrypted backup is truncated")
+	}
+	salt, nonce, ciphertext := raw[:saltSize], raw[saltSize:saltSize+nonceSize], raw[saltSize+nonceSize:]
+
+	block, err := aes.NewCipher(encryptionKey(passphrase, salt))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, encryptedMagic)
+	if err != nil {
+		return nil, errors.New("could not decrypt the backup, wrong passphrase or damaged file")
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,391 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/config"
+	"github.com/Richard87/wg-vpn-server/database"
+	"github.com/Richard87/wg-vpn-server/wireguard"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Backend is where the commands are carried out, the database and device on this host or the API of a running server
+type Backend interface {
+	Users() ([]User, error)
+	AddUser(username string, password string, role string) (*User, error)
+	SetPassword(user *User, password string) error
+	DeleteUser(user *User) error
+	Clients() ([]database.Client, error)
+	// AddClient returns the wg-quick config of the new client, with the private key when it was generated.
+	// An empty network is the default network.
+	AddClient(network string, client wireguard.BulkClient) ([]byte, error)
+	DeleteClient(client *database.Client) error
+	ClientConfig(client *database.Client) ([]byte, error)
+	// RotateClientKey returns the wg-quick config with the new key, with the private key when it was generated
+	RotateClientKey(client *database.Client, publicKey string) ([]byte, error)
+	Status(network string) (*wireguard.Status, error)
+}
+
+type User struct {
+	ID          uint   `json:"id"`
+	Username    string `json:"username"`
+	Role        string `json:"role"`
+	Sso         bool   `json:"sso"`
+	TotpEnabled bool   `json:"totpEnabled"`
+	Locked      bool   `json:"locked"`
+}
+
+const (
+	userUsage   = "Usage: wg-vpn-server user list|add <username> [-role admin]|passwd <username>|delete <username> [flags]"
+	clientUsage = "Usage: wg-vpn-server client list|add <name> [-network name] [-ip 10.0.0.5] [-public-key key] [-group name] [-expires 2006-01-02] [-out file]|show <id|name>|delete <id|name>|config <id|name> [-out file]|rotate-key <id|name> [-public-key key] [-out file] [flags]"
+	statusUsage = "Usage: wg-vpn-server status [-network name] [flags]"
+)
+
+// commands are the subcommands by name. With -remote the user, client and status commands use the API of a running
+// server, the others and those without it use the database and device on this host.
+var commands = map[string]func(args []string){
+	"user":    userCommand,
+	"client":  clientCommand,
+	"status":  statusCommand,
+	"migrate": migrateCommand,
+	"backup":  backupCommand,
+	"restore": restoreCommand,
+	"import":  importCommand,
+	"export":  exportCommand,
+	"bulk":    bulkCommand,
+}
+
+// IsCommand reports whether Run handles the command
+func IsCommand(command string) bool {
+	_, ok := commands[command]
+	return ok
+}
+
+// Run handles a subcommand, args are the arguments after its name
+func Run(command string, args []string) {
+	run, ok := commands[command]
+	if !ok {
+		log.Fatalf("Unknown command %s", command)
+	}
+	run(args)
+}
+
+func userCommand(args []string) {
+	positional, options, configArgs := splitArgs(args, map[string]bool{"role": true})
+	if len(positional) == 0 {
+		log.Fatal(userUsage)
+	}
+	backend := newBackend(configArgs, false)
+
+	switch {
+	case positional[0] == "list" && len(positional) == 1:
+		users, err := backend.Users()
+		if err != nil {
+			log.Fatalf("Could not list users: %s", err)
+		}
+		out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(out, "ID\tUSERNAME\tROLE\tSSO\t2FA\tLOCKED")
+		for _, user := range users {
+			fmt.Fprintf(out, "%d\t%s\t%s\t%t\t%t\t%t\n", user.ID, user.Username, user.Role, user.Sso, user.TotpEnabled, user.Locked)
+		}
+		out.Flush()
+	case positional[0] == "add" && len(positional) == 2:
+		password, err := readPassword()
+		if err != nil {
+			log.Fatalf("Could not read password: %s", err)
+		}
+		user, err := backend.AddUser(positional[1], password, options["role"])
+		if err != nil {
+			log.Fatalf("Could not create user %s: %s", positional[1], err)
+		}
+		log.Printf("Created user %s (%s)", user.Username, user.Role)
+	case positional[0] == "passwd" && len(positional) == 2:
+		user := findUser(backend, positional[1])
+		password, err := readPassword()
+		if err != nil {
+			log.Fatalf("Could not read password: %s", err)
+		}
+		if err = backend.SetPassword(user, password); err != nil {
+			log.Fatalf("Could not change the password of %s: %s", user.Username, err)
+		}
+		log.Printf("Changed the password of %s, existing sessions and API tokens are revoked", user.Username)
+	case positional[0] == "delete" && len(positional) == 2:
+		user := findUser(backend, positional[1])
+		if err := backend.DeleteUser(user); err != nil {
+			log.Fatalf("Could not delete user %s: %s", user.Username, err)
+		}
+		log.Printf("Deleted user %s", user.Username)
+	default:
+		log.Fatal(userUsage)
+	}
+}
+
+func clientCommand(args []string) {
+	positional, options, configArgs := splitArgs(args, map[string]bool{
+		"network": true, "ip": true, "public-key": true, "group": true, "expires": true, "out": true,
+	})
+	if len(positional) == 0 {
+		log.Fatal(clientUsage)
+	}
+	backend := newBackend(configArgs, true)
+
+	switch {
+	case positional[0] == "list" && len(positional) == 1:
+		clients, err := backend.Clients()
+		if err != nil {
+			log.Fatalf("Could not list clients: %s", err)
+		}
+		out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(out, "ID\tNAME\tIP\tGROUP\tEXPIRES\tPUBLIC KEY")
+		for _, client := range clients {
+			fmt.Fprintf(out, "%d\t%s\t%s\t%s\t%s\t%s\n", client.ID, client.Name, client.AllowedIp4, client.Group, formatExpiry(&client), client.PublicKey)
+		}
+		out.Flush()
+	case positional[0] == "add" && len(positional) == 2:
+		row := wireguard.BulkClient{
+			Name:      positional[1],
+			Ip:        options["ip"],
+			PublicKey: options["public-key"],
+			Group:     options["group"],
+		}
+		if expires := options["expires"]; expires != "" {
+			expiresAt, err := time.Parse(time.RFC3339, expires)
+			if err != nil {
+				if expiresAt, err = time.Parse("2006-01-02", expires); err != nil {
+					log.Fatalf("Invalid -expires %s, use 2006-01-02 or RFC 3339", expires)
+				}
+			}
+			row.ExpiresAt = &expiresAt
+		}
+		conf, err := backend.AddClient(options["network"], row)
+		if err != nil {
+			log.Fatalf("Could not create client %s: %s", row.Name, err)
+		}
+		writeOutput(options["out"], conf)
+	case positional[0] == "show" && len(positional) == 2:
+		client := findClient(backend, positional[1])
+		out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(out, "ID:\t%d\n", client.ID)
+		fmt.Fprintf(out, "Name:\t%s\n", client.Name)
+		fmt.Fprintf(out, "Address:\t%s\n", client.AllowedIp4)
+		fmt.Fprintf(out, "Allowed IPs:\t%s\n", client.AllowedIps)
+		fmt.Fprintf(out, "Public key:\t%s\n", client.PublicKey)
+		fmt.Fprintf(out, "Group:\t%s\n", client.Group)
+		fmt.Fprintf(out, "Keepalive:\t%d\n", client.PersistentKeepalive)
+		fmt.Fprintf(out, "Expires:\t%s\n", formatExpiry(client))
+		fmt.Fprintf(out, "Disabled:\t%t\n", client.Disabled)
+		if client.DisabledReason != "" {
+			fmt.Fprintf(out, "Disabled reason:\t%s\n", client.DisabledReason)
+		}
+		fmt.Fprintf(out, "Key created:\t%s\n", client.KeyCreatedAt.Format(time.RFC3339))
+		fmt.Fprintf(out, "Created:\t%s\n", client.CreatedAt.Format(time.RFC3339))
+		out.Flush()
+	case positional[0] == "delete" && len(positional) == 2:
+		client := findClient(backend, positional[1])
+		if err := backend.DeleteClient(client); err != nil {
+			log.Fatalf("Could not delete client %s: %s", client.Name, err)
+		}
+		log.Printf("Deleted client %s (%s)", client.Name, client.AllowedIp4)
+	case positional[0] == "config" && len(positional) == 2:
+		client := findClient(backend, positional[1])
+		conf, err := backend.ClientConfig(client)
+		if err != nil {
+			log.Fatalf("Could not render the config of %s: %s", client.Name, err)
+		}
+		writeOutput(options["out"], conf)
+	case positional[0] == "rotate-key" && len(positional) == 2:
+		client := findClient(backend, positional[1])
+		conf, err := backend.RotateClientKey(client, options["public-key"])
+		if err != nil {
+			log.Fatalf("Could not rotate the key of %s: %s", client.Name, err)
+		}
+		writeOutput(options["out"], conf)
+	default:
+		log.Fatal(clientUsage)
+	}
+}
+
+func statusCommand(args []string) {
+	positional, options, configArgs := splitArgs(args, map[string]bool{"network": true})
+	if len(positional) > 0 {
+		log.Fatal(statusUsage)
+	}
+	backend := newBackend(configArgs, true)
+
+	status, err := backend.Status(options["network"])
+	if err != nil {
+		log.Fatalf("Could not read status: %s", err)
+	}
+
+	state := "stopped"
+	if status.Running {
+		state = "running"
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(out, "Network:\t%s\n", status.Network)
+	fmt.Fprintf(out, "Device:\t%s (%s)\n", status.Device, state)
+	fmt.Fprintf(out, "Public key:\t%s\n", status.PublicKey)
+	if status.NextPublicKey != "" {
+		fmt.Fprintf(out, "Next key:\t%s (rotation in progress)\n", status.NextPublicKey)
+	}
+	fmt.Fprintf(out, "Endpoint:\t%s\n", status.Endpoint)
+	fmt.Fprintf(out, "Listen port:\t%d\n", status.ListenPort)
+	fmt.Fprintf(out, "Client subnet:\t%s\n", status.Subnet)
+	fmt.Fprintf(out, "Clients:\t%d (%d expired)\n", status.Clients, status.Expired)
+	fmt.Fprintf(out, "Peers:\t%d (%d online)\n", status.Peers, status.Online)
+	for _, change := range status.FailedChanges {
+		fmt.Fprintf(out, "Failed change:\tclient %d (%s) after %d attempts: %s\n", change.ClientID, change.PublicKey, change.Attempts, change.LastError)
+	}
+	out.Flush()
+}
+
+// newBackend loads the configuration, the server keys are only needed by commands that render configs
+func newBackend(configArgs []string, keys bool) Backend {
+	config.InitCommand(configArgs)
+	if config.Config.Remote != "" {
+		backend, err := newRemoteBackend()
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		return backend
+	}
+
+	database.InitDatabase()
+	if keys {
+		wireguard.LoadKeys()
+	}
+	return &localBackend{}
+}
+
+// splitArgs separates the positional arguments, which come first, from the command options and the configuration
+// flags. options lists the command options, true when they take a value. A lone - is positional, it stands for stdout.
+func splitArgs(args []string, options map[string]bool) ([]string, map[string]string, []string) {
+	var positional []string
+	for len(args) > 0 && (!strings.HasPrefix(args[0], "-") || args[0] == "-") {
+		positional, args = append(positional, args[0]), args[1:]
+	}
+
+	values := map[string]string{}
+	var configArgs []string
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		value := ""
+		hasValue := false
+		if parts := strings.SplitN(name, "=", 2); len(parts) == 2 {
+			name, value, hasValue = parts[0], parts[1], true
+		}
+
+		takesValue, ok := options[name]
+		if !ok {
+			configArgs = append(configArgs, args[i])
+			continue
+		}
+		if takesValue && !hasValue {
+			if i+1 == len(args) {
+				log.Fatalf("-%s needs a value", name)
+			}
+			value = args[i+1]
+			i++
+		}
+		values[name] = value
+	}
+	return positional, values, configArgs
+}
+
+// readPassword prompts twice without echo on a terminal, or reads a single line from stdin for scripts
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	repeated, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(repeated) {
+		return "", errors.New("the passwords do not match")
+	}
+	return string(password), nil
+}
+
+func findUser(backend Backend, username string) *User {
+	users, err := backend.Users()
+	if err != nil {
+		log.Fatalf("Could not list users: %s", err)
+	}
+	for i := range users {
+		if users[i].Username == username {
+			return &users[i]
+		}
+	}
+	log.Fatalf("User %s not found", username)
+	return nil
+}
+
+// findClient finds a client by id, or by name when the name is unique
+func findClient(backend Backend, ref string) *database.Client {
+	clients, err := backend.Clients()
+	if err != nil {
+		log.Fatalf("Could not list clients: %s", err)
+	}
+
+	var found []*database.Client
+	for i := range clients {
+		if strconv.FormatUint(uint64(clients[i].ID), 10) == ref {
+			return &clients[i]
+		}
+		if clients[i].Name == ref {
+			found = append(found, &clients[i])
+		}
+	}
+	if len(found) == 0 {
+		log.Fatalf("Client %s not found", ref)
+	}
+	if len(found) > 1 {
+		log.Fatalf("%d clients are named %s, use the id instead", len(found), ref)
+	}
+	return found[0]
+}
+
+func formatExpiry(client *database.Client) string {
+	if client.ExpiresAt == nil {
+		return "never"
+	}
+	if client.Expired() {
+		return "expired " + client.ExpiresAt.Format(time.RFC3339)
+	}
+	return client.ExpiresAt.Format(time.RFC3339)
+}
+
+// writeOutput writes to file, or stdout when file is empty
+func writeOutput(file string, content []byte) {
+	if file == "" {
+		os.Stdout.Write(content)
+		return
+	}
+	if err := os.WriteFile(file, content, 0600); err != nil {
+		log.Fatalf("Could not write %s: %s", file, err)
+	}
+	log.Printf("Written to %s", file)
+}
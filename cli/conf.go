@@ -0,0 +1,157 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/config"
+	"github.com/Richard87/wg-vpn-server/database"
+	"github.com/Richard87/wg-vpn-server/wireguard"
+	"log"
+	"os"
+)
+
+const (
+	importUsage = "Usage: wg-vpn-server import <wg0.conf> [-dry-run] [-adopt-private-key] [flags]"
+	exportUsage = "Usage: wg-vpn-server export <file> [-format wg-quick|setconf] [-network name] [flags]"
+	bulkUsage   = "Usage: wg-vpn-server bulk <clients.csv|clients.json> [-dry-run] [-out configs.zip] [-network name] [flags]"
+)
+
+// importCommand handles "import <wg0.conf> [-dry-run] [-adopt-private-key]", conflicts are reported and skipped
+func importCommand(args []string) {
+	positional, options, configArgs := splitArgs(args, map[string]bool{"dry-run": false, "adopt-private-key": false})
+	if len(positional) != 1 || positional[0] == "-" {
+		log.Fatal(importUsage)
+	}
+	file := positional[0]
+
+	_, dryRun := options["dry-run"]
+	_, adoptPrivateKey := options["adopt-private-key"]
+	importOptions := wireguard.ImportOptions{DryRun: dryRun, AdoptPrivateKey: adoptPrivateKey}
+
+	config.InitCommand(configArgs)
+	database.InitDatabase()
+	if !importOptions.AdoptPrivateKey {
+		wireguard.LoadKeys()
+	}
+
+	in, err := os.Open(file)
+	if err != nil {
+		log.Fatalf("Could not open %s: %s", file, err)
+	}
+	conf, err := wireguard.ParseConf(in)
+	in.Close()
+	if err != nil {
+		log.Fatalf("Could not parse %s: %s", file, err)
+	}
+
+	result, err := wireguard.Import(conf, importOptions)
+	if err != nil {
+		log.Fatalf("Could not import %s: %s", file, err)
+	}
+
+	for _, peer := range result.Imported {
+		fmt.Printf("imported  %-30s %s %s\n", peer.Name, peer.AllowedIp4, peer.PublicKey)
+	}
+	for _, conflict := range result.Conflicts {
+		fmt.Printf("conflict  %-30s line %d: %s\n", conflict.Name, conflict.Line, conflict.Reason)
+	}
+	if importOptions.DryRun {
+		fmt.Println("Dry run, nothing was changed")
+		return
+	}
+
+	if result.AdoptedPrivateKey {
+		if err = wireguard.Sync(); err != nil {
+			log.Printf("Could not sync WireGuard, the adopted key is used from the next start: %s", err)
+		}
+	}
+}
+
+// exportCommand handles "export <file> [-format wg-quick|setconf] [-network name]", - writes to stdout
+func exportCommand(args []string) {
+	positional, options, configArgs := splitArgs(args, map[string]bool{"format": true, "network": true})
+	if len(positional) != 1 {
+		log.Fatal(exportUsage)
+	}
+	file := positional[0]
+
+	format := options["format"]
+	if format == "" {
+		format = wireguard.FormatWgQuick
+	}
+
+	config.InitCommand(configArgs)
+	database.InitDatabase()
+	wireguard.LoadKeys()
+
+	network, err := localNetwork(options["network"])
+	if err != nil {
+		log.Fatalf("Could not find network: %s", err)
+	}
+	conf, err := wireguard.RenderConf(network, format)
+	if err != nil {
+		log.Fatalf("Could not export: %s", err)
+	}
+
+	if file == "-" {
+		_, err = os.Stdout.Write(conf)
+	} else {
+		err = os.WriteFile(file, conf, 0600)
+	}
+	if err != nil {
+		log.Fatalf("Could not write %s: %s", file, err)
+	}
+}
+
+// bulkCommand handles "bulk <clients.csv|clients.json> [-dry-run] [-out configs.zip] [-network name]"
+func bulkCommand(args []string) {
+	positional, options, configArgs := splitArgs(args, map[string]bool{"dry-run": false, "out": true, "network": true})
+	if len(positional) != 1 || positional[0] == "-" {
+		log.Fatal(bulkUsage)
+	}
+	file := positional[0]
+
+	_, dryRun := options["dry-run"]
+	out := options["out"]
+	if out == "" {
+		out = "configs.zip"
+	}
+
+	config.InitCommand(configArgs)
+	database.InitDatabase()
+	wireguard.LoadKeys()
+
+	network, err := localNetwork(options["network"])
+	if err != nil {
+		log.Fatalf("Could not find network: %s", err)
+	}
+
+	in, err := os.Open(file)
+	if err != nil {
+		log.Fatalf("Could not open %s: %s", file, err)
+	}
+	rows, err := wireguard.ParseBulk(in)
+	in.Close()
+	if err != nil {
+		log.Fatalf("Could not parse %s: %s", file, err)
+	}
+
+	result, err := wireguard.Provision(network, rows, dryRun)
+	if err != nil {
+		log.Fatalf("Could not create clients: %s", err)
+	}
+
+	for _, row := range result.Rows {
+		fmt.Printf("%4d  %-8s %-30s %-18s %s\n", row.Row, row.Status, row.Name, row.AllowedIp4, row.Error)
+	}
+	if !result.Created {
+		if !dryRun {
+			log.Fatal("Nothing was created, fix the invalid rows first")
+		}
+		return
+	}
+
+	if err = os.WriteFile(out, result.Configs, 0600); err != nil {
+		log.Fatalf("Could not write %s: %s", out, err)
+	}
+	log.Printf("Client configs written to %s", out)
+}
@@ -0,0 +1,147 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/backup"
+	"github.com/Richard87/wg-vpn-server/config"
+	"github.com/Richard87/wg-vpn-server/database"
+	"github.com/Richard87/wg-vpn-server/wireguard"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	migrateUsage = "Usage: wg-vpn-server migrate status|up|down [version] [flags]"
+	backupUsage  = "Usage: wg-vpn-server backup <file> [flags]"
+	restoreUsage = "Usage: wg-vpn-server restore <file> [flags]"
+)
+
+// migrateCommand handles "migrate status|up|down [version]", without starting the server
+func migrateCommand(args []string) {
+	positional, _, configArgs := splitArgs(args, map[string]bool{})
+	if len(positional) == 0 || len(positional) > 2 {
+		log.Fatal(migrateUsage)
+	}
+
+	version := -1
+	if len(positional) == 2 {
+		v, err := strconv.Atoi(positional[1])
+		if err != nil || v < 0 {
+			log.Fatal(migrateUsage)
+		}
+		version = v
+	}
+
+	config.InitCommand(configArgs)
+	database.OpenDatabase()
+
+	current, err := database.SchemaVersion()
+	if err != nil {
+		log.Fatalf("Could not read schema version: %s", err)
+	}
+
+	switch positional[0] {
+	case "status":
+		status, err := database.GetMigrationStatus()
+		if err != nil {
+			log.Fatalf("Could not read migrations: %s", err)
+		}
+		fmt.Printf("Schema version %d, this server supports %d\n", current, database.LatestSchemaVersion())
+		for _, migration := range status {
+			applied := "pending"
+			if migration.AppliedAt != nil {
+				applied = "applied " + migration.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-50s %s\n", migration.Version, migration.Name, applied)
+		}
+	case "up":
+		if version < 0 {
+			version = database.LatestSchemaVersion()
+		}
+		if err = database.MigrateUp(version); err != nil {
+			log.Fatalf("%s", err)
+		}
+	case "down":
+		if version < 0 {
+			version = current - 1
+		}
+		if err = database.MigrateDown(version); err != nil {
+			log.Fatalf("%s", err)
+		}
+	default:
+		log.Fatal(migrateUsage)
+	}
+}
+
+// backupCommand handles "backup <file>", - writes the backup to stdout
+func backupCommand(args []string) {
+	positional, _, configArgs := splitArgs(args, map[string]bool{})
+	if len(positional) != 1 {
+		log.Fatal(backupUsage)
+	}
+	file := positional[0]
+
+	config.InitCommand(configArgs)
+	database.InitDatabase()
+
+	passphrase, err := backup.ReadPassphrase()
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	out := os.Stdout
+	if file != "-" {
+		if out, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			log.Fatalf("Could not create backup: %s", err)
+		}
+	}
+
+	manifest, err := backup.Create(out, passphrase)
+	if err != nil {
+		log.Fatalf("Could not create backup: %s", err)
+	}
+	if err = out.Close(); err != nil {
+		log.Fatalf("Could not write backup: %s", err)
+	}
+	log.Printf("Backup of %d users, %d clients and %d networks written to %s (encrypted: %t)", manifest.Users, manifest.Clients, manifest.Networks, file, passphrase != nil)
+}
+
+// restoreCommand handles "restore <file>". It refuses while the devices are up, a running server would keep using the
+// keys it loaded before the restore
+func restoreCommand(args []string) {
+	positional, _, configArgs := splitArgs(args, map[string]bool{})
+	if len(positional) != 1 || positional[0] == "-" {
+		log.Fatal(restoreUsage)
+	}
+	file := positional[0]
+
+	config.InitCommand(configArgs)
+	database.InitDatabase()
+
+	running, err := wireguard.RunningDevices()
+	if err != nil {
+		log.Printf("Could not check if WireGuard is running: %s", err)
+	}
+	if len(running) > 0 {
+		log.Fatalf("WireGuard devices %s are up, stop the server (and remove the devices) before restoring", strings.Join(running, ", "))
+	}
+
+	passphrase, err := backup.ReadPassphrase()
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	in, err := os.Open(file)
+	if err != nil {
+		log.Fatalf("Could not open backup: %s", err)
+	}
+	defer in.Close()
+
+	if _, err = backup.Restore(in, passphrase); err != nil {
+		log.Fatalf("Could not restore backup: %s", err)
+	}
+	log.Printf("WireGuard is configured with the restored clients and key when the server starts")
+}
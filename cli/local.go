@@ -0,0 +1,168 @@
+package cli
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/database"
+	"github.com/Richard87/wg-vpn-server/wireguard"
+	"gorm.io/gorm"
+	"io"
+)
+
+// localBackend works on the database and the device of this host, next to a running server or without one
+type localBackend struct{}
+
+func (b *localBackend) Users() ([]User, error) {
+	var users []database.User
+	if err := database.Connection.Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	result := make([]User, 0, len(users))
+	for _, user := range users {
+		result = append(result, newUser(&user))
+	}
+	return result, nil
+}
+
+func (b *localBackend) AddUser(username string, password string, role string) (*User, error) {
+	user, err := database.CreateUser(username, password, role)
+	if err != nil {
+		return nil, err
+	}
+	result := newUser(user)
+	return &result, nil
+}
+
+func (b *localBackend) SetPassword(user *User, password string) error {
+	dbUser, err := b.user(user)
+	if err != nil {
+		return err
+	}
+	return dbUser.SetPassword(password)
+}
+
+func (b *localBackend) DeleteUser(user *User) error {
+	dbUser, err := b.user(user)
+	if err != nil {
+		return err
+	}
+	return database.DeleteUser(dbUser)
+}
+
+func (b *localBackend) user(user *User) (*database.User, error) {
+	dbUser := &database.User{}
+	if err := database.Connection.Find(dbUser, user.ID).Error; err != nil {
+		return nil, err
+	}
+	if dbUser.ID == 0 {
+		return nil, errors.New("not found")
+	}
+	return dbUser, nil
+}
+
+func (b *localBackend) Clients() ([]database.Client, error) {
+	var clients []database.Client
+	err := database.Connection.Order("id").Find(&clients).Error
+	return clients, err
+}
+
+func (b *localBackend) AddClient(network string, client wireguard.BulkClient) ([]byte, error) {
+	target, err := localNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	result, err := wireguard.Provision(target, []wireguard.BulkClient{client}, false)
+	if err != nil {
+		return nil, err
+	}
+	if !result.Created {
+		return nil, errors.New(result.Rows[0].Error)
+	}
+	return firstConfig(result.Configs)
+}
+
+func (b *localBackend) DeleteClient(client *database.Client) error {
+	// Deleted permanently, the ip and public key are unique and can be used again
+	deleted := *client
+	return wireguard.Change(func(tx *gorm.DB) ([]database.Client, error) {
+		return []database.Client{deleted}, tx.Unscoped().Delete(client).Error
+	}, func(tx *gorm.DB) error {
+		return tx.Create(&deleted).Error
+	})
+}
+
+func (b *localBackend) ClientConfig(client *database.Client) ([]byte, error) {
+	network, err := wireguard.ClientNetwork(client)
+	if err != nil {
+		return nil, err
+	}
+	conf := wireguard.RenderClientConf(network, client, "")
+	return conf, wireguard.RecordConfig(network, client)
+}
+
+func (b *localBackend) RotateClientKey(client *database.Client, publicKey string) ([]byte, error) {
+	privateKey, err := wireguard.RotateClientKey(client, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err = database.Connection.First(client, client.ID).Error; err != nil {
+		return nil, err
+	}
+	network, err := wireguard.ClientNetwork(client)
+	if err != nil {
+		return nil, err
+	}
+	return wireguard.RenderClientConf(network, client, privateKey), nil
+}
+
+func (b *localBackend) Status(network string) (*wireguard.Status, error) {
+	target, err := localNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	return wireguard.GetNetworkStatus(target)
+}
+
+// localNetwork finds a network by name, the default network when name is empty
+func localNetwork(name string) (*wireguard.Network, error) {
+	if name == "" {
+		name = wireguard.DefaultNetwork
+	}
+	network, err := wireguard.GetNetwork(name)
+	if errors.Is(err, wireguard.ErrNetworkNotFound) {
+		return nil, fmt.Errorf("network %s not found", name)
+	}
+	return network, err
+}
+
+func newUser(user *database.User) User {
+	return User{
+		ID:          user.ID,
+		Username:    user.Username,
+		Role:        user.Role,
+		Sso:         user.Subject != "",
+		TotpEnabled: user.TotpEnabled,
+		Locked:      user.Locked(),
+	}
+}
+
+// firstConfig reads the config of a single client from the zip made by wireguard.Provision
+func firstConfig(archive []byte) ([]byte, error) {
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return nil, err
+	}
+	if len(reader.File) == 0 {
+		return nil, errors.New("no config was created")
+	}
+
+	file, err := reader.File[0].Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
@@ -0,0 +1,243 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/config"
+	"github.com/Richard87/wg-vpn-server/database"
+	"github.com/Richard87/wg-vpn-server/wireguard"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// remoteBackend uses the API of the server at -remote, authenticated with the API token in -remote-token
+type remoteBackend struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newRemoteBackend() (*remoteBackend, error) {
+	u, err := url.Parse(config.Config.Remote)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("-remote must be a https URL, for example https://vpn.example.com:8443")
+	}
+	if config.Config.RemoteToken == "" {
+		return nil, errors.New("-remote needs an API token in -remote-token or WG_VPN_REMOTE_TOKEN")
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.Config.RemoteCa != "" {
+		pem, err := os.ReadFile(config.Config.RemoteCa)
+		if err != nil {
+			return nil, fmt.Errorf("could not read -remote-ca: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in -remote-ca %s", config.Config.RemoteCa)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &remoteBackend{
+		url:   strings.TrimRight(config.Config.Remote, "/"),
+		token: config.Config.RemoteToken,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+func (b *remoteBackend) Users() ([]User, error) {
+	var users []User
+	err := b.call(http.MethodGet, "/api/users", nil, &users)
+	return users, err
+}
+
+func (b *remoteBackend) AddUser(username string, password string, role string) (*User, error) {
+	user := &User{}
+	err := b.call(http.MethodPost, "/api/users", map[string]string{
+		"username": username,
+		"password": password,
+		"role":     role,
+	}, user)
+	return user, err
+}
+
+func (b *remoteBackend) SetPassword(user *User, password string) error {
+	return b.call(http.MethodPut, fmt.Sprintf("/api/users/%d/password", user.ID), map[string]string{"password": password}, nil)
+}
+
+func (b *remoteBackend) DeleteUser(user *User) error {
+	return b.call(http.MethodDelete, fmt.Sprintf("/api/users/%d", user.ID), nil, nil)
+}
+
+func (b *remoteBackend) Clients() ([]database.Client, error) {
+	var clients []database.Client
+	for {
+		page := struct {
+			Items []database.Client `json:"items"`
+			Total int               `json:"total"`
+		}{}
+		if err := b.call(http.MethodGet, fmt.Sprintf("/api/clients?limit=1000&offset=%d", len(clients)), nil, &page); err != nil {
+			return nil, err
+		}
+		clients = append(clients, page.Items...)
+		if len(page.Items) == 0 || len(clients) >= page.Total {
+			return clients, nil
+		}
+	}
+}
+
+func (b *remoteBackend) AddClient(network string, client wireguard.BulkClient) ([]byte, error) {
+	body, status, err := b.request(http.MethodPost, networkPath(network)+"/clients/bulk", []wireguard.BulkClient{client})
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusCreated && status != http.StatusUnprocessableEntity {
+		return nil, responseError(status, body)
+	}
+
+	result := wireguard.BulkResult{}
+	if err = json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("invalid response: %s", err)
+	}
+	if !result.Created {
+		if len(result.Rows) > 0 {
+			return nil, errors.New(result.Rows[0].Error)
+		}
+		return nil, responseError(status, body)
+	}
+	return firstConfig(result.Configs)
+}
+
+func (b *remoteBackend) DeleteClient(client *database.Client) error {
+	return b.call(http.MethodDelete, fmt.Sprintf("/api/clients/%d", client.ID), nil, nil)
+}
+
+func (b *remoteBackend) ClientConfig(client *database.Client) ([]byte, error) {
+	body, status, err := b.request(http.MethodGet, fmt.Sprintf("/api/clients/%d/config", client.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, responseError(status, body)
+	}
+	return body, nil
+}
+
+func (b *remoteBackend) RotateClientKey(client *database.Client, publicKey string) ([]byte, error) {
+	result := struct {
+		Config string `json:"config"`
+	}{}
+	body := map[string]string{"publicKey": publicKey}
+	if err := b.call(http.MethodPost, fmt.Sprintf("/api/clients/%d/rotate-key", client.ID), body, &result); err != nil {
+		return nil, err
+	}
+	return []byte(result.Config), nil
+}
+
+func (b *remoteBackend) Status(network string) (*wireguard.Status, error) {
+	status := &wireguard.Status{}
+	err := b.call(http.MethodGet, networkPath(network)+"/status", nil, status)
+	return status, err
+}
+
+// networkPath is the prefix of the routes of a network, the default network has the routes without one
+func networkPath(network string) string {
+	if network == "" {
+		return "/api"
+	}
+	return "/api/networks/" + url.PathEscape(network)
+}
+
+// call sends body as JSON, and decodes a successful response into out when it is not nil
+func (b *remoteBackend) call(method string, path string, body interface{}, out interface{}) error {
+	response, status, err := b.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	if status < 200 || status > 299 {
+		return responseError(status, response)
+	}
+	if out == nil {
+		return nil
+	}
+	if err = json.Unmarshal(response, out); err != nil {
+		return fmt.Errorf("invalid response: %s", err)
+	}
+	return nil
+}
+
+func (b *remoteBackend) request(method string, path string, body interface{}) ([]byte, int, error) {
+	var reader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return nil, 0, err
+		}
+		reader = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequest(method, b.url+path, reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := b.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	response, err := io.ReadAll(res.Body)
+	return response, res.StatusCode, err
+}
+
+// responseError reads the error envelope of the API, {"error": {"code", "message", "fields", "requestId"}}
+func responseError(status int, body []byte) error {
+	envelope := struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+			Fields  []struct {
+				Field   string `json:"field"`
+				Message string `json:"message"`
+			} `json:"fields"`
+			RequestID string `json:"requestId"`
+		} `json:"error"`
+	}{}
+	if json.Unmarshal(body, &envelope) != nil || envelope.Error.Message == "" {
+		message := strings.TrimSpace(string(body))
+		if message == "" {
+			message = http.StatusText(status)
+		}
+		return fmt.Errorf("%d %s", status, message)
+	}
+
+	message := envelope.Error.Message
+	if envelope.Error.RequestID != "" {
+		message += fmt.Sprintf(" (request %s)", envelope.Error.RequestID)
+	}
+	for _, field := range envelope.Error.Fields {
+		message += fmt.Sprintf("\n  %s: %s", field.Field, field.Message)
+	}
+	return fmt.Errorf("%d %s", status, message)
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// defaultDataDir uses the StateDirectory from systemd when available
+func defaultDataDir() string {
+	if dir := os.Getenv("STATE_DIRECTORY"); dir != "" {
+		return filepath.SplitList(dir)[0]
+	}
+	return "./var"
+}
+
+// resolvePaths makes every path absolute, and derives unset paths from the data folder
+func (cfg *ConfigStruct) resolvePaths() error {
+	dataDir, err := filepath.Abs(cfg.DataDir)
+	if err != nil {
+		return fmt.Errorf("invalid data-dir %s: %w", cfg.DataDir, err)
+	}
+	cfg.DataDir = dataDir
+
+	paths := []struct {
+		value   *string
+		defName string
+	}{
+		{&cfg.WgKey, "wg.private"},
+		{&cfg.Database, "wg.db"},
+		{&cfg.HttpsKey, "server_key.pem"},
+		{&cfg.HttpsCrt, "server_crt.pem"},
+		{&cfg.HttpsJwtKeys, "jwt.keys"},
+		{&cfg.AcmeCacheDir, "acme"},
+	}
+	for _, path := range paths {
+		if *path.value == "" {
+			*path.value = filepath.Join(dataDir, path.defName)
+			continue
+		}
+		if *path.value, err = filepath.Abs(*path.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initDataDir creates the data folder, and makes sure every folder we write to exists and is writable.
+// Folders we create are only accessible by this user, the permissions of existing folders are left to the operator.
+func (cfg *ConfigStruct) initDataDir() error {
+	stat, err := os.Stat(cfg.DataDir)
+	switch {
+	case os.IsNotExist(err):
+		if err = os.MkdirAll(cfg.DataDir, 0700); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case stat.Mode().Perm()&0077 != 0:
+		log.Printf("Warning: %s is accessible by other users (%s), it holds private keys and the database", cfg.DataDir, stat.Mode().Perm())
+	}
+
+	dirs := []string{
+		cfg.DataDir,
+		filepath.Dir(cfg.WgKey),
+		filepath.Dir(cfg.Database),
+		filepath.Dir(cfg.HttpsKey),
+		filepath.Dir(cfg.HttpsCrt),
+		filepath.Dir(cfg.HttpsJwtKeys),
+	}
+	if len(cfg.AcmeDomains) > 0 {
+		dirs = append(dirs, cfg.AcmeCacheDir)
+	}
+
+	checked := map[string]bool{}
+	for _, dir := range dirs {
+		if checked[dir] {
+			continue
+		}
+		checked[dir] = true
+
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		if err := checkWritable(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".write-test-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	_ = file.Close()
+	return os.Remove(file.Name())
+}
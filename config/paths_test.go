@@ -0,0 +1,48 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInitDataDirRestrictsNewFolders(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	cfg, err := Load([]string{"-data-dir", dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.initDataDir(); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := stat.Mode().Perm(); perm != 0700 {
+		t.Fatalf("New data folder has permissions %s, expected -rwx------", perm)
+	}
+}
+
+func TestInitDataDirKeepsExistingPermissions(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load([]string{"-data-dir", dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.initDataDir(); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := stat.Mode().Perm(); perm != 0750 {
+		t.Fatalf("Existing data folder was changed to %s", perm)
+	}
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type ReloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restartRequired"`
+}
+
+// ReloadHook applies changed options to a running component
+type ReloadHook func(changed map[string]bool) error
+
+var (
+	loadedArgs  []string
+	reloadMutex sync.Mutex
+	reloadHooks []ReloadHook
+	// current holds the *ConfigStruct with the reloaded options, a reload publishes a new one instead of changing
+	// the fields requests are reading
+	current atomic.Value
+)
+
+// Current returns the configuration with the latest reloaded options. The options in liveOptions must be read from
+// it, Config keeps the values the process started with.
+func Current() *ConfigStruct {
+	if cfg, ok := current.Load().(*ConfigStruct); ok {
+		return cfg
+	}
+	return Config
+}
+
+// liveOptions can be changed without a restart
+var liveOptions = map[string]func(dst *ConfigStruct, src *ConfigStruct){
+	"wg-dns":                  func(dst, src *ConfigStruct) { dst.WgRecommendedDns = src.WgRecommendedDns },
+	"wg-endpoint":             func(dst, src *ConfigStruct) { dst.WgEndpoint = src.WgEndpoint },
+	"wg-listen-port":          func(dst, src *ConfigStruct) { dst.WgListenPort = src.WgListenPort },
+	"client-key-max-age":      func(dst, src *ConfigStruct) { dst.ClientKeyMaxAges = src.ClientKeyMaxAges },
+	"user":                    func(dst, src *ConfigStruct) { dst.Users = src.Users },
+	"https-cors":              func(dst, src *ConfigStruct) { dst.HttpsCors = src.HttpsCors },
+	"https-crt":               func(dst, src *ConfigStruct) { dst.HttpsCrt = src.HttpsCrt },
+	"https-key":               func(dst, src *ConfigStruct) { dst.HttpsKey = src.HttpsKey },
+	"https-client-cert-user":  func(dst, src *ConfigStruct) { dst.HttpsClientCertUsers = src.HttpsClientCertUsers },
+	"https-jwt-rotate":        func(dst, src *ConfigStruct) { dst.HttpsJwtRotate = src.HttpsJwtRotate },
+	"https-jwt-grace":         func(dst, src *ConfigStruct) { dst.HttpsJwtGrace = src.HttpsJwtGrace },
+	"https-access-token-ttl":  func(dst, src *ConfigStruct) { dst.HttpsAccessTokenTtl = src.HttpsAccessTokenTtl },
+	"https-refresh-token-ttl": func(dst, src *ConfigStruct) { dst.HttpsRefreshTokenTtl = src.HttpsRefreshTokenTtl },
+	"oidc-role":               func(dst, src *ConfigStruct) { dst.OidcRoles = src.OidcRoles },
+	"oidc-default-role":       func(dst, src *ConfigStruct) { dst.OidcDefaultRole = src.OidcDefaultRole },
+	"require-2fa-role":        func(dst, src *ConfigStruct) { dst.Require2faRoles = src.Require2faRoles },
+	"login-max-failures":      func(dst, src *ConfigStruct) { dst.LoginMaxFailures = src.LoginMaxFailures },
+	"login-lockout":           func(dst, src *ConfigStruct) { dst.LoginLockout = src.LoginLockout },
+	"backup-passphrase-file":  func(dst, src *ConfigStruct) { dst.BackupPassphraseFile = src.BackupPassphraseFile },
+}
+
+// OnReload registers a hook that is called with the changed options after a reload
+func OnReload(hook ReloadHook) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	reloadHooks = append(reloadHooks, hook)
+}
+
+// Reload reads the configuration again with the original arguments, applies the options that
+// can be changed live, and reports the changed options that need a restart
+func Reload() (*ReloadResult, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	cfg, err := Load(loadedArgs)
+	if err != nil {
+		return nil, err
+	}
+	if err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%s", err)
+	}
+
+	previous := Current()
+	next := *previous
+	next.sources = make(map[string]string, len(previous.sources))
+	for name, source := range previous.sources {
+		next.sources[name] = source
+	}
+
+	result := &ReloadResult{Applied: []string{}, RestartRequired: []string{}}
+	changed := map[string]bool{}
+	cfg.flags.VisitAll(func(f *flag.Flag) {
+		current := previous.flags.Lookup(f.Name)
+		if current == nil || optionValue(current) == optionValue(f) {
+			return
+		}
+
+		apply, live := liveOptions[f.Name]
+		if !live {
+			result.RestartRequired = append(result.RestartRequired, f.Name)
+			return
+		}
+
+		apply(&next, cfg)
+		next.sources[f.Name] = cfg.Source(f.Name)
+		changed[f.Name] = true
+		result.Applied = append(result.Applied, f.Name)
+	})
+	sort.Strings(result.Applied)
+	sort.Strings(result.RestartRequired)
+
+	if len(changed) > 0 {
+		next.bindFlags()
+		current.Store(&next)
+		for _, hook := range reloadHooks {
+			if err := hook(changed); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	log.Printf("Reloaded configuration, applied: %v, requires restart: %v", result.Applied, result.RestartRequired)
+	return result, nil
+}
+
+// bindFlags gives cfg a flag set of its own, so Print and the next Reload read the values of cfg
+func (cfg *ConfigStruct) bindFlags() {
+	values := *cfg
+	flags := newFlagSet(cfg) // resets the fields to their defaults
+	*cfg = values
+	cfg.flags = flags
+}
+
+func optionValue(f *flag.Flag) string {
+	switch v := f.Value.(type) {
+	case *StringsFlag:
+		return strings.Join(*v, "\n")
+	case *UsersFlag:
+		return strings.Join(*v, "\n")
+	}
+	return f.Value.String()
+}
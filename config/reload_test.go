@@ -0,0 +1,97 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useConfigFile starts the configuration from a config file with content, and restores the previous one after the test
+func useConfigFile(t *testing.T, content string) string {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "wg-vpn-server.yaml")
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{"-config", file, "-data-dir", dir}
+	cfg, err := Load(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous, previousArgs := Config, loadedArgs
+	Config = cfg
+	current.Store(cfg)
+	loadedArgs = args
+	t.Cleanup(func() {
+		Config = previous
+		current.Store(previous)
+		loadedArgs = previousArgs
+	})
+	return file
+}
+
+func TestReloadPublishesNewConfiguration(t *testing.T) {
+	file := useConfigFile(t, "wg-endpoint: old.example.com\nwg-device: wg0\n")
+	started := Config
+	if err := os.WriteFile(file, []byte("wg-endpoint: new.example.com\nwg-device: wg7\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests keep reading while the configuration is reloaded, go test -race reports unsynchronized access
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					if endpoint := Current().WgEndpoint; endpoint != "old.example.com" && endpoint != "new.example.com" {
+						t.Errorf("Read endpoint %q", endpoint)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	result, err := Reload()
+	close(stop)
+	readers.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(result.Applied, ",") != "wg-endpoint" || strings.Join(result.RestartRequired, ",") != "wg-device" {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+	if Current().WgEndpoint != "new.example.com" || Current().WgDeviceName != "wg0" {
+		t.Fatalf("Reloaded configuration has endpoint %s and device %s", Current().WgEndpoint, Current().WgDeviceName)
+	}
+	if started.WgEndpoint != "old.example.com" {
+		t.Fatalf("The published configuration was changed to %s", started.WgEndpoint)
+	}
+
+	var printed bytes.Buffer
+	Current().Print(&printed)
+	if !strings.Contains(printed.String(), "wg-endpoint: new.example.com # file") {
+		t.Fatalf("Print shows the old endpoint:\n%s", printed.String())
+	}
+
+	// Applied options are not reported again, the pending restart is
+	result, err = Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 0 || strings.Join(result.RestartRequired, ",") != "wg-device" {
+		t.Fatalf("Unexpected result of the second reload %+v", result)
+	}
+}
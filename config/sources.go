@@ -0,0 +1,240 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	EnvPrefix = "WG_VPN_"
+
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+
+	redacted = "<redacted>"
+)
+
+// secretOptions are never printed
+var secretOptions = map[string]bool{
+	"user":               true,
+	"database-url":       true,
+	"oidc-client-secret": true,
+	"remote-token":       true,
+}
+
+// Load reads the configuration. Command line flags override WG_VPN_* environment variables,
+// which override the config file, which overrides the defaults.
+func Load(args []string) (*ConfigStruct, error) {
+	cfg := &ConfigStruct{sources: map[string]string{}}
+	fs := newFlagSet(cfg)
+	fs.SetOutput(io.Discard)
+	cfg.flags = fs
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	fs.SetOutput(os.Stderr)
+
+	fs.Visit(func(f *flag.Flag) {
+		cfg.sources[f.Name] = SourceFlag
+	})
+
+	env := readEnv(fs)
+	if file, ok := env["config"]; ok && cfg.sources["config"] == "" {
+		cfg.ConfigFile = file[0]
+		cfg.sources["config"] = SourceEnv
+	}
+
+	if cfg.ConfigFile != "" {
+		values, err := readConfigFile(cfg.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range values {
+			if _, overridden := env[name]; overridden || cfg.sources[name] != "" {
+				continue
+			}
+			if err := setOption(fs, name, value); err != nil {
+				return nil, fmt.Errorf("%s: %w", cfg.ConfigFile, err)
+			}
+			cfg.sources[name] = SourceFile
+		}
+	}
+
+	for name, value := range env {
+		// The config file is chosen above, and help is only a flag
+		if cfg.sources[name] == SourceFlag || name == "config" || name == "help" {
+			continue
+		}
+		if err := setOption(fs, name, value); err != nil {
+			return nil, fmt.Errorf("environment variable %s: %w", envName(name), err)
+		}
+		cfg.sources[name] = SourceEnv
+	}
+
+	if err := cfg.resolvePaths(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func envName(option string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(option, "-", "_"))
+}
+
+// readEnv returns the options set as environment variables, repeatable options are separated by newlines
+func readEnv(fs *flag.FlagSet) map[string][]string {
+	known := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		known[envName(f.Name)] = f.Name
+	})
+
+	values := map[string][]string{}
+	for _, variable := range os.Environ() {
+		parts := strings.SplitN(variable, "=", 2)
+		if !strings.HasPrefix(parts[0], EnvPrefix) || len(parts) != 2 {
+			continue
+		}
+
+		name, ok := known[parts[0]]
+		if !ok {
+			log.Printf("Ignoring unknown environment variable %s", parts[0])
+			continue
+		}
+
+		if isRepeatable(fs.Lookup(name)) {
+			values[name] = strings.Split(strings.TrimSpace(parts[1]), "\n")
+		} else {
+			values[name] = []string{parts[1]}
+		}
+	}
+	return values
+}
+
+func readConfigFile(path string) (map[string][]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+
+	raw := map[string]interface{}{}
+	if err = yaml.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %w", path, err)
+	}
+
+	values := map[string][]string{}
+	for name, value := range raw {
+		switch v := value.(type) {
+		case []interface{}:
+			for _, item := range v {
+				values[name] = append(values[name], fmt.Sprint(item))
+			}
+		case map[string]interface{}:
+			return nil, fmt.Errorf("%s: option %s must be a value or a list, not a map", path, name)
+		case nil:
+			values[name] = []string{""}
+		default:
+			values[name] = []string{fmt.Sprint(v)}
+		}
+	}
+	return values, nil
+}
+
+func setOption(fs *flag.FlagSet, name string, values []string) error {
+	f := fs.Lookup(name)
+	if f == nil || name == "config" || name == "help" {
+		return fmt.Errorf("unknown option %s", name)
+	}
+	if len(values) > 1 && !isRepeatable(f) {
+		return fmt.Errorf("option %s can only be set once", name)
+	}
+
+	for _, value := range values {
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %v", value, name, err)
+		}
+	}
+	return nil
+}
+
+func isRepeatable(f *flag.Flag) bool {
+	switch f.Value.(type) {
+	case *StringsFlag, *UsersFlag:
+		return true
+	}
+	return false
+}
+
+// Print writes the effective configuration as YAML, with the source of every option and secrets redacted
+func (cfg *ConfigStruct) Print(w io.Writer) {
+	var names []string
+	cfg.flags.VisitAll(func(f *flag.Flag) {
+		if f.Name != "help" && f.Name != "config" {
+			names = append(names, f.Name)
+		}
+	})
+	sort.Strings(names)
+
+	if cfg.ConfigFile != "" {
+		_, _ = fmt.Fprintf(w, "# config file: %s\n", cfg.ConfigFile)
+	}
+	for _, name := range names {
+		source := cfg.Source(name)
+		f := cfg.flags.Lookup(name)
+
+		var value interface{}
+		switch v := f.Value.(type) {
+		case *StringsFlag:
+			value = append([]string{}, *v...)
+		case *UsersFlag:
+			value = append([]string{}, *v...)
+		default:
+			value = f.Value.String()
+			if getter, ok := f.Value.(flag.Getter); ok {
+				switch typed := getter.Get().(type) {
+				case bool, int:
+					value = typed
+				}
+			}
+		}
+
+		if secretOptions[name] && source != SourceDefault {
+			if list, ok := value.([]string); ok {
+				for i := range list {
+					list[i] = redacted
+				}
+				value = list
+			} else if value != "" {
+				value = redacted
+			}
+		}
+
+		out, _ := yaml.Marshal(map[string]interface{}{name: value})
+		line := strings.TrimSuffix(string(out), "\n")
+		if strings.Contains(line, "\n") {
+			_, _ = fmt.Fprintf(w, "# %s: %s\n%s\n", name, source, line)
+		} else {
+			_, _ = fmt.Fprintf(w, "%s # %s\n", line, source)
+		}
+	}
+}
+
+// Source returns where an option was set: default, file, env or flag
+func (cfg *ConfigStruct) Source(name string) string {
+	if source, ok := cfg.sources[name]; ok {
+		return source
+	}
+	return SourceDefault
+}
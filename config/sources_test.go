@@ -0,0 +1,56 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setEnv sets an environment variable for the test
+func setEnv(t *testing.T, name string, value string) {
+	previous, existed := os.LookupEnv(name)
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if existed {
+			_ = os.Setenv(name, previous)
+		} else {
+			_ = os.Unsetenv(name)
+		}
+	})
+}
+
+func TestLoadReadsConfigFileFromEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "wg-vpn-server.yaml")
+	if err := os.WriteFile(file, []byte("wg-endpoint: env.example.com\nwg-listen-port: 51821\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setEnv(t, "WG_VPN_CONFIG", file)
+	setEnv(t, "WG_VPN_WG_LISTEN_PORT", "51822")
+
+	cfg, err := Load([]string{"-data-dir", dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ConfigFile != file || cfg.WgEndpoint != "env.example.com" {
+		t.Fatalf("Config file %q was not read, endpoint is %q", cfg.ConfigFile, cfg.WgEndpoint)
+	}
+	// The environment still overrides the file
+	if cfg.WgListenPort != 51822 || cfg.sources["wg-listen-port"] != SourceEnv {
+		t.Fatalf("Listen port is %d from %s", cfg.WgListenPort, cfg.sources["wg-listen-port"])
+	}
+
+	// The flag overrides the environment
+	other := filepath.Join(dir, "other.yaml")
+	if err = os.WriteFile(other, []byte("wg-endpoint: flag.example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = Load([]string{"-config", other, "-data-dir", dir}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.WgEndpoint != "flag.example.com" {
+		t.Fatalf("Endpoint is %q, -config was ignored", cfg.WgEndpoint)
+	}
+}
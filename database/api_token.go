@@ -0,0 +1,33 @@
+package database
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+const (
+	ApiTokenPrefix = "wgvpn_"
+	ScopeRead      = "read"
+	ScopeWrite     = "write"
+)
+
+// ApiToken is a long-lived credential for automation, only the hash of the token is stored
+type ApiToken struct {
+	gorm.Model
+	UserID     uint       `json:"userId" gorm:"index"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Hash       string     `json:"-" gorm:"size:191;uniqueIndex"`
+	Scope      string     `json:"scope"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+func (t *ApiToken) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+// RevokeApiTokens deletes every API token of a user
+func RevokeApiTokens(userID uint) error {
+	return Connection.Where("user_id = ?", userID).Delete(&ApiToken{}).Error
+}
@@ -1,12 +1,68 @@
 package database
 
 import (
+	"github.com/Richard87/wg-vpn-server/config"
 	"gorm.io/gorm"
+	"time"
 )
 
+// DisabledKeyAge is the DisabledReason of clients that were disabled because their key is too old
+const DisabledKeyAge = "key_age"
+
 type Client struct {
 	gorm.Model
 	Name       string `json:"name"`
 	AllowedIp4 string `json:"allowedIp4"`
 	PublicKey  string `json:"publicKey"`
+	// PresharedKey is optional, and only shared with the client itself
+	PresharedKey        string `json:"-"`
+	PersistentKeepalive int    `json:"persistentKeepalive"`
+	// AllowedIps are extra networks routed to the client, comma separated
+	AllowedIps string     `json:"allowedIps"`
+	Group      string     `json:"group" gorm:"column:client_group"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	// NetworkID is 0 for clients of the default network
+	NetworkID uint `json:"networkId" gorm:"index"`
+	// Disabled clients are kept, but removed from the device
+	Disabled bool `json:"disabled"`
+	// DisabledReason is DisabledKeyAge when the server disabled the client, empty when an admin did
+	DisabledReason string `json:"disabledReason"`
+	// KeyCreatedAt is when PublicKey was set
+	KeyCreatedAt time.Time `json:"keyCreatedAt"`
+	// ServerKey is the server public key in the last config the client got, empty when unknown
+	ServerKey string `json:"serverKey"`
+}
+
+// Expired clients are removed from the device
+func (c *Client) Expired() bool {
+	return c.ExpiresAt != nil && time.Now().After(*c.ExpiresAt)
+}
+
+// Active clients are configured on the device
+func (c *Client) Active() bool {
+	return !c.Disabled && !c.Expired()
+}
+
+// BeforeCreate sets the key age of new clients
+func (c *Client) BeforeCreate(*gorm.DB) error {
+	if c.KeyCreatedAt.IsZero() {
+		c.KeyCreatedAt = time.Now()
+	}
+	return nil
+}
+
+// KeyExpiresAt is when the key must be rotated, nil when keys of the group do not expire
+func (c *Client) KeyExpiresAt() *time.Time {
+	maxAge := config.Current().ClientKeyMaxAge(c.Group)
+	if maxAge == 0 {
+		return nil
+	}
+	expiresAt := c.KeyCreatedAt.Add(maxAge)
+	return &expiresAt
+}
+
+// KeyExpired clients are disabled until their key is rotated
+func (c *Client) KeyExpired() bool {
+	expiresAt := c.KeyExpiresAt()
+	return expiresAt != nil && time.Now().After(*expiresAt)
 }
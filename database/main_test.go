@@ -0,0 +1,39 @@
+package database
+
+import (
+	"github.com/Richard87/wg-vpn-server/config"
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+// TestMain runs the tests against a new sqlite database in a temporary data folder. Set WG_VPN_TEST_DATABASE_URL to run
+// them against PostgreSQL or MySQL instead, the schema of that database is dropped first. CI runs them against each
+// database, see .github/workflows/test.yml.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "wg-vpn-server-database-")
+	if err != nil {
+		log.Fatalf("Could not create data folder: %s", err)
+	}
+	if os.Getenv("WG_VPN_TEST_LOG") == "" {
+		log.SetOutput(io.Discard)
+	}
+
+	args := []string{"-data-dir", dir}
+	if url := os.Getenv("WG_VPN_TEST_DATABASE_URL"); url != "" {
+		args = append(args, "-database-url", url)
+	}
+	config.InitCommand(args)
+	if config.Config.DatabaseUrl != "" {
+		OpenDatabase()
+		if err = MigrateDown(0); err != nil {
+			log.Fatalf("Could not empty test database: %s", err)
+		}
+	}
+	InitDatabase()
+
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
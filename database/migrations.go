@@ -0,0 +1,535 @@
+package database
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"log"
+	"time"
+)
+
+// Migration changes the schema from Version-1 to Version. Migrations use their own copies of the models,
+// so they keep working when the models change later on.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration records an applied migration
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// migrations must be ordered by version, never change a migration that has been released
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: func(tx *gorm.DB) error {
+			// Databases created before versioned migrations already have these tables, AutoMigrate only adds what is missing
+			return tx.AutoMigrate(&v1User{}, &v1Client{}, &v1Session{}, &v1ApiToken{}, &v1RecoveryCode{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&v1RecoveryCode{}, &v1ApiToken{}, &v1Session{}, &v1Client{}, &v1User{})
+		},
+	},
+	{
+		Version: 2,
+		Name:    "unique usernames, client keys and client ips",
+		Up: func(tx *gorm.DB) error {
+			// Soft deleted rows would block the unique indexes, and are never read again
+			if err := tx.Unscoped().Where("deleted_at IS NOT NULL").Delete(&v2Client{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Where("deleted_at IS NOT NULL").Delete(&v2User{}).Error; err != nil {
+				return err
+			}
+
+			for _, column := range []struct {
+				model interface{}
+				table string
+				field string
+				index string
+			}{
+				{&v2User{}, "users", "username", "idx_users_username"},
+				{&v2Client{}, "clients", "public_key", "idx_clients_public_key"},
+				{&v2Client{}, "clients", "allowed_ip4", "idx_clients_allowed_ip4"},
+			} {
+				var duplicates []string
+				err := tx.Table(column.table).Select(column.field).Group(column.field).Having("COUNT(*) > 1").Pluck(column.field, &duplicates).Error
+				if err != nil {
+					return err
+				}
+				if len(duplicates) > 0 {
+					return fmt.Errorf("%s.%s has duplicates, remove them first: %v", column.table, column.field, duplicates)
+				}
+
+				// MySQL can not index text columns
+				if tx.Dialector.Name() == "mysql" {
+					if err := tx.Migrator().AlterColumn(column.model, column.field); err != nil {
+						return err
+					}
+				}
+				if err := tx.Migrator().CreateIndex(column.model, column.index); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropIndex(&v2User{}, "idx_users_username"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().DropIndex(&v2Client{}, "idx_clients_public_key"); err != nil {
+				return err
+			}
+			return tx.Migrator().DropIndex(&v2Client{}, "idx_clients_allowed_ip4")
+		},
+	},
+	{
+		Version: 3,
+		Name:    "client preshared keys, keepalive and extra allowed ips",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range []string{"PresharedKey", "PersistentKeepalive", "AllowedIps"} {
+				if err := tx.Migrator().AddColumn(&v3Client{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, column := range []string{"PresharedKey", "PersistentKeepalive", "AllowedIps"} {
+				if err := dropColumn(tx, &v3Client{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}, {
+		Version: 4,
+		Name:    "client groups and expiry",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range []string{"Group", "ExpiresAt"} {
+				if err := tx.Migrator().AddColumn(&v4Client{}, column); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateIndex(&v4Client{}, "Group")
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropIndex(&v4Client{}, "Group"); err != nil {
+				return err
+			}
+			for _, column := range []string{"Group", "ExpiresAt"} {
+				if err := dropColumn(tx, &v4Client{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}, {
+		Version: 5,
+		Name:    "disabled clients",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Migrator().AddColumn(&v5Client{}, "Disabled"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateIndex(&v5Client{}, "Disabled")
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropIndex(&v5Client{}, "Disabled"); err != nil {
+				return err
+			}
+			return dropColumn(tx, &v5Client{}, "Disabled")
+		},
+	}, {
+		Version: 6,
+		Name:    "device outbox",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&v6OutboxEntry{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&v6OutboxEntry{})
+		},
+	}, {
+		Version: 7,
+		Name:    "client server keys",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().AddColumn(&v7Client{}, "ServerKey")
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropColumn(tx, &v7Client{}, "ServerKey")
+		},
+	}, {
+		Version: 8,
+		Name:    "client key age",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range []string{"KeyCreatedAt", "DisabledReason"} {
+				if err := tx.Migrator().AddColumn(&v8Client{}, column); err != nil {
+					return err
+				}
+			}
+			// The keys of existing clients are as old as the clients
+			return tx.Exec("UPDATE clients SET key_created_at = created_at").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, column := range []string{"KeyCreatedAt", "DisabledReason"} {
+				if err := dropColumn(tx, &v8Client{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}, {
+		Version: 9,
+		Name:    "networks",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Migrator().CreateTable(&v9Network{}); err != nil {
+				return err
+			}
+			if err := tx.Migrator().AddColumn(&v9OutboxEntry{}, "NetworkID"); err != nil {
+				return err
+			}
+			// Existing clients stay in the default network
+			if err := tx.Migrator().AddColumn(&v9Client{}, "NetworkID"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateIndex(&v9Client{}, "NetworkID")
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropIndex(&v9Client{}, "NetworkID"); err != nil {
+				return err
+			}
+			if err := dropColumn(tx, &v9Client{}, "NetworkID"); err != nil {
+				return err
+			}
+			if err := dropColumn(tx, &v9OutboxEntry{}, "NetworkID"); err != nil {
+				return err
+			}
+			return tx.Migrator().DropTable(&v9Network{})
+		},
+	}, {
+		Version: 10,
+		Name:    "network key rotation",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range []string{"NextPrivateKey", "RotationStartedAt"} {
+				if err := tx.Migrator().AddColumn(&v10Network{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, column := range []string{"NextPrivateKey", "RotationStartedAt"} {
+				if err := dropColumn(tx, &v10Network{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// LatestSchemaVersion is the schema version this server is built for
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the highest applied migration, 0 for an empty database
+func SchemaVersion() (int, error) {
+	if err := Connection.AutoMigrate(&SchemaMigration{}); err != nil {
+		return 0, fmt.Errorf("could not create schema_migrations: %s", err)
+	}
+
+	var version int
+	err := Connection.Model(&SchemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+// GetMigrationStatus lists every known migration, and when it was applied
+func GetMigrationStatus() ([]MigrationStatus, error) {
+	if _, err := SchemaVersion(); err != nil {
+		return nil, err
+	}
+
+	var applied []SchemaMigration
+	if err := Connection.Find(&applied).Error; err != nil {
+		return nil, err
+	}
+	appliedAt := map[int]time.Time{}
+	for _, migration := range applied {
+		appliedAt[migration.Version] = migration.AppliedAt
+	}
+
+	var status []MigrationStatus
+	for _, migration := range migrations {
+		state := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if at, ok := appliedAt[migration.Version]; ok {
+			state.AppliedAt = &at
+		}
+		status = append(status, state)
+	}
+	return status, nil
+}
+
+// MigrateUp applies every pending migration up to and including version
+func MigrateUp(version int) error {
+	current, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range migrations {
+		if migration.Version <= current || migration.Version > version {
+			continue
+		}
+
+		log.Printf("DB: Applying migration %d: %s", migration.Version, migration.Name)
+		err := Connection.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %s", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
+
+// MigrateDown reverts applied migrations until the schema is at version
+func MigrateDown(version int) error {
+	current, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if migration.Version > current || migration.Version <= version {
+			continue
+		}
+
+		log.Printf("DB: Reverting migration %d: %s", migration.Version, migration.Name)
+		err := Connection.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{}, migration.Version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("reverting migration %d (%s) failed: %s", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
+
+// dropColumn drops a column and keeps the other indexes of the table. sqlite can not drop columns, so the table is
+// copied without the column, and without any index.
+func dropColumn(tx *gorm.DB, model interface{}, column string) error {
+	if tx.Dialector.Name() != "sqlite" {
+		return tx.Migrator().DropColumn(model, column)
+	}
+
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(model); err != nil {
+		return err
+	}
+	rows, err := tx.Raw("SELECT sql FROM sqlite_master WHERE type = ? AND tbl_name = ? AND sql IS NOT NULL", "index", stmt.Table).Rows()
+	if err != nil {
+		return err
+	}
+	var indexes []string
+	for rows.Next() {
+		var index string
+		if err = rows.Scan(&index); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		indexes = append(indexes, index)
+	}
+	if err = rows.Close(); err != nil {
+		return err
+	}
+
+	if err = tx.Migrator().DropColumn(model, column); err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if err = tx.Exec(index).Error; err != nil {
+			return fmt.Errorf("could not restore index of %s: %s", stmt.Table, err)
+		}
+	}
+	return nil
+}
+
+type v1User struct {
+	gorm.Model
+	Username        string
+	Hash            string
+	Role            string
+	Subject         string `gorm:"index"`
+	TotpSecret      string
+	TotpEnabled     bool
+	TotpLastCounter int64
+	FailedLogins    int
+	LockedUntil     *time.Time
+}
+
+func (v1User) TableName() string { return "users" }
+
+type v1Client struct {
+	gorm.Model
+	Name       string
+	AllowedIp4 string
+	PublicKey  string
+}
+
+func (v1Client) TableName() string { return "clients" }
+
+type v1Session struct {
+	gorm.Model
+	UserID       uint   `gorm:"index"`
+	TokenHash    string `gorm:"index"`
+	PreviousHash string `gorm:"index"`
+	ExpiresAt    time.Time
+	RevokedAt    *time.Time
+}
+
+func (v1Session) TableName() string { return "sessions" }
+
+type v1ApiToken struct {
+	gorm.Model
+	UserID     uint `gorm:"index"`
+	Name       string
+	Prefix     string
+	Hash       string `gorm:"size:191;uniqueIndex"`
+	Scope      string
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+}
+
+func (v1ApiToken) TableName() string { return "api_tokens" }
+
+type v1RecoveryCode struct {
+	gorm.Model
+	UserID uint `gorm:"index"`
+	Hash   string
+	UsedAt *time.Time
+}
+
+func (v1RecoveryCode) TableName() string { return "recovery_codes" }
+
+type v2User struct {
+	gorm.Model
+	Username string `gorm:"size:191;uniqueIndex:idx_users_username"`
+}
+
+func (v2User) TableName() string { return "users" }
+
+type v2Client struct {
+	gorm.Model
+	AllowedIp4 string `gorm:"size:191;uniqueIndex:idx_clients_allowed_ip4"`
+	PublicKey  string `gorm:"size:191;uniqueIndex:idx_clients_public_key"`
+}
+
+func (v2Client) TableName() string { return "clients" }
+
+type v3Client struct {
+	gorm.Model
+	PresharedKey        string
+	PersistentKeepalive int
+	AllowedIps          string
+}
+
+func (v3Client) TableName() string { return "clients" }
+
+type v4Client struct {
+	gorm.Model
+	Group     string `gorm:"column:client_group;size:191;index"`
+	ExpiresAt *time.Time
+}
+
+func (v4Client) TableName() string { return "clients" }
+
+type v5Client struct {
+	gorm.Model
+	Disabled bool `gorm:"index"`
+}
+
+func (v5Client) TableName() string { return "clients" }
+
+type v6OutboxEntry struct {
+	gorm.Model
+	ClientID  uint `gorm:"index"`
+	PublicKey string
+	Attempts  int
+	LastError string
+}
+
+func (v6OutboxEntry) TableName() string { return "outbox_entries" }
+
+type v7Client struct {
+	gorm.Model
+	ServerKey string
+}
+
+func (v7Client) TableName() string { return "clients" }
+
+type v8Client struct {
+	gorm.Model
+	KeyCreatedAt   time.Time
+	DisabledReason string
+}
+
+func (v8Client) TableName() string { return "clients" }
+
+type v9Network struct {
+	gorm.Model
+	Name       string `gorm:"size:191;uniqueIndex"`
+	DeviceName string
+	ListenPort int
+	Subnet     string
+	Endpoint   string
+	Dns        string
+	PrivateKey string
+	PublicKey  string
+}
+
+func (v9Network) TableName() string { return "networks" }
+
+type v9Client struct {
+	gorm.Model
+	NetworkID uint `gorm:"not null;default:0;index"`
+}
+
+func (v9Client) TableName() string { return "clients" }
+
+type v9OutboxEntry struct {
+	gorm.Model
+	NetworkID uint `gorm:"not null;default:0"`
+}
+
+func (v9OutboxEntry) TableName() string { return "outbox_entries" }
+
+type v10Network struct {
+	gorm.Model
+	NextPrivateKey    string
+	RotationStartedAt *time.Time
+}
+
+func (v10Network) TableName() string { return "networks" }
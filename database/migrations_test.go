@@ -0,0 +1,139 @@
+package database
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"strings"
+	"testing"
+	"time"
+)
+
+var models = []interface{}{&User{}, &RecoveryCode{}, &Session{}, &ApiToken{}, &Client{}, &Network{}, &OutboxEntry{}}
+
+// requireSchema checks that the migrated database has a column for every field of the models
+func requireSchema(t *testing.T) {
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: Connection}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+		if !Connection.Migrator().HasTable(model) {
+			t.Fatalf("Table %s is missing", stmt.Schema.Table)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !Connection.Migrator().HasColumn(model, field.DBName) {
+				t.Errorf("Column %s.%s is missing", stmt.Schema.Table, field.DBName)
+			}
+		}
+	}
+}
+
+func TestMigrationsMatchModels(t *testing.T) {
+	requireSchema(t)
+}
+
+func TestMigrationsRevertAndApplyAgain(t *testing.T) {
+	latest := LatestSchemaVersion()
+	t.Cleanup(func() {
+		if err := MigrateUp(latest); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if err := MigrateDown(0); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := SchemaVersion(); err != nil || version != 0 {
+		t.Fatalf("Schema version %d after reverting every migration (%v)", version, err)
+	}
+	for _, model := range models {
+		if Connection.Migrator().HasTable(model) {
+			t.Fatalf("Table of %T was not dropped", model)
+		}
+	}
+
+	if err := MigrateUp(latest); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := SchemaVersion(); err != nil || version != latest {
+		t.Fatalf("Schema version %d after applying every migration, expected %d (%v)", version, latest, err)
+	}
+	requireSchema(t)
+}
+
+func TestRevertingMigrationKeepsIndexes(t *testing.T) {
+	latest := LatestSchemaVersion()
+	t.Cleanup(func() {
+		if err := MigrateUp(latest); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Reverting the networks drops clients.network_id
+	if err := MigrateDown(8); err != nil {
+		t.Fatal(err)
+	}
+	for _, index := range []string{"idx_clients_public_key", "idx_clients_allowed_ip4", "idx_clients_disabled", "idx_clients_group"} {
+		if !Connection.Migrator().HasIndex(&v9Client{}, index) {
+			t.Errorf("Index %s was lost", index)
+		}
+	}
+}
+
+func TestApiTokenHashIsUnique(t *testing.T) {
+	user := createTestUser(t, "tokens")
+	hash := strings.Repeat("a", 64)
+	first := &ApiToken{UserID: user.ID, Name: "first", Hash: hash, Scope: ScopeRead}
+	if err := Connection.Create(first).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		Connection.Unscoped().Where("user_id = ?", user.ID).Delete(&ApiToken{})
+	})
+
+	quiet := Connection.Session(&gorm.Session{Logger: logger.Default.LogMode(logger.Silent)})
+	if err := quiet.Create(&ApiToken{UserID: user.ID, Name: "second", Hash: hash, Scope: ScopeRead}).Error; err == nil {
+		t.Fatal("Two tokens were stored with the same hash")
+	}
+
+	// MySQL can only index sized columns, a longtext hash would not have a unique index
+	if Connection.Dialector.Name() != "sqlite" {
+		columns, err := Connection.Migrator().ColumnTypes(&ApiToken{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, column := range columns {
+			if column.Name() != "hash" {
+				continue
+			}
+			if length, ok := column.Length(); !ok || length != 191 {
+				t.Fatalf("api_tokens.hash is %s with length %d, expected 191", column.DatabaseTypeName(), length)
+			}
+		}
+	}
+}
+
+func TestRevokeApiTokens(t *testing.T) {
+	user := createTestUser(t, "revoked")
+	expires := time.Now().Add(time.Hour)
+	for _, name := range []string{"ci", "backup"} {
+		token := &ApiToken{UserID: user.ID, Name: name, Hash: name + "-hash", Scope: ScopeWrite, ExpiresAt: &expires}
+		if err := Connection.Create(token).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		Connection.Unscoped().Where("user_id = ?", user.ID).Delete(&ApiToken{})
+	})
+
+	if err := RevokeApiTokens(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	if err := Connection.Model(&ApiToken{}).Where("user_id = ?", user.ID).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("%d tokens are left after revoking them", count)
+	}
+}
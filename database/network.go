@@ -0,0 +1,24 @@
+package database
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+// Network is a WireGuard interface with its own key pair, listen port and subnet. Clients with NetworkID 0 belong to
+// the default network, which is configured with the -wg-* and -client-subnet options.
+type Network struct {
+	gorm.Model
+	Name       string `json:"name" gorm:"size:191;uniqueIndex"`
+	DeviceName string `json:"deviceName"`
+	ListenPort int    `json:"listenPort"`
+	Subnet     string `json:"subnet"`
+	// Endpoint is the public host of the network, without the port
+	Endpoint   string `json:"endpoint"`
+	Dns        string `json:"dns"`
+	PrivateKey string `json:"-"`
+	PublicKey  string `json:"publicKey"`
+	// NextPrivateKey is the key a rotation switches to, empty when no rotation is in progress
+	NextPrivateKey    string     `json:"-"`
+	RotationStartedAt *time.Time `json:"-"`
+}
@@ -0,0 +1,23 @@
+package database
+
+import (
+	"gorm.io/gorm"
+)
+
+// OutboxEntry is a client whose peer on the device may differ from the database. It is written in the same transaction
+// as the client, and deleted when the device has been changed, so changes are not lost when the server stops halfway.
+type OutboxEntry struct {
+	gorm.Model
+	ClientID uint `gorm:"index"`
+	// NetworkID is the network of the device, it is known after the client was deleted
+	NetworkID uint
+	// PublicKey is the key the device may still have a peer for, the client can be deleted or have a new key
+	PublicKey string
+	Attempts  int
+	LastError string
+}
+
+// NewOutboxEntry is the pending device change of client
+func NewOutboxEntry(client *Client) OutboxEntry {
+	return OutboxEntry{ClientID: client.ID, NetworkID: client.NetworkID, PublicKey: client.PublicKey}
+}
@@ -0,0 +1,35 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"gorm.io/gorm"
+	"time"
+)
+
+// Session is a login session, identified by a rotating refresh token
+type Session struct {
+	gorm.Model
+	UserID       uint   `gorm:"index"`
+	TokenHash    string `gorm:"index"`
+	PreviousHash string `gorm:"index"`
+	ExpiresAt    time.Time
+	RevokedAt    *time.Time
+}
+
+func (s *Session) Active() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpiresAt)
+}
+
+// RevokeSessions revokes every active session of a user
+func RevokeSessions(userID uint) error {
+	return Connection.Model(&Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// HashToken hashes high entropy tokens before they are stored
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -2,6 +2,8 @@ package database
 
 import (
 	crand "crypto/rand"
+	"errors"
+	"fmt"
 	"github.com/Richard87/wg-vpn-server/config"
 	"github.com/alexedwards/argon2id"
 	"gorm.io/gorm"
@@ -9,6 +11,7 @@ import (
 	"math/big"
 	"runtime"
 	"strings"
+	"time"
 )
 
 type User struct {
@@ -16,92 +19,128 @@ type User struct {
 	Username string
 	Hash     string
 	Role     string
+	// Subject is the OpenID Connect subject of users created by single sign-on
+	Subject string `gorm:"index"`
+	// TotpSecret is set when enrolling, and only used for logins once TotpEnabled is set
+	TotpSecret      string
+	TotpEnabled     bool
+	TotpLastCounter int64
+	FailedLogins    int
+	LockedUntil     *time.Time
 }
 
-func InitUsers() {
-	usersCreated := false
-
-	users := []User{}
-	Connection.Find(&users)
+// RecoveryCode is a single use replacement for a TOTP code
+type RecoveryCode struct {
+	gorm.Model
+	UserID uint `gorm:"index"`
+	Hash   string
+	UsedAt *time.Time
+}
 
-	for _, user := range users {
-		usersCreated = true
+// RequiresTotp checks if the users role must use two-factor authentication
+func (u *User) RequiresTotp() bool {
+	for _, role := range config.Current().Require2faRoles {
+		if u.Role == role {
+			return true
+		}
+	}
+	return false
+}
 
-		for i, u := range config.Config.Users {
-			parts := strings.Split(u, ":")
-			if len(parts) < 2 {
-				log.Fatalf("When creating a new user, it must be in format username:password! (%s used)", u)
-			}
+var hashParams = &argon2id.Params{
+	Memory:      65536,
+	Iterations:  19,
+	Parallelism: uint8(runtime.NumCPU()),
+	SaltLength:  16,
+	KeyLength:   16,
+}
 
-			if parts[0] != user.Username {
-				continue
-			}
+func HashPassword(password string) (string, error) {
+	return argon2id.CreateHash(password, hashParams)
+}
 
-			hash, err := argon2id.CreateHash(parts[1], &argon2id.Params{
-				Memory:      65536,
-				Iterations:  19,
-				Parallelism: uint8(runtime.NumCPU()),
-				SaltLength:  16,
-				KeyLength:   16,
-			})
-			if err != nil {
-				log.Fatalf("could not update hash for %s: %s", user.Username, err)
-			}
+// Locked checks if the user is temporarily locked out after too many failed logins
+func (u *User) Locked() bool {
+	return u.LockedUntil != nil && time.Now().Before(*u.LockedUntil)
+}
 
-			user.Hash = hash
-			if len(parts) == 3 {
-				user.Role = parts[2]
-			}
+// RegisterFailedLogin counts a failed login, and locks the user when -login-max-failures is reached.
+// The count is increased by the database, so concurrent failed logins are all counted.
+func (u *User) RegisterFailedLogin() error {
+	var lockedUntil *time.Time
+	err := Connection.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&User{}).Where("id = ?", u.ID).Update("failed_logins", gorm.Expr("failed_logins + 1")).Error
+		if err != nil {
+			return err
+		}
 
-			Connection.Save(user)
-			removeIndexFromUsersList(i)
+		// The update locks the row until the transaction ends, so this is the count of this failure
+		var failures []int
+		if err = tx.Model(&User{}).Where("id = ?", u.ID).Pluck("failed_logins", &failures).Error; err != nil {
+			return err
+		}
+		if len(failures) == 0 {
+			return gorm.ErrRecordNotFound
 		}
+		u.FailedLogins = failures[0]
+		cfg := config.Current()
+		if cfg.LoginMaxFailures <= 0 || u.FailedLogins < cfg.LoginMaxFailures {
+			return nil
+		}
+
+		until := time.Now().Add(cfg.LoginLockout)
+		lockedUntil = &until
+		return tx.Model(&User{}).Where("id = ?", u.ID).Updates(map[string]interface{}{
+			"failed_logins": 0,
+			"locked_until":  lockedUntil,
+		}).Error
+	})
+	if err != nil || lockedUntil == nil {
+		return err
 	}
 
-	for i, u := range config.Config.Users {
-		parts := strings.Split(u, ":")
-		if len(parts) < 2 {
-			log.Fatalf("error in users database! Failed user: %d (%v)", i, parts)
-		}
+	u.FailedLogins = 0
+	u.LockedUntil = lockedUntil
+	log.Printf("DB: Locked user %s until %s after too many failed logins", u.Username, lockedUntil.Format(time.RFC3339))
+	return nil
+}
 
-		hash, err := argon2id.CreateHash(parts[1], &argon2id.Params{
-			Memory:      65536,
-			Iterations:  19,
-			Parallelism: uint8(runtime.NumCPU()),
-			SaltLength:  16,
-			KeyLength:   16,
-		})
-		if err != nil {
-			log.Fatalf("could not update hash for %s: %s", u, err)
-		}
+// ResetFailedLogins clears failed logins and lockouts
+func (u *User) ResetFailedLogins() error {
+	if u.FailedLogins == 0 && u.LockedUntil == nil {
+		return nil
+	}
 
-		var user = &User{
-			Username: parts[0],
-			Hash:     hash,
-			Role:     "admin",
-		}
-		if len(parts) == 3 {
-			user.Role = parts[2]
-		}
+	u.FailedLogins = 0
+	u.LockedUntil = nil
+	return Connection.Model(u).Updates(map[string]interface{}{
+		"failed_logins": 0,
+		"locked_until":  nil,
+	}).Error
+}
 
-		Connection.Create(user)
-		usersCreated = true
+func InitUsers() {
+	if err := SyncUsers(); err != nil {
+		log.Fatalf("%s", err)
 	}
+	config.OnReload(func(changed map[string]bool) error {
+		if !changed["user"] {
+			return nil
+		}
+		return SyncUsers()
+	})
+
+	var count int64
+	Connection.Model(&User{}).Count(&count)
 
-	if !usersCreated {
+	if count == 0 && !config.Config.DisableLocalLogin {
 		password, err := generatePassword(10)
 		if err != nil {
 			log.Fatalf("could not generate admin password: %s", err)
 		}
 
 		log.Println("Creating admin user with password: " + password)
-		hash, err := argon2id.CreateHash(password, &argon2id.Params{
-			Memory:      65536,
-			Iterations:  19,
-			Parallelism: uint8(runtime.NumCPU()),
-			SaltLength:  16,
-			KeyLength:   16,
-		})
+		hash, err := HashPassword(password)
 		if err != nil {
 			log.Fatalf("could not generate admin password: %s", err)
 		}
@@ -112,13 +151,121 @@ func InitUsers() {
 			Role:     "admin",
 		}
 
-		Connection.Create(newUser)
+		Connection.Create(&newUser)
+	}
+}
+
+// SyncUsers creates or updates the users given with -user, users missing from the list are kept
+func SyncUsers() error {
+	for _, u := range config.Current().Users {
+		parts := strings.Split(u, ":")
+		if len(parts) < 2 {
+			return fmt.Errorf("when creating a new user, it must be in format username:password! (%s used)", parts[0])
+		}
+
+		hash, err := HashPassword(parts[1])
+		if err != nil {
+			return fmt.Errorf("could not update hash for %s: %s", parts[0], err)
+		}
+
+		user := User{}
+		Connection.Where("username = ?", parts[0]).Limit(1).Find(&user)
+		if user.ID == 0 {
+			user = User{Username: parts[0], Role: "admin"}
+		}
+
+		user.Hash = hash
+		if len(parts) == 3 {
+			user.Role = parts[2]
+		}
+
+		if err = Connection.Save(&user).Error; err != nil {
+			return fmt.Errorf("could not save user %s: %s", user.Username, err)
+		}
+	}
+	return nil
+}
+
+// ErrUserExists is returned when creating a user with a username that is taken
+var ErrUserExists = errors.New("user already exists")
+
+// CreateUser creates a local user, the role defaults to admin like -user
+func CreateUser(username string, password string, role string) (*User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" || strings.Contains(username, ":") {
+		return nil, errors.New("username must not be empty or contain :")
 	}
+	if password == "" {
+		return nil, errors.New("password must not be empty")
+	}
+	if role == "" {
+		role = "admin"
+	}
+
+	var count int64
+	if err := Connection.Model(&User{}).Where("username = ?", username).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrUserExists
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &User{Username: username, Hash: hash, Role: role}
+	if err = Connection.Create(user).Error; err != nil {
+		return nil, err
+	}
+	log.Printf("DB: Created user %s (%s)", user.Username, user.Role)
+	return user, nil
 }
 
-func removeIndexFromUsersList(i int) {
-	config.Config.Users[i] = config.Config.Users[len(config.Config.Users)-1]
-	config.Config.Users = config.Config.Users[:len(config.Config.Users)-1]
+// SetPassword replaces the password, unlocks the user and revokes every session and API token
+func (u *User) SetPassword(password string) error {
+	if password == "" {
+		return errors.New("password must not be empty")
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	u.Hash = hash
+	u.FailedLogins = 0
+	u.LockedUntil = nil
+	err = Connection.Model(u).Updates(map[string]interface{}{
+		"hash":          u.Hash,
+		"failed_logins": 0,
+		"locked_until":  nil,
+	}).Error
+	if err != nil {
+		return err
+	}
+	if err = RevokeSessions(u.ID); err != nil {
+		return err
+	}
+	return RevokeApiTokens(u.ID)
+}
+
+// DeleteUser removes the user permanently, with its sessions, API tokens and recovery codes
+func DeleteUser(u *User) error {
+	err := Connection.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&Session{}, &ApiToken{}, &RecoveryCode{}} {
+			if err := tx.Unscoped().Where("user_id = ?", u.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		// Deleted permanently, the username is unique and can be used again
+		return tx.Unscoped().Delete(u).Error
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("DB: Deleted user %s", u.Username)
+	return nil
 }
 
 func generatePassword(length int) (string, error) {
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"github.com/Richard87/wg-vpn-server/config"
+	"sync"
+	"testing"
+)
+
+func createTestUser(t *testing.T, username string) *User {
+	user := &User{Username: username, Role: "user"}
+	if err := Connection.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		Connection.Unscoped().Delete(user)
+	})
+	return user
+}
+
+func TestRegisterFailedLoginCountsConcurrentFailures(t *testing.T) {
+	maxFailures := config.Current().LoginMaxFailures
+	config.Current().LoginMaxFailures = 0
+	t.Cleanup(func() {
+		config.Current().LoginMaxFailures = maxFailures
+	})
+	user := createTestUser(t, "concurrent")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(u User) {
+			defer wg.Done()
+			errs <- u.RegisterFailedLogin()
+		}(*user)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Connection.First(user, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.FailedLogins != 20 {
+		t.Fatalf("Counted %d failed logins, expected 20", user.FailedLogins)
+	}
+}
+
+func TestRegisterFailedLoginLocksUser(t *testing.T) {
+	maxFailures := config.Current().LoginMaxFailures
+	config.Current().LoginMaxFailures = 3
+	t.Cleanup(func() {
+		config.Current().LoginMaxFailures = maxFailures
+	})
+	user := createTestUser(t, "locked")
+
+	for i := 0; i < 3; i++ {
+		if user.Locked() {
+			t.Fatalf("Locked after %d failed logins", i)
+		}
+		if err := user.RegisterFailedLogin(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !user.Locked() {
+		t.Fatal("Not locked after 3 failed logins")
+	}
+
+	stored := User{}
+	if err := Connection.First(&stored, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Locked() || stored.FailedLogins != 0 {
+		t.Fatalf("Stored user is not locked: %d failed logins, locked until %v", stored.FailedLogins, stored.LockedUntil)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"embed"
 	"github.com/Richard87/wg-vpn-server/api"
+	"github.com/Richard87/wg-vpn-server/cli"
 	"github.com/Richard87/wg-vpn-server/config"
 	"github.com/Richard87/wg-vpn-server/database"
 	"github.com/Richard87/wg-vpn-server/wireguard"
@@ -21,7 +22,25 @@ import (
 var embededFiles embed.FS
 
 func main() {
-	config.InitFlags()
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "serve" {
+		serve(args[1:])
+		return
+	}
+	if len(args) > 0 && cli.IsCommand(args[0]) {
+		cli.Run(args[0], args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "config" {
+		configCommand(args[1:])
+		return
+	}
+
+	serve(args)
+}
+
+func serve(args []string) {
+	config.InitFlags(args)
 	database.InitDatabase()
 	database.InitUsers()
 
@@ -30,7 +49,17 @@ func main() {
 
 	api.Run(embededFiles)
 
-	termSignal := make(chan os.Signal)
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	go func() {
+		for range reloadSignal {
+			if _, err := config.Reload(); err != nil {
+				log.Printf("Could not reload configuration: %s", err)
+			}
+		}
+	}()
+
+	termSignal := make(chan os.Signal, 1)
 	signal.Notify(termSignal, syscall.SIGTERM, syscall.SIGINT)
 	signal.Notify(termSignal, os.Interrupt)
 	<-termSignal // Block until we receive our signal.
@@ -40,3 +69,20 @@ func main() {
 
 	os.Exit(0)
 }
+
+// configCommand handles "config print", which shows the effective configuration with secrets redacted
+func configCommand(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		log.Fatalf("Usage: wg-vpn-server config print [flags]")
+	}
+
+	cfg, err := config.Load(args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
+
+	cfg.Print(os.Stdout)
+	if err = cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%s", err)
+	}
+}
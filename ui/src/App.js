@@ -1,7 +1,8 @@
-import {MDBContainer, MDBNavbar, MDBNavbarBrand,} from "mdbreact";
+import {MDBBtn, MDBContainer, MDBNavbar, MDBNavbarBrand, MDBNavbarNav, MDBNavItem} from "mdbreact";
 import {BrowserRouter, Route, Routes} from "react-router-dom";
 import Dashboard from "./Dashboard";
 import Login from "./Login";
+import {logout} from "./index";
 
 
 function App() {
@@ -11,6 +12,11 @@ function App() {
                 <MDBNavbarBrand>
                     <strong className="white-text">WG VPN Server</strong>
                 </MDBNavbarBrand>
+                <MDBNavbarNav right>
+                    <MDBNavItem>
+                        <MDBBtn size="sm" color="indigo" onClick={logout}>Logout</MDBBtn>
+                    </MDBNavItem>
+                </MDBNavbarNav>
             </MDBNavbar>
             <MDBContainer>
                 <BrowserRouter>
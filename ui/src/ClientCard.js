@@ -13,15 +13,22 @@ export default function ClientCard({client, onDelete}) {
                 <strong>peer: </strong><span
                 style={{wordBreak: "break-all"}}>{client?.publicKey}</span><br/>
                 <strong>endpoint: </strong>{client?.endpoint}<br/>
-                <strong>allowed ips: </strong>{(client?.allowedIps ?? []).join(", ")}<br/>
+                <strong>allowed ips: </strong>{[client?.allowedIp4, ...(client?.allowedIps ? client.allowedIps.split(",") : [])].filter(Boolean).join(", ")}<br/>
                 <strong>latest handshake: </strong>{latestHandshakeDistance}<br/>
                 <strong>transfer: </strong>{bytesToSize(client?.receivedBytes)} received, {bytesToSize(client?.sentBytes)} sent<br/>
+                {client?.daysUntilKeyRotation != null && <><strong>key rotation: </strong>{keyRotation(client)}<br/></>}
             </MDBCardText>
             <MDBBtn onClick={onDelete}>Remove client</MDBBtn>
         </MDBCardBody>
     </MDBCard>
 }
 
+function keyRotation(client) {
+    if (client.disabledReason === "key_age") return "key expired, the client is disabled"
+    if (client.daysUntilKeyRotation < 0) return "key expired"
+    return `in ${client.daysUntilKeyRotation} days`
+}
+
 function bytesToSize(bytes) {
     const sizes = ['Bytes', 'KB', 'MB', 'GB', 'TB'];
     if (bytes === 0) return '0 Byte';
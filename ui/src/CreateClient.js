@@ -50,7 +50,7 @@ export default function CreateClient ({onSubmit}) {
 
     const onLocalSubmit = () => {
         setShowNewClient(false)
-        onSubmit({name, allowedIps: [ip ?? defaultIp], publicKey}).then(refetch)
+        onSubmit({name, allowedIp4: ip ?? defaultIp, publicKey}).then(refetch)
         setPublicKey("")
         setIp(null)
         setName("")
@@ -69,7 +69,7 @@ export default function CreateClient ({onSubmit}) {
         setPublicKey(publicKey)
     }
 
-    const currentConfig = wgConfig(name,ip ?? defaultIp,privateKey,config?.recommendedDNS,config?.endpoint,config?.publicKey)
+    const currentConfig = wgConfig(name,ip ?? defaultIp,privateKey,config?.recommendedDNS,config?.nextEndpoint ?? config?.endpoint,config?.nextPublicKey ?? config?.publicKey)
 
     return <>
         <FloatingButton onClick={() => setShowNewClient(true)} gradient="purple">
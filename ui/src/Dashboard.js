@@ -2,7 +2,7 @@ import ClientCard from "./ClientCard";
 import styled from "styled-components";
 import {useQuery} from "react-query";
 import CreateClient from "./CreateClient";
-import {MDBBtn, MDBCol, MDBModal, MDBModalBody, MDBModalFooter, MDBModalHeader, MDBRow} from "mdbreact";
+import {MDBBtn, MDBCol, MDBInput, MDBModal, MDBModalBody, MDBModalFooter, MDBModalHeader, MDBRow} from "mdbreact";
 import {useState} from "react";
 import {authFetch} from "./index";
 
@@ -15,8 +15,14 @@ const Grid = styled.div`
 `
 
 
+const pageSize = 50
+
 export default function Dashboard() {
-    const {data, isSuccess, refetch} = useQuery(`clients`)
+    const [name, setName] = useState("")
+    const [sort, setSort] = useState("name")
+    const [offset, setOffset] = useState(0)
+    const params = new URLSearchParams({limit: pageSize, offset, sort, ...(name ? {name} : {})})
+    const {data, isSuccess, refetch} = useQuery(`clients?${params}`, {keepPreviousData: true})
     const [remove, setRemove] = useState(null)
 
     const onSubmit = (newClient) => {
@@ -28,10 +34,43 @@ export default function Dashboard() {
         return authFetch(`clients/${client.id}`, {method: "DELETE"}).then(() => refetch())
     }
 
+    const onSearch = e => {
+        setName(e.target.value)
+        setOffset(0)
+    }
+
+    const onSort = e => {
+        setSort(e.target.value)
+        setOffset(0)
+    }
+
     return <>
+        <MDBRow className="mt-4">
+            <MDBCol md="6">
+                <MDBInput label="Search by name" value={name} onChange={onSearch}/>
+            </MDBCol>
+            <MDBCol md="3">
+                <select className="browser-default custom-select mt-4" value={sort} onChange={onSort}>
+                    <option value="name">Name</option>
+                    <option value="-created">Newest</option>
+                    <option value="-handshake">Latest handshake</option>
+                    <option value="-traffic">Most traffic</option>
+                </select>
+            </MDBCol>
+            <MDBCol md="3" className="mt-4">
+                {isSuccess && <span>{data.totals.online} of {data.totals.clients} online</span>}
+            </MDBCol>
+        </MDBRow>
         <Grid>
-            {isSuccess && data.map(client => <ClientCard onDelete={() => setRemove(client)} key={client.id} client={client}/>)}
+            {isSuccess && data.items.map(client => <ClientCard onDelete={() => setRemove(client)} key={client.id} client={client}/>)}
         </Grid>
+        {isSuccess && data.total > pageSize && <MDBRow className="mt-4">
+            <MDBCol>
+                <MDBBtn disabled={offset === 0} onClick={() => setOffset(Math.max(0, offset - pageSize))}>Previous</MDBBtn>
+                <span>{offset + 1}-{Math.min(offset + pageSize, data.total)} of {data.total}</span>
+                <MDBBtn disabled={offset + pageSize >= data.total} onClick={() => setOffset(offset + pageSize)}>Next</MDBBtn>
+            </MDBCol>
+        </MDBRow>}
         <RemoveClient onConfirm={() => onDelete(remove)} onClose={() => setRemove(null)} name={remove?.name} />
         <CreateClient onSubmit={onSubmit}/>
     </>
@@ -1,5 +1,6 @@
-import {useState} from "react";
+import {useEffect, useState} from "react";
 import {useNavigate} from "react-router-dom";
+import {useQuery} from "react-query";
 import {MDBBtn, MDBCard, MDBCardBody, MDBCardHeader, MDBIcon, MDBInput} from "mdbreact";
 import {authFetch} from "./index";
 
@@ -8,15 +9,50 @@ export default function Login () {
     const [password, setPassword] = useState("")
     const [error, setError] = useState(null)
     const nav = useNavigate()
+    const {data: methods} = useQuery(`auth-methods`)
+
+    const [mfaRequired, setMfaRequired] = useState(false)
+    const [mfaToken, setMfaToken] = useState(null)
+    const [code, setCode] = useState("")
+
+    // After single sign-on the session only exists as a refresh cookie, or the mfa token as a cookie
+    useEffect(() => {
+        const query = new URLSearchParams(window.location.search)
+        if (!query.has("sso"))
+            return
+        if (query.has("mfa")) {
+            setMfaRequired(true)
+            return
+        }
+
+        authFetch(`refresh`, {method: "POST"})
+            .then(({token}) => window.localStorage.setItem("jwt", token))
+            .then(() => nav("/dashboard"))
+            .catch(() => setError("Single sign-on failed"))
+    }, [nav])
 
     const onLogin = () => {
         authFetch(`authenticate`, {
             body: JSON.stringify({username,password}),
             method: "POST"
         })
+            .then(({token, mfaRequired, mfaToken}) => {
+                if (mfaRequired) {
+                    setMfaToken(mfaToken)
+                    setMfaRequired(true)
+                    return
+                }
+                window.localStorage.setItem("jwt", token)
+                nav("/dashboard")
+            })
+            .catch(err => setError("Unknown username and/or password"))
+    }
+
+    const onVerify = () => {
+        authFetch(`authenticate/totp`, {json: {mfaToken, code}, method: "POST"})
             .then(({token}) => window.localStorage.setItem("jwt", token))
             .then(() => nav("/dashboard"))
-            .catch(err => setError("Unknown username and/or password"))
+            .catch(err => setError("Invalid code"))
     }
 
     return <div style={{paddingTop:"2em"}}><MDBCard>
@@ -43,6 +79,14 @@ export default function Login () {
                 type="password"
                 required
             />
+            {mfaRequired && <MDBInput
+                label="Type your authenticator or recovery code"
+                onChange={e => setCode(e.target.value)}
+                value={code}
+                icon="key"
+                type="text"
+                required
+            />}
             {error && (
                 <div className="text-danger text-center mt-4">
                     {error}
@@ -51,9 +95,12 @@ export default function Login () {
 
 
             <div className="text-center mt-4">
-                <MDBBtn color="light-blue" className="mb-3" type="button" onClick={onLogin}>
+                {(methods?.localLogin !== false || mfaRequired) && <MDBBtn color="light-blue" className="mb-3" type="button" onClick={mfaRequired ? onVerify : onLogin}>
                     Login
-                </MDBBtn>
+                </MDBBtn>}
+                {methods?.sso && <MDBBtn color="indigo" className="mb-3" type="button" href={`${process.env.REACT_APP_API_SERVER}/oidc/login`}>
+                    Login with SSO
+                </MDBBtn>}
             </div>
         </MDBCardBody>
     </MDBCard></div>
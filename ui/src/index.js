@@ -7,7 +7,24 @@ import 'bootstrap-css-only/css/bootstrap.min.css';
 import 'mdbreact/dist/css/mdb.css';
 import "./wireguard"
 
-export const authFetch = async (url, {json, ...options} = {}) => {
+const refresh = async () => {
+    const response = await fetch(`${process.env.REACT_APP_API_SERVER}/refresh`, {method: "POST", credentials: "include"})
+    if (!response.ok)
+        return false
+
+    const {token} = await response.json()
+    window.localStorage.setItem("jwt", token)
+    return true
+}
+
+export const logout = async () => {
+    await fetch(`${process.env.REACT_APP_API_SERVER}/logout`, {method: "POST", credentials: "include"})
+    window.localStorage.removeItem("jwt")
+    window.location = "/"
+}
+
+export const authFetch = async (url, {json, retry = true, ...options} = {}) => {
+        const path = url
         url = `${process.env.REACT_APP_API_SERVER}/${url}`
 
     const {headers = {}, ...restOptions} = options
@@ -22,10 +39,20 @@ export const authFetch = async (url, {json, ...options} = {}) => {
 
     let response = await fetch(url, {headers, credentials: "include",...restOptions});
 
-    if (response.status === 403) {
+    if ((response.status === 401 || response.status === 403) && retry && path !== "authenticate") {
+        if (await refresh())
+            return authFetch(path, {json, retry: false, ...options})
+        window.location = "/"
+    } else if (response.status === 403) {
         window.location = "/"
     } else if (response.status >= 400) {
-        throw new Error(response.status)
+        const body = await response.json().catch(() => ({}))
+        const error = new Error(body.error?.message ?? response.status)
+        error.status = response.status
+        error.code = body.error?.code
+        error.fields = body.error?.fields ?? []
+        error.requestId = body.error?.requestId
+        throw error
     }
 
     let contentType = response.headers.get("Content-type") || "text/plain"
@@ -0,0 +1,302 @@
+package wireguard
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/database"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	BulkCreated = "created"
+	BulkValid   = "valid"
+	BulkInvalid = "invalid"
+)
+
+// BulkClient is one row of a bulk request, the ip and key are generated when empty
+type BulkClient struct {
+	Name      string     `json:"name"`
+	Ip        string     `json:"ip"`
+	PublicKey string     `json:"publicKey"`
+	Group     string     `json:"group"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type BulkRowResult struct {
+	Row        int    `json:"row"`
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	ClientID   uint   `json:"clientId,omitempty"`
+	AllowedIp4 string `json:"allowedIp4,omitempty"`
+	PublicKey  string `json:"publicKey,omitempty"`
+	// GeneratedKey is set when the server generated the key pair, the private key is only in the config
+	GeneratedKey bool   `json:"generatedKey"`
+	ConfigFile   string `json:"configFile,omitempty"`
+}
+
+type BulkResult struct {
+	Created bool            `json:"created"`
+	Rows    []BulkRowResult `json:"rows"`
+	// Configs is a zip with a wg-quick configuration per client
+	Configs []byte `json:"configs,omitempty"`
+}
+
+var unsafeFileName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// ParseBulk reads a JSON list or a CSV file with a header row: name, ip, publicKey, group, expiresAt
+func ParseBulk(r io.Reader) ([]BulkClient, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	trimmed := bytes.TrimSpace(content)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		var rows []BulkClient
+		if err = json.Unmarshal(trimmed, &rows); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %s", err)
+		}
+		return rows, nil
+	}
+
+	reader := csv.NewReader(bytes.NewReader(trimmed))
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %s", err)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("no clients in request")
+	}
+
+	columns := map[string]int{}
+	for i, column := range records[0] {
+		column = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(column), "_", ""))
+		columns[column] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, errors.New("the CSV header must have a name column, and optionally ip, publicKey, group and expiresAt")
+	}
+	field := func(record []string, column string) string {
+		if i, ok := columns[strings.ToLower(column)]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var rows []BulkClient
+	for line, record := range records[1:] {
+		row := BulkClient{
+			Name:      field(record, "name"),
+			Ip:        field(record, "ip"),
+			PublicKey: field(record, "publicKey"),
+			Group:     field(record, "group"),
+		}
+		if expiresAt := field(record, "expiresAt"); expiresAt != "" {
+			parsed, err := parseExpiry(expiresAt)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid expiresAt %s, use 2006-01-02 or RFC 3339", line+2, expiresAt)
+			}
+			row.ExpiresAt = &parsed
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func parseExpiry(value string) (time.Time, error) {
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// Provision validates every row and allocates ips in the network, and only creates the clients when all rows are
+// valid. The clients are created in one transaction and added to the device with a single change.
+func Provision(network *Network, rows []BulkClient, dryRun bool) (*BulkResult, error) {
+	_, subnet, err := net.ParseCIDR(network.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("no clients in request")
+	}
+
+	var existing []database.Client
+	if err = database.Connection.Find(&existing).Error; err != nil {
+		return nil, err
+	}
+	used := map[string]bool{serverAddress(subnet).String() + "/32": true}
+	for _, client := range existing {
+		used[client.PublicKey] = true
+		used[client.AllowedIp4] = true
+	}
+
+	result := &BulkResult{}
+	clients := make([]database.Client, len(rows))
+	privateKeys := make([]string, len(rows))
+	valid := true
+
+	// Requested ips are reserved first, so generated ips never take them
+	for i, row := range rows {
+		result.Rows = append(result.Rows, BulkRowResult{Row: i + 1, Name: row.Name, Status: BulkValid})
+		if row.Ip == "" {
+			continue
+		}
+		ip := row.Ip
+		if !strings.Contains(ip, "/") {
+			ip += "/32"
+		}
+		parsed, ipNet, err := net.ParseCIDR(ip)
+		if err != nil || parsed.To4() == nil || !subnet.Contains(parsed) || ipNet.String() != ip {
+			result.Rows[i].Status, result.Rows[i].Error = BulkInvalid, fmt.Sprintf("ip %s must be an address inside %s", row.Ip, network.Subnet)
+			continue
+		}
+		if used[ip] {
+			result.Rows[i].Status, result.Rows[i].Error = BulkInvalid, fmt.Sprintf("ip %s is already used", ip)
+			continue
+		}
+		used[ip] = true
+		clients[i].AllowedIp4 = ip
+	}
+
+	// Every client gets a config, with the next key during a server key rotation
+	serverKey, _ := network.ConfigKey()
+	next := serverAddress(subnet)
+	for i, row := range rows {
+		invalid := func(format string, args ...interface{}) {
+			result.Rows[i].Status, result.Rows[i].Error = BulkInvalid, fmt.Sprintf(format, args...)
+		}
+		if result.Rows[i].Status == BulkInvalid {
+			continue
+		}
+
+		if strings.TrimSpace(row.Name) == "" {
+			invalid("name is required")
+			continue
+		}
+		if row.ExpiresAt != nil && row.ExpiresAt.Before(time.Now()) {
+			invalid("expiresAt is in the past")
+			continue
+		}
+
+		publicKey := row.PublicKey
+		if publicKey == "" {
+			key, err := wgtypes.GeneratePrivateKey()
+			if err != nil {
+				return nil, err
+			}
+			privateKeys[i] = key.String()
+			publicKey = key.PublicKey().String()
+			result.Rows[i].GeneratedKey = true
+		} else if _, err := wgtypes.ParseKey(publicKey); err != nil {
+			invalid("invalid public key: %s", err)
+			continue
+		}
+		if used[publicKey] {
+			invalid("public key is already used")
+			continue
+		}
+		used[publicKey] = true
+
+		if clients[i].AllowedIp4 == "" {
+			inc(next)
+			for subnet.Contains(next) && used[next.String()+"/32"] {
+				inc(next)
+			}
+			if !subnet.Contains(next) || isBroadcast(next, subnet) {
+				invalid("no free ip left in %s", network.Subnet)
+				continue
+			}
+			clients[i].AllowedIp4 = next.String() + "/32"
+			used[clients[i].AllowedIp4] = true
+		}
+
+		clients[i].Name = strings.TrimSpace(row.Name)
+		clients[i].PublicKey = publicKey
+		clients[i].Group = row.Group
+		clients[i].ExpiresAt = row.ExpiresAt
+		clients[i].NetworkID = network.ID
+		clients[i].ServerKey = serverKey.String()
+		result.Rows[i].AllowedIp4 = clients[i].AllowedIp4
+		result.Rows[i].PublicKey = publicKey
+	}
+
+	for _, row := range result.Rows {
+		valid = valid && row.Status == BulkValid
+	}
+	if !valid || dryRun {
+		return result, nil
+	}
+
+	err = Change(func(tx *gorm.DB) ([]database.Client, error) {
+		if err := tx.Create(&clients).Error; err != nil {
+			return nil, err
+		}
+		return clients, nil
+	}, func(tx *gorm.DB) error {
+		// The device rejected the clients, they are deleted again
+		return tx.Unscoped().Delete(&clients).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create clients: %w", err)
+	}
+
+	archive := &bytes.Buffer{}
+	zipWriter := zip.NewWriter(archive)
+	names := map[string]int{}
+	for i := range clients {
+		name := unsafeFileName.ReplaceAllString(clients[i].Name, "_")
+		names[name]++
+		if names[name] > 1 {
+			name = fmt.Sprintf("%s-%d", name, names[name])
+		}
+		name += ".conf"
+
+		file, err := zipWriter.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = file.Write(RenderClientConf(network, &clients[i], privateKeys[i])); err != nil {
+			return nil, err
+		}
+
+		result.Rows[i].Status = BulkCreated
+		result.Rows[i].ClientID = clients[i].ID
+		result.Rows[i].ConfigFile = name
+	}
+	if err = zipWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	result.Created = true
+	result.Configs = archive.Bytes()
+	log.Printf("WG: Created %d clients", len(clients))
+	return result, nil
+}
+
+func isBroadcast(ip net.IP, subnet *net.IPNet) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	for i := range ip4 {
+		if ip4[i]|subnet.Mask[len(subnet.Mask)-4+i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,170 @@
+package wireguard
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ConfFile is a wg-quick configuration (wg0.conf) or the output of "wg showconf"
+type ConfFile struct {
+	Interface ConfInterface
+	Peers     []ConfPeer
+}
+
+type ConfInterface struct {
+	PrivateKey string
+	ListenPort int
+	Address    []string
+	Dns        []string
+}
+
+type ConfPeer struct {
+	// Name comes from the comment above the [Peer] section, or the first comment inside it
+	Name                string
+	PublicKey           string
+	PresharedKey        string
+	AllowedIPs          []string
+	Endpoint            string
+	PersistentKeepalive int
+	// Line is where the [Peer] section starts, for error messages
+	Line int
+}
+
+// ParseConf reads the [Interface] and [Peer] sections, unknown keys like PostUp are ignored
+func ParseConf(r io.Reader) (*ConfFile, error) {
+	conf := &ConfFile{}
+	scanner := bufio.NewScanner(r)
+
+	section := ""
+	comment := ""
+	var peer *ConfPeer
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			comment = commentName(line)
+			if peer != nil && peer.Name == "" && peer.PublicKey == "" && comment != "" {
+				peer.Name = comment
+			}
+			continue
+		}
+		if line == "" {
+			comment = ""
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.Trim(line, "[] "))
+			switch section {
+			case "interface":
+				peer = nil
+			case "peer":
+				conf.Peers = append(conf.Peers, ConfPeer{Name: comment, Line: number})
+				peer = &conf.Peers[len(conf.Peers)-1]
+			default:
+				return nil, fmt.Errorf("line %d: unknown section %s", number, line)
+			}
+			comment = ""
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected key = value", number)
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+		if i := strings.Index(value, "#"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+
+		var err error
+		switch section {
+		case "interface":
+			err = conf.Interface.set(key, value)
+		case "peer":
+			err = peer.set(key, value)
+		default:
+			err = fmt.Errorf("%s outside of a section", parts[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", number, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, p := range conf.Peers {
+		if p.PublicKey == "" {
+			return nil, fmt.Errorf("line %d: peer without PublicKey", p.Line)
+		}
+	}
+	return conf, nil
+}
+
+func (i *ConfInterface) set(key string, value string) error {
+	switch key {
+	case "privatekey":
+		i.PrivateKey = value
+	case "listenport":
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid ListenPort %s", value)
+		}
+		i.ListenPort = port
+	case "address":
+		i.Address = append(i.Address, splitList(value)...)
+	case "dns":
+		i.Dns = append(i.Dns, splitList(value)...)
+	}
+	return nil
+}
+
+func (p *ConfPeer) set(key string, value string) error {
+	switch key {
+	case "publickey":
+		p.PublicKey = value
+	case "presharedkey":
+		p.PresharedKey = value
+	case "allowedips":
+		p.AllowedIPs = append(p.AllowedIPs, splitList(value)...)
+	case "endpoint":
+		p.Endpoint = value
+	case "persistentkeepalive":
+		if value == "off" {
+			return nil
+		}
+		keepalive, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid PersistentKeepalive %s", value)
+		}
+		p.PersistentKeepalive = keepalive
+	}
+	return nil
+}
+
+// commentName turns "# Name = alice", "### alice ###" or "# alice" into alice
+func commentName(line string) string {
+	name := strings.Trim(line, "#; \t")
+	lower := strings.ToLower(name)
+	for _, prefix := range []string{"name =", "name=", "name:", "friendlyname =", "friendlyname=", "client:", "peer:"} {
+		if strings.HasPrefix(lower, prefix) {
+			return strings.TrimSpace(name[len(prefix):])
+		}
+	}
+	return name
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,108 @@
+package wireguard
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/database"
+	"net"
+	"strings"
+)
+
+const (
+	FormatWgQuick = "wg-quick"
+	FormatSetconf = "setconf"
+)
+
+// serverAddress is the first address of the client subnet, it is never given to a client
+func serverAddress(subnet *net.IPNet) net.IP {
+	ip := make(net.IP, len(subnet.IP))
+	copy(ip, subnet.IP.Mask(subnet.Mask))
+	inc(ip)
+	return ip
+}
+
+func inc(ip net.IP) {
+	for j := len(ip) - 1; j >= 0; j-- {
+		ip[j]++
+		if ip[j] > 0 {
+			break
+		}
+	}
+}
+
+// RenderConf writes the server and every client of a network as a wg-quick configuration, or for "wg setconf" which
+// does not support Address. The plain WireGuard tools can take over with it when this server is down.
+func RenderConf(network *Network, format string) ([]byte, error) {
+	if format != FormatWgQuick && format != FormatSetconf {
+		return nil, fmt.Errorf("unknown format %s, use %s or %s", format, FormatWgQuick, FormatSetconf)
+	}
+
+	_, subnet, err := net.ParseCIDR(network.Subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	var clients []database.Client
+	if err = database.Connection.Where("network_id = ?", network.ID).Order("id").Find(&clients).Error; err != nil {
+		return nil, err
+	}
+
+	out := &bytes.Buffer{}
+	ones, _ := subnet.Mask.Size()
+	fmt.Fprintf(out, "# %s, public key %s\n", network.DeviceName, network.PublicKey)
+	fmt.Fprintln(out, "[Interface]")
+	if format == FormatWgQuick {
+		fmt.Fprintf(out, "Address = %s/%d\n", serverAddress(subnet), ones)
+	}
+	fmt.Fprintf(out, "ListenPort = %d\n", network.ListenPort)
+	fmt.Fprintf(out, "PrivateKey = %s\n", network.privateKey)
+
+	for _, client := range clients {
+		fmt.Fprintln(out)
+		fmt.Fprintf(out, "# %s\n", strings.ReplaceAll(client.Name, "\n", " "))
+		fmt.Fprintln(out, "[Peer]")
+		fmt.Fprintf(out, "PublicKey = %s\n", client.PublicKey)
+		if client.PresharedKey != "" {
+			fmt.Fprintf(out, "PresharedKey = %s\n", client.PresharedKey)
+		}
+
+		var allowedIps []string
+		for _, ipNet := range getAllowedIpNets(&client) {
+			allowedIps = append(allowedIps, ipNet.String())
+		}
+		fmt.Fprintf(out, "AllowedIPs = %s\n", strings.Join(allowedIps, ", "))
+		if client.PersistentKeepalive > 0 {
+			fmt.Fprintf(out, "PersistentKeepalive = %d\n", client.PersistentKeepalive)
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+// RenderClientConf is the wg-quick configuration for a client, like the one shown in the UI. Without a private key
+// the line has to be filled in by the owner of the key. During a server key rotation it has the next key.
+func RenderClientConf(network *Network, client *database.Client, privateKey string) []byte {
+	if privateKey == "" {
+		privateKey = "<private key for " + client.PublicKey + ">"
+	}
+	serverKey, _ := network.ConfigKey()
+	endpoint := network.ConfigEndpoint()
+
+	out := &bytes.Buffer{}
+	fmt.Fprintln(out, "[Interface]")
+	fmt.Fprintf(out, "# Name = %s\n", strings.ReplaceAll(client.Name, "\n", " "))
+	fmt.Fprintf(out, "Address = %s\n", client.AllowedIp4)
+	fmt.Fprintf(out, "PrivateKey = %s\n", privateKey)
+	fmt.Fprintf(out, "DNS = %s\n", network.Dns)
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "[Peer]")
+	fmt.Fprintf(out, "# Name = %s\n", endpoint)
+	fmt.Fprintf(out, "Endpoint = %s\n", endpoint)
+	fmt.Fprintf(out, "PublicKey = %s\n", serverKey)
+	if client.PresharedKey != "" {
+		fmt.Fprintf(out, "PresharedKey = %s\n", client.PresharedKey)
+	}
+	fmt.Fprintln(out, "AllowedIPs = 0.0.0.0/0, ::/0")
+	fmt.Fprintln(out, "PersistentKeepalive = 25")
+	return out.Bytes()
+}
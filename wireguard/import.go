@@ -0,0 +1,191 @@
+package wireguard
+
+import (
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/config"
+	"github.com/Richard87/wg-vpn-server/database"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+type ImportOptions struct {
+	// AdoptPrivateKey replaces the server private key with the one from [Interface], existing clients stop working
+	AdoptPrivateKey bool `json:"adoptPrivateKey"`
+	// DryRun only reports what would be imported
+	DryRun bool `json:"dryRun"`
+}
+
+type ImportedPeer struct {
+	Name       string `json:"name"`
+	PublicKey  string `json:"publicKey"`
+	AllowedIp4 string `json:"allowedIp4"`
+	AllowedIps string `json:"allowedIps"`
+}
+
+type ImportConflict struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"publicKey"`
+	Line      int    `json:"line"`
+	Reason    string `json:"reason"`
+}
+
+type ImportResult struct {
+	Imported          []ImportedPeer   `json:"imported"`
+	Conflicts         []ImportConflict `json:"conflicts"`
+	AdoptedPrivateKey bool             `json:"adoptedPrivateKey"`
+	DryRun            bool             `json:"dryRun"`
+}
+
+// Import creates a client for every peer in conf. Peers that clash with existing clients, or with each other, are
+// reported as conflicts and skipped, the other peers are created in one change. An adopted private key still has to be
+// applied with Sync.
+func Import(conf *ConfFile, options ImportOptions) (*ImportResult, error) {
+	_, subnet, err := net.ParseCIDR(config.Config.ClientsSubnet)
+	if err != nil {
+		return nil, err
+	}
+
+	gateway := serverAddress(subnet).String() + "/32"
+
+	var privateKey wgtypes.Key
+	if options.AdoptPrivateKey {
+		if conf.Interface.PrivateKey == "" {
+			return nil, fmt.Errorf("the configuration has no [Interface] PrivateKey to adopt")
+		}
+		if privateKey, err = wgtypes.ParseKey(conf.Interface.PrivateKey); err != nil {
+			return nil, fmt.Errorf("invalid [Interface] PrivateKey: %s", err)
+		}
+	}
+
+	var existing []database.Client
+	if err = database.Connection.Find(&existing).Error; err != nil {
+		return nil, err
+	}
+	used := map[string]string{}
+	for _, client := range existing {
+		used[client.PublicKey] = client.Name
+		used[client.AllowedIp4] = client.Name
+	}
+
+	result := &ImportResult{Imported: []ImportedPeer{}, Conflicts: []ImportConflict{}, DryRun: options.DryRun}
+	var clients []database.Client
+	for i, peer := range conf.Peers {
+		name := peer.Name
+		if name == "" {
+			name = fmt.Sprintf("imported-%d", i+1)
+		}
+		conflict := func(format string, args ...interface{}) {
+			result.Conflicts = append(result.Conflicts, ImportConflict{
+				Name:      name,
+				PublicKey: peer.PublicKey,
+				Line:      peer.Line,
+				Reason:    fmt.Sprintf(format, args...),
+			})
+		}
+
+		if _, err := wgtypes.ParseKey(peer.PublicKey); err != nil {
+			conflict("invalid public key: %s", err)
+			continue
+		}
+		if peer.PresharedKey != "" {
+			if _, err := wgtypes.ParseKey(peer.PresharedKey); err != nil {
+				conflict("invalid preshared key: %s", err)
+				continue
+			}
+		}
+
+		// The first /32 inside -client-subnet is the client address, everything else is routed to it as well
+		allowedIp4 := ""
+		var extra []string
+		invalid := ""
+		for _, cidr := range peer.AllowedIPs {
+			ip, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				invalid = cidr
+				break
+			}
+			ones, bits := network.Mask.Size()
+			if allowedIp4 == "" && ip.To4() != nil && ones == 32 && bits == 32 && subnet.Contains(ip) {
+				allowedIp4 = network.String()
+				continue
+			}
+			extra = append(extra, network.String())
+		}
+		if invalid != "" {
+			conflict("invalid AllowedIPs %s", invalid)
+			continue
+		}
+		if allowedIp4 == "" {
+			conflict("no /32 address inside client-subnet %s in AllowedIPs", config.Config.ClientsSubnet)
+			continue
+		}
+
+		if allowedIp4 == gateway {
+			conflict("%s is reserved for the server", allowedIp4)
+			continue
+		}
+		if owner, ok := used[peer.PublicKey]; ok {
+			conflict("public key is already used by %s", owner)
+			continue
+		}
+		if owner, ok := used[allowedIp4]; ok {
+			conflict("%s is already used by %s", allowedIp4, owner)
+			continue
+		}
+		used[peer.PublicKey] = name
+		used[allowedIp4] = name
+
+		client := database.Client{
+			Name:                name,
+			AllowedIp4:          allowedIp4,
+			PublicKey:           peer.PublicKey,
+			PresharedKey:        peer.PresharedKey,
+			PersistentKeepalive: peer.PersistentKeepalive,
+			AllowedIps:          strings.Join(extra, ","),
+		}
+		clients = append(clients, client)
+		result.Imported = append(result.Imported, ImportedPeer{
+			Name:       client.Name,
+			PublicKey:  client.PublicKey,
+			AllowedIp4: client.AllowedIp4,
+			AllowedIps: client.AllowedIps,
+		})
+	}
+
+	if options.DryRun {
+		result.AdoptedPrivateKey = options.AdoptPrivateKey
+		return result, nil
+	}
+
+	if len(clients) > 0 {
+		err = Change(func(tx *gorm.DB) ([]database.Client, error) {
+			if err := tx.Create(&clients).Error; err != nil {
+				return nil, err
+			}
+			return clients, nil
+		}, func(tx *gorm.DB) error {
+			// The device rejected the clients, they are deleted again
+			return tx.Unscoped().Delete(&clients).Error
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not create clients: %w", err)
+		}
+	}
+
+	if options.AdoptPrivateKey {
+		if err = os.WriteFile(config.Config.WgKey, []byte(privateKey.String()), 0600); err != nil {
+			return nil, fmt.Errorf("could not save private key: %s", err)
+		}
+		config.Config.WgPrivateKey = privateKey
+		config.Config.WgPublicKey = privateKey.PublicKey()
+		result.AdoptedPrivateKey = true
+		log.Printf("WG: Adopted the imported private key, public key is now %s", config.Config.WgPublicKey)
+	}
+
+	log.Printf("WG: Imported %d clients, %d conflicts", len(result.Imported), len(result.Conflicts))
+	return result, nil
+}
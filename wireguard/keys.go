@@ -0,0 +1,126 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/database"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+	"log"
+	"time"
+)
+
+var (
+	ErrInvalidKey = errors.New("public key must be a base64 encoded WireGuard key")
+	ErrKeyUsed    = errors.New("public key is already used by a client")
+)
+
+// RotateClientKey replaces the key of a client, the ip, id and every other setting are kept. A key pair is generated
+// when publicKey is empty, the private key is returned so it can go in the config. Clients that were disabled
+// because their key was too old are enabled again.
+func RotateClientKey(client *database.Client, publicKey string) (string, error) {
+	privateKey := ""
+	if publicKey == "" {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return "", fmt.Errorf("could not generate key: %s", err)
+		}
+		privateKey = key.String()
+		publicKey = key.PublicKey().String()
+	} else if _, err := wgtypes.ParseKey(publicKey); err != nil {
+		return "", ErrInvalidKey
+	}
+
+	var used int64
+	if err := database.Connection.Model(&database.Client{}).Where("public_key = ?", publicKey).Count(&used).Error; err != nil {
+		return "", err
+	}
+	if used > 0 {
+		return "", ErrKeyUsed
+	}
+
+	network, err := ClientNetwork(client)
+	if err != nil {
+		return "", err
+	}
+
+	// The outbox entry has the old key, so its peer is removed when the new one is added
+	old := *client
+	serverKey, _ := network.ConfigKey()
+	updates := map[string]interface{}{
+		"public_key":     publicKey,
+		"key_created_at": time.Now(),
+		"server_key":     serverKey.String(),
+	}
+	if client.Disabled && client.DisabledReason == database.DisabledKeyAge {
+		updates["disabled"] = false
+		updates["disabled_reason"] = ""
+	}
+	err = Change(func(tx *gorm.DB) ([]database.Client, error) {
+		return []database.Client{old}, tx.Model(client).Updates(updates).Error
+	}, func(tx *gorm.DB) error {
+		return tx.Model(client).Updates(map[string]interface{}{
+			"public_key":      old.PublicKey,
+			"key_created_at":  old.KeyCreatedAt,
+			"server_key":      old.ServerKey,
+			"disabled":        old.Disabled,
+			"disabled_reason": old.DisabledReason,
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("WG: Rotated the key of client %s", client.Name)
+	return privateKey, nil
+}
+
+// DisableExpiredKeys disables the active clients whose key is older than -client-key-max-age allows
+func DisableExpiredKeys() error {
+	var clients []database.Client
+	if err := database.Connection.Where("disabled = ?", false).Find(&clients).Error; err != nil {
+		return err
+	}
+
+	var expired []database.Client
+	var ids []uint
+	for _, client := range clients {
+		if client.KeyExpired() {
+			expired = append(expired, client)
+			ids = append(ids, client.ID)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	err := Change(func(tx *gorm.DB) ([]database.Client, error) {
+		return expired, tx.Model(&database.Client{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+			"disabled":        true,
+			"disabled_reason": database.DisabledKeyAge,
+		}).Error
+	}, func(tx *gorm.DB) error {
+		return tx.Model(&database.Client{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+			"disabled":        false,
+			"disabled_reason": "",
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, client := range expired {
+		log.Printf("WG: Disabled client %s, its key is from %s", client.Name, client.KeyCreatedAt.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// disableExpiredKeys enforces the maximum key age, the first time when the server starts
+func disableExpiredKeys() {
+	tick := time.Tick(time.Minute)
+	for ; true; <-tick {
+		if err := DisableExpiredKeys(); err != nil {
+			log.Printf("WG: Could not disable clients with expired keys: %s", err)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/config"
+	"github.com/Richard87/wg-vpn-server/database"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultNetwork is the name of the network configured with the -wg-* and -client-subnet options
+const DefaultNetwork = "default"
+
+var (
+	ErrNetworkNotFound = errors.New("network not found")
+	ErrNetworkNotEmpty = errors.New("the network still has clients")
+)
+
+// Network is a WireGuard device with its own key pair, listen port and subnet. The default network has ID 0, the
+// others are stored in the database.
+type Network struct {
+	ID         uint   `json:"id"`
+	Name       string `json:"name"`
+	Default    bool   `json:"default"`
+	DeviceName string `json:"deviceName"`
+	ListenPort int    `json:"listenPort"`
+	Subnet     string `json:"subnet"`
+	// Endpoint is the public host, without the port
+	Endpoint   string `json:"endpoint"`
+	Dns        string `json:"dns"`
+	PublicKey  string `json:"publicKey"`
+	privateKey wgtypes.Key
+	// nextKey is the key a rotation switches to, nil when no rotation is in progress
+	nextKey           *wgtypes.Key
+	rotationStartedAt time.Time
+}
+
+// NewNetwork are the settings of a network to create, the key pair is generated
+type NewNetwork struct {
+	Name       string `json:"name"`
+	DeviceName string `json:"deviceName"`
+	ListenPort int    `json:"listenPort"`
+	Subnet     string `json:"subnet"`
+	Endpoint   string `json:"endpoint"`
+	Dns        string `json:"dns"`
+}
+
+// networkDevices are the embedded devices of the networks in the database, by network id
+var networkDevices = struct {
+	sync.Mutex
+	devices map[uint]embedded
+}{devices: map[uint]embedded{}}
+
+type embedded struct {
+	device *device.Device
+	uapi   net.Listener
+}
+
+func defaultNetwork() *Network {
+	rotation.Lock()
+	next, startedAt := rotation.next, rotation.startedAt
+	rotation.Unlock()
+
+	live := config.Current()
+	return &Network{
+		Name:       DefaultNetwork,
+		Default:    true,
+		DeviceName: config.Config.WgDeviceName,
+		ListenPort: live.WgListenPort,
+		Subnet:     config.Config.ClientsSubnet,
+		Endpoint:   live.WgEndpoint,
+		Dns:        live.WgRecommendedDns,
+		PublicKey:  config.Config.WgPublicKey.String(),
+		privateKey: config.Config.WgPrivateKey,
+
+		nextKey:           next,
+		rotationStartedAt: startedAt,
+	}
+}
+
+func newNetwork(network *database.Network) (*Network, error) {
+	key, err := wgtypes.ParseKey(network.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("network %s has an invalid private key: %s", network.Name, err)
+	}
+	var next *wgtypes.Key
+	var startedAt time.Time
+	if network.NextPrivateKey != "" {
+		key, err := wgtypes.ParseKey(network.NextPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("network %s has an invalid next private key: %s", network.Name, err)
+		}
+		next = &key
+	}
+	if network.RotationStartedAt != nil {
+		startedAt = *network.RotationStartedAt
+	}
+	return &Network{
+		ID:         network.ID,
+		Name:       network.Name,
+		DeviceName: network.DeviceName,
+		ListenPort: network.ListenPort,
+		Subnet:     network.Subnet,
+		Endpoint:   network.Endpoint,
+		Dns:        network.Dns,
+		PublicKey:  key.PublicKey().String(),
+		privateKey: key,
+
+		nextKey:           next,
+		rotationStartedAt: startedAt,
+	}, nil
+}
+
+// GetNetworks lists the default network first, then the networks in the database
+func GetNetworks() ([]Network, error) {
+	var stored []database.Network
+	if err := database.Connection.Order("id").Find(&stored).Error; err != nil {
+		return nil, err
+	}
+
+	networks := []Network{*defaultNetwork()}
+	for i := range stored {
+		network, err := newNetwork(&stored[i])
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, *network)
+	}
+	return networks, nil
+}
+
+// GetNetwork finds a network by name
+func GetNetwork(name string) (*Network, error) {
+	if name == DefaultNetwork {
+		return defaultNetwork(), nil
+	}
+	stored := database.Network{}
+	if err := database.Connection.Where("name = ?", name).Limit(1).Find(&stored).Error; err != nil {
+		return nil, err
+	}
+	if stored.ID == 0 {
+		return nil, ErrNetworkNotFound
+	}
+	return newNetwork(&stored)
+}
+
+// ClientNetwork is the network the client belongs to
+func ClientNetwork(client *database.Client) (*Network, error) {
+	return networkByID(client.NetworkID)
+}
+
+func networkByID(id uint) (*Network, error) {
+	if id == 0 {
+		return defaultNetwork(), nil
+	}
+	stored := database.Network{}
+	if err := database.Connection.Limit(1).Find(&stored, id).Error; err != nil {
+		return nil, err
+	}
+	if stored.ID == 0 {
+		return nil, ErrNetworkNotFound
+	}
+	return newNetwork(&stored)
+}
+
+// NextPublicKey is the key the network rotates to, nil when no rotation is in progress
+func (n *Network) NextPublicKey() *wgtypes.Key {
+	if n.nextKey == nil {
+		return nil
+	}
+	key := n.nextKey.PublicKey()
+	return &key
+}
+
+// ConfigKey is the server key and port for client configs, the next key during a rotation
+func (n *Network) ConfigKey() (wgtypes.Key, int) {
+	if next := n.NextPublicKey(); next != nil {
+		return *next, n.ListenPort
+	}
+	return n.privateKey.PublicKey(), n.ListenPort
+}
+
+// ConfigEndpoint is the endpoint for client configs
+func (n *Network) ConfigEndpoint() string {
+	_, port := n.ConfigKey()
+	return n.Endpoint + ":" + strconv.Itoa(port)
+}
+
+// CreateNetwork stores a network with a new key pair, and starts its device when the server is running.
+// The settings are validated by the caller.
+func CreateNetwork(settings NewNetwork) (*Network, error) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate key: %s", err)
+	}
+	stored := database.Network{
+		Name:       settings.Name,
+		DeviceName: settings.DeviceName,
+		ListenPort: settings.ListenPort,
+		Subnet:     settings.Subnet,
+		Endpoint:   settings.Endpoint,
+		Dns:        settings.Dns,
+		PrivateKey: key.String(),
+		PublicKey:  key.PublicKey().String(),
+	}
+	if err = database.Connection.Create(&stored).Error; err != nil {
+		return nil, err
+	}
+	network, err := newNetwork(&stored)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Config.WgClient != nil {
+		if err = startNetwork(config.Config.WgClient, network); err != nil {
+			stopNetwork(network.ID)
+			if deleteErr := database.Connection.Unscoped().Delete(&stored).Error; deleteErr != nil {
+				log.Printf("WG: Could not remove network %s after its device failed: %s", network.Name, deleteErr)
+			}
+			return nil, &DeviceError{err: err}
+		}
+	}
+
+	log.Printf("WG: Created network %s on %s, port %d", network.Name, network.DeviceName, network.ListenPort)
+	return network, nil
+}
+
+// DeleteNetwork stops the device of an empty network and removes it, the default network can not be deleted
+func DeleteNetwork(network *Network) error {
+	if network.Default {
+		return errors.New("the default network can not be deleted")
+	}
+	var clients int64
+	if err := database.Connection.Model(&database.Client{}).Where("network_id = ?", network.ID).Count(&clients).Error; err != nil {
+		return err
+	}
+	if clients > 0 {
+		return fmt.Errorf("%w: %d clients", ErrNetworkNotEmpty, clients)
+	}
+
+	if err := database.Connection.Unscoped().Delete(&database.Network{}, network.ID).Error; err != nil {
+		return err
+	}
+	stopNetwork(network.ID)
+
+	log.Printf("WG: Deleted network %s", network.Name)
+	return nil
+}
+
+// startNetworks starts the device of every network in the database, next to the default device
+func startNetworks(wgClient *wgctrl.Client) {
+	networks, err := GetNetworks()
+	if err != nil {
+		log.Printf("WG: Could not read networks: %s", err)
+		return
+	}
+	for i := range networks[1:] {
+		network := &networks[i+1]
+		if err = startNetwork(wgClient, network); err != nil {
+			log.Printf("WG: Could not start network %s: %s", network.Name, err)
+			continue
+		}
+		log.Printf("WG: Network %s is listening on port %d (%s)", network.Name, network.ListenPort, network.DeviceName)
+	}
+}
+
+// startNetwork creates the device of a network unless it exists, and configures its address, key and peers
+func startNetwork(wgClient *wgctrl.Client, network *Network) error {
+	if _, err := wgClient.Device(network.DeviceName); err != nil {
+		wgDevice, uapi, err := embeddedDevice(network.DeviceName)
+		if err != nil {
+			return err
+		}
+		networkDevices.Lock()
+		networkDevices.devices[network.ID] = embedded{device: wgDevice, uapi: uapi}
+		networkDevices.Unlock()
+	}
+	if err := addInterfaceAddress(network.DeviceName, network.Subnet); err != nil {
+		return err
+	}
+	return configureNetwork(wgClient, network)
+}
+
+// configureNetwork replaces the key, port and every peer of the device of a network in the database
+func configureNetwork(wgClient *wgctrl.Client, network *Network) error {
+	peers, err := activePeers(network.ID)
+	if err != nil {
+		return err
+	}
+	cfg := wgtypes.Config{
+		PrivateKey:   &network.privateKey,
+		ListenPort:   &network.ListenPort,
+		ReplacePeers: true,
+		Peers:        peers,
+	}
+	if err = wgClient.ConfigureDevice(network.DeviceName, cfg); err != nil {
+		return fmt.Errorf("could not configure device %s: %s", network.DeviceName, err)
+	}
+	return nil
+}
+
+// configureRunningNetwork configures the device of a network when it is up, it picks up the settings on start otherwise
+func configureRunningNetwork(network *Network) error {
+	wgClient, done, err := controller()
+	if errors.Is(err, ErrDeviceNotRunning) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if _, err = wgClient.Device(network.DeviceName); err != nil {
+		return nil
+	}
+	return configureNetwork(wgClient, network)
+}
+
+// stopNetwork closes the device of a network, when this process created it
+func stopNetwork(id uint) {
+	networkDevices.Lock()
+	defer networkDevices.Unlock()
+	running, ok := networkDevices.devices[id]
+	if !ok {
+		return
+	}
+	_ = running.uapi.Close()
+	running.device.Close()
+	delete(networkDevices.devices, id)
+}
+
+func stopNetworks() {
+	networkDevices.Lock()
+	ids := make([]uint, 0, len(networkDevices.devices))
+	for id := range networkDevices.devices {
+		ids = append(ids, id)
+	}
+	networkDevices.Unlock()
+	for _, id := range ids {
+		stopNetwork(id)
+	}
+}
@@ -0,0 +1,232 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/database"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+	"log"
+	"time"
+)
+
+// DeviceError is returned by Change when the device rejected the change, the database change was undone
+type DeviceError struct {
+	err error
+}
+
+func (e *DeviceError) Error() string {
+	return e.err.Error()
+}
+
+func (e *DeviceError) Unwrap() error {
+	return e.err
+}
+
+// Change runs change in a transaction, together with an outbox entry for every client it returns. After the commit
+// the peers of those clients are made to match the database. When the device fails, undo compensates the change in a
+// new transaction. Entries that are left behind by a crash are applied by ProcessOutbox.
+func Change(change func(tx *gorm.DB) ([]database.Client, error), undo func(tx *gorm.DB) error) error {
+	var entries []database.OutboxEntry
+	err := database.Connection.Transaction(func(tx *gorm.DB) error {
+		clients, err := change(tx)
+		if err != nil {
+			return err
+		}
+		for i := range clients {
+			entries = append(entries, database.NewOutboxEntry(&clients[i]))
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		return tx.Create(&entries).Error
+	})
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	err = applyOutbox(entries)
+	if errors.Is(err, ErrDeviceNotRunning) {
+		// The device is configured from the database when it starts
+		log.Printf("WG: %s, the change is applied on the next start", err)
+	} else if err != nil {
+		undoErr := database.Connection.Transaction(func(tx *gorm.DB) error {
+			if err := undo(tx); err != nil {
+				return err
+			}
+			return tx.Unscoped().Delete(&entries).Error
+		})
+		if undoErr != nil {
+			log.Printf("WG: Could not undo a change the device rejected, it is retried from the outbox: %s", undoErr)
+		}
+		return &DeviceError{err: err}
+	}
+
+	if err = clearOutbox(entries); err != nil {
+		log.Printf("WG: Could not clear the outbox, it is applied again: %s", err)
+	}
+	return nil
+}
+
+// clearOutbox deletes applied entries. The device has the current peer of their clients, so older entries for the same
+// keys are done as well, including the ones ProcessOutbox gave up on.
+func clearOutbox(entries []database.OutboxEntry) error {
+	return database.Connection.Transaction(func(tx *gorm.DB) error {
+		for _, entry := range entries {
+			err := tx.Unscoped().Where("id = ? OR (client_id = ? AND public_key = ?)", entry.ID, entry.ClientID, entry.PublicKey).Delete(&database.OutboxEntry{}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// outboxMaxAttempts is how often ProcessOutbox applies an entry before giving up on it, failed entries are reported
+// in the status until the client changes again or the server restarts
+const outboxMaxAttempts = 10
+
+// ProcessOutbox applies the changes that were interrupted, the device is made to match the database. Every entry is
+// applied on its own, so one entry the device rejects does not hold up the others.
+func ProcessOutbox() error {
+	var entries []database.OutboxEntry
+	if err := database.Connection.Where("attempts < ?", outboxMaxAttempts).Order("id").Find(&entries).Error; err != nil {
+		return err
+	}
+
+	applied := 0
+	var failed error
+	cleared := map[string]bool{}
+	for _, entry := range entries {
+		key := fmt.Sprintf("%d/%s", entry.ClientID, entry.PublicKey)
+		if cleared[key] {
+			continue
+		}
+
+		err := applyOutbox([]database.OutboxEntry{entry})
+		if errors.Is(err, ErrDeviceNotRunning) {
+			return err
+		}
+		if err != nil {
+			failed = err
+			entry.Attempts++
+			if entry.Attempts >= outboxMaxAttempts {
+				log.Printf("WG: Giving up on the change of client %d after %d attempts: %s", entry.ClientID, entry.Attempts, err)
+			}
+			updateErr := database.Connection.Model(&entry).Updates(map[string]interface{}{
+				"attempts":   entry.Attempts,
+				"last_error": err.Error(),
+			}).Error
+			if updateErr != nil {
+				log.Printf("WG: Could not update outbox entry %d: %s", entry.ID, updateErr)
+			}
+			continue
+		}
+		if err = clearOutbox([]database.OutboxEntry{entry}); err != nil {
+			return err
+		}
+		cleared[key] = true
+		applied++
+	}
+
+	if applied > 0 {
+		log.Printf("WG: Applied %d pending changes from the outbox", applied)
+	}
+	return failed
+}
+
+// retryFailedChanges gives entries that ProcessOutbox gave up on another round of attempts
+func retryFailedChanges() error {
+	return database.Connection.Model(&database.OutboxEntry{}).Where("attempts >= ?", outboxMaxAttempts).Update("attempts", 0).Error
+}
+
+// FailedChange is an outbox entry that ProcessOutbox gave up on, the peer of the client may differ from the database
+type FailedChange struct {
+	ClientID  uint      `json:"clientId"`
+	PublicKey string    `json:"publicKey"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"lastError"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// failedChanges lists the entries of a network that ProcessOutbox gave up on
+func failedChanges(networkID uint) ([]FailedChange, error) {
+	var entries []database.OutboxEntry
+	err := database.Connection.Where("network_id = ? AND attempts >= ?", networkID, outboxMaxAttempts).Order("id").Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []FailedChange{}
+	for _, entry := range entries {
+		changes = append(changes, FailedChange{
+			ClientID:  entry.ClientID,
+			PublicKey: entry.PublicKey,
+			Attempts:  entry.Attempts,
+			LastError: entry.LastError,
+			UpdatedAt: entry.UpdatedAt,
+		})
+	}
+	return changes, nil
+}
+
+// processOutbox retries pending changes, for example from a command that stopped halfway
+func processOutbox() {
+	for range time.Tick(time.Minute) {
+		if err := ProcessOutbox(); err != nil && !errors.Is(err, ErrDeviceNotRunning) {
+			log.Printf("WG: Could not apply the outbox: %s", err)
+		}
+	}
+}
+
+// applyOutbox adds or updates the peers of active clients, and removes the peers of every other entry.
+// The state is read from the database, so applying an entry twice does no harm.
+func applyOutbox(entries []database.OutboxEntry) error {
+	wgClient, done, err := controller()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	// Every network has its own device, clients never move between networks
+	configs := map[uint]*wgtypes.Config{}
+	for _, entry := range entries {
+		client := database.Client{}
+		if err := database.Connection.Limit(1).Find(&client, entry.ClientID).Error; err != nil {
+			return err
+		}
+		cfg, ok := configs[entry.NetworkID]
+		if !ok {
+			cfg = &wgtypes.Config{Peers: []wgtypes.PeerConfig{}}
+			configs[entry.NetworkID] = cfg
+		}
+
+		if client.ID == 0 || !client.Active() || client.PublicKey != entry.PublicKey {
+			if key, err := wgtypes.ParseKey(entry.PublicKey); err == nil {
+				cfg.Peers = append(cfg.Peers, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+			}
+		}
+		if client.ID != 0 && client.Active() {
+			peer, err := peerConfig(&client)
+			if err != nil {
+				return fmt.Errorf("client %s: %s", client.Name, err)
+			}
+			cfg.Peers = append(cfg.Peers, peer)
+		}
+	}
+
+	for networkID, cfg := range configs {
+		network, err := networkByID(networkID)
+		if errors.Is(err, ErrNetworkNotFound) {
+			// The device was stopped with the network
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = wgClient.ConfigureDevice(network.DeviceName, *cfg); err != nil {
+			return fmt.Errorf("could not configure device %s: %s", network.DeviceName, err)
+		}
+	}
+	return nil
+}
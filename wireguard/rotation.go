@@ -0,0 +1,277 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Richard87/wg-vpn-server/config"
+	"github.com/Richard87/wg-vpn-server/database"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoRotation         = errors.New("no server key rotation in progress")
+	ErrRotationInProgress = errors.New("a server key rotation is already in progress")
+	ErrClientsPending     = errors.New("not every client got a config with the new key")
+)
+
+// Rotation is the state of a server key rotation. The new key is used for client configs from the start,
+// the device switches to it on the cutover. Configs keep the listen port, so updated clients connect after the cutover.
+type Rotation struct {
+	Network       string     `json:"network"`
+	InProgress    bool       `json:"inProgress"`
+	PublicKey     string     `json:"publicKey"`
+	NextPublicKey string     `json:"nextPublicKey,omitempty"`
+	StartedAt     *time.Time `json:"startedAt,omitempty"`
+	// Clients counts the active clients, Updated the ones that got a config with the new key
+	Clients int              `json:"clients"`
+	Updated int              `json:"updated"`
+	Pending []RotationClient `json:"pending"`
+}
+
+type RotationClient struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+// rotation holds the next key, it is kept in <wg-private-key>.next so a rotation survives restarts
+var rotation struct {
+	sync.Mutex
+	next      *wgtypes.Key
+	startedAt time.Time
+}
+
+func nextKeyPath() string {
+	return config.Config.WgKey + ".next"
+}
+
+// loadNextKey continues a rotation that was started before the server restarted
+func loadNextKey() {
+	content, err := os.ReadFile(nextKeyPath())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Could not read next private key: %v", err)
+	}
+	key, err := wgtypes.ParseKey(strings.TrimSpace(string(content)))
+	if err != nil {
+		log.Fatalf("Could not parse next private key %s: %v", nextKeyPath(), err)
+	}
+
+	rotation.Lock()
+	defer rotation.Unlock()
+	rotation.next = &key
+	if info, err := os.Stat(nextKeyPath()); err == nil {
+		rotation.startedAt = info.ModTime()
+	}
+}
+
+// RecordConfig remembers that the client got a config with the current key of its network
+func RecordConfig(network *Network, client *database.Client) error {
+	key, _ := network.ConfigKey()
+	if client.ServerKey == key.String() {
+		return nil
+	}
+	return database.Connection.Model(client).Update("server_key", key.String()).Error
+}
+
+// GetRotation reports the progress of a rotation of the network, and which clients still have a config with the
+// old key
+func GetRotation(network *Network) (*Rotation, error) {
+	// The rotation may have changed since the network was loaded
+	network, err := networkByID(network.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Rotation{Network: network.Name, PublicKey: network.PublicKey, Pending: []RotationClient{}}
+	next := network.NextPublicKey()
+	if next == nil {
+		return result, nil
+	}
+	startedAt := network.rotationStartedAt
+	result.InProgress = true
+	result.NextPublicKey = next.String()
+	result.StartedAt = &startedAt
+
+	var clients []database.Client
+	if err = database.Connection.Where("network_id = ?", network.ID).Order("id").Find(&clients).Error; err != nil {
+		return nil, err
+	}
+	for _, client := range clients {
+		if !client.Active() {
+			continue
+		}
+		result.Clients++
+		if client.ServerKey == result.NextPublicKey {
+			result.Updated++
+		} else {
+			result.Pending = append(result.Pending, RotationClient{ID: client.ID, Name: client.Name})
+		}
+	}
+	return result, nil
+}
+
+// StartRotation generates the next key of the network, client configs use it from now on
+func StartRotation(network *Network) (*Rotation, error) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate key: %s", err)
+	}
+	if network.Default {
+		err = startDefaultRotation(key)
+	} else {
+		err = startNetworkRotation(network, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("WG: Started key rotation of network %s to %s", network.Name, key.PublicKey())
+	return GetRotation(network)
+}
+
+// startDefaultRotation keeps the next key of the default network next to its key file
+func startDefaultRotation(key wgtypes.Key) error {
+	rotation.Lock()
+	defer rotation.Unlock()
+	if rotation.next != nil {
+		return ErrRotationInProgress
+	}
+	if err := os.WriteFile(nextKeyPath(), []byte(key.String()), 0600); err != nil {
+		return fmt.Errorf("could not save next private key: %s", err)
+	}
+	rotation.next = &key
+	rotation.startedAt = time.Now()
+	return nil
+}
+
+// startNetworkRotation stores the next key of a network in the database, unless it is rotated already
+func startNetworkRotation(network *Network, key wgtypes.Key) error {
+	now := time.Now()
+	result := database.Connection.Model(&database.Network{}).
+		Where("id = ? AND next_private_key = ?", network.ID, "").
+		Updates(map[string]interface{}{"next_private_key": key.String(), "rotation_started_at": &now})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRotationInProgress
+	}
+	return nil
+}
+
+// CompleteRotation switches the device of the network to the next key. Clients with an old config can not connect
+// afterwards, so it fails with ErrClientsPending unless every active client got a new config, or force is set.
+func CompleteRotation(network *Network, force bool) (*Rotation, error) {
+	status, err := GetRotation(network)
+	if err != nil {
+		return nil, err
+	}
+	if !status.InProgress {
+		return nil, ErrNoRotation
+	}
+	if len(status.Pending) > 0 && !force {
+		return nil, fmt.Errorf("%w: %d of %d clients still use the old key", ErrClientsPending, len(status.Pending), status.Clients)
+	}
+
+	if network.Default {
+		err = completeDefaultRotation()
+	} else {
+		err = completeNetworkRotation(network)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("WG: Completed key rotation of network %s, the key is %s", network.Name, status.NextPublicKey)
+	return GetRotation(network)
+}
+
+// completeDefaultRotation replaces the key file with the next key, and configures the device with it
+func completeDefaultRotation() error {
+	rotation.Lock()
+	if rotation.next == nil {
+		rotation.Unlock()
+		return ErrNoRotation
+	}
+	next := *rotation.next
+	// The old key is kept, in case the rotation has to be undone by hand
+	if err := os.Rename(config.Config.WgKey, config.Config.WgKey+".old"); err != nil {
+		rotation.Unlock()
+		return fmt.Errorf("could not keep the old private key: %s", err)
+	}
+	if err := os.Rename(nextKeyPath(), config.Config.WgKey); err != nil {
+		if restoreErr := os.Rename(config.Config.WgKey+".old", config.Config.WgKey); restoreErr != nil {
+			log.Printf("WG: Could not restore the old private key: %s", restoreErr)
+		}
+		rotation.Unlock()
+		return fmt.Errorf("could not replace the private key: %s", err)
+	}
+	config.Config.WgPrivateKey = next
+	config.Config.WgPublicKey = next.PublicKey()
+	rotation.next = nil
+	rotation.Unlock()
+
+	if err := Sync(); err != nil && !errors.Is(err, ErrDeviceNotRunning) {
+		return err
+	}
+	return nil
+}
+
+// completeNetworkRotation makes the next key of a network its key, and configures its device when it runs
+func completeNetworkRotation(network *Network) error {
+	result := database.Connection.Model(&database.Network{}).
+		Where("id = ? AND next_private_key = ?", network.ID, network.nextKey.String()).
+		Updates(map[string]interface{}{
+			"private_key":         network.nextKey.String(),
+			"public_key":          network.nextKey.PublicKey().String(),
+			"next_private_key":    "",
+			"rotation_started_at": nil,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNoRotation
+	}
+
+	rotated, err := networkByID(network.ID)
+	if err != nil {
+		return err
+	}
+	return configureRunningNetwork(rotated)
+}
+
+// CancelRotation removes the next key of the network, clients that got a config with it need a new one
+func CancelRotation(network *Network) error {
+	if network.Default {
+		rotation.Lock()
+		defer rotation.Unlock()
+		if rotation.next == nil {
+			return ErrNoRotation
+		}
+		if err := os.Remove(nextKeyPath()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove next private key: %s", err)
+		}
+		rotation.next = nil
+	} else {
+		result := database.Connection.Model(&database.Network{}).
+			Where("id = ? AND next_private_key <> ?", network.ID, "").
+			Updates(map[string]interface{}{"next_private_key": "", "rotation_started_at": nil})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNoRotation
+		}
+	}
+
+	log.Printf("WG: Cancelled key rotation of network %s", network.Name)
+	return nil
+}
@@ -0,0 +1,147 @@
+package wireguard
+
+import (
+	"errors"
+	"github.com/Richard87/wg-vpn-server/database"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"strconv"
+	"time"
+)
+
+// onlineHandshake is how recent the last handshake must be for a peer to count as online
+const onlineHandshake = 3 * time.Minute
+
+type Status struct {
+	Network    string `json:"network"`
+	Device     string `json:"device"`
+	Running    bool   `json:"running"`
+	PublicKey  string `json:"publicKey"`
+	ListenPort int    `json:"listenPort"`
+	Endpoint   string `json:"endpoint"`
+	Subnet     string `json:"subnet"`
+	// NextPublicKey is set during a server key rotation
+	NextPublicKey string `json:"nextPublicKey,omitempty"`
+	// Clients is the number of clients in the database, Peers the number configured on the device
+	Clients int64 `json:"clients"`
+	Expired int64 `json:"expired"`
+	Peers   int   `json:"peers"`
+	Online  int   `json:"online"`
+	// FailedChanges are client changes the device kept rejecting
+	FailedChanges []FailedChange `json:"failedChanges"`
+}
+
+// GetStatus reports the default device and client counts, a stopped device is not an error
+func GetStatus() (*Status, error) {
+	return GetNetworkStatus(defaultNetwork())
+}
+
+// GetNetworkStatus reports the device and client counts of a network
+func GetNetworkStatus(network *Network) (*Status, error) {
+	status := &Status{
+		Network:    network.Name,
+		Device:     network.DeviceName,
+		PublicKey:  network.PublicKey,
+		ListenPort: network.ListenPort,
+		Endpoint:   network.Endpoint + ":" + strconv.Itoa(network.ListenPort),
+		Subnet:     network.Subnet,
+	}
+	if next := network.NextPublicKey(); next != nil {
+		status.NextPublicKey = next.String()
+	}
+
+	clients := database.Connection.Model(&database.Client{}).Where("network_id = ?", network.ID)
+	if err := clients.Count(&status.Clients).Error; err != nil {
+		return nil, err
+	}
+	expired := database.Connection.Model(&database.Client{}).Where("network_id = ? AND expires_at <= ?", network.ID, time.Now())
+	if err := expired.Count(&status.Expired).Error; err != nil {
+		return nil, err
+	}
+	failed, err := failedChanges(network.ID)
+	if err != nil {
+		return nil, err
+	}
+	status.FailedChanges = failed
+
+	client, done, err := controller()
+	if errors.Is(err, ErrDeviceNotRunning) {
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	device, err := client.Device(network.DeviceName)
+	if err != nil {
+		return status, nil
+	}
+	status.Running = true
+	status.PublicKey = device.PublicKey.String()
+	status.ListenPort = device.ListenPort
+	status.Peers = len(device.Peers)
+	for _, peer := range device.Peers {
+		if newPeerStats(peer).Online() {
+			status.Online++
+		}
+	}
+	return status, nil
+}
+
+// PeerStats is what the device knows about a client
+type PeerStats struct {
+	LatestHandshake *time.Time
+	Endpoint        string
+	SentBytes       int64
+	ReceivedBytes   int64
+}
+
+func newPeerStats(peer wgtypes.Peer) PeerStats {
+	stats := PeerStats{
+		SentBytes:     peer.TransmitBytes,
+		ReceivedBytes: peer.ReceiveBytes,
+	}
+	if !peer.LastHandshakeTime.IsZero() {
+		handshake := peer.LastHandshakeTime
+		stats.LatestHandshake = &handshake
+	}
+	if peer.Endpoint != nil {
+		stats.Endpoint = peer.Endpoint.String()
+	}
+	return stats
+}
+
+// Online peers had a handshake recently
+func (s PeerStats) Online() bool {
+	return s.LatestHandshake != nil && time.Since(*s.LatestHandshake) < onlineHandshake
+}
+
+// GetPeerStats returns the stats of every peer in every network by public key, empty when the device is not running
+func GetPeerStats() (map[string]PeerStats, error) {
+	stats := map[string]PeerStats{}
+
+	client, done, err := controller()
+	if errors.Is(err, ErrDeviceNotRunning) {
+		return stats, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	networks, err := GetNetworks()
+	if err != nil {
+		return nil, err
+	}
+	// Public keys are unique over every network
+	for _, network := range networks {
+		device, err := client.Device(network.DeviceName)
+		if err != nil {
+			continue
+		}
+		for _, peer := range device.Peers {
+			stats[peer.PublicKey.String()] = newPeerStats(peer)
+		}
+	}
+	return stats, nil
+}
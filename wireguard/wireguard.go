@@ -1,6 +1,7 @@
 package wireguard
 
 import (
+	"errors"
 	"fmt"
 	"github.com/Richard87/wg-vpn-server/config"
 	"github.com/Richard87/wg-vpn-server/database"
@@ -12,6 +13,8 @@ import (
 	"log"
 	"net"
 	"os"
+	"strings"
+	"time"
 )
 
 func Init() {
@@ -36,17 +39,28 @@ func initInterface() {
 		}
 	}
 
+	if err = addInterfaceAddress(iface.Name, config.Config.ClientsSubnet); err != nil {
+		log.Fatalf("WG: %s", err)
+	}
+}
+
+// addInterfaceAddress gives the interface the server address of its subnet, unless it has an address
+func addInterfaceAddress(name string, subnet string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("could not open interface %s: %s", name, err)
+	}
 	addrs, err := iface.Addrs()
 	if err != nil {
-		log.Fatalf("WG: interface %s could not be read: %s", config.Config.WgDeviceName, err)
+		return fmt.Errorf("interface %s could not be read: %s", name, err)
 	}
 
 	if len(addrs) == 0 {
-		err := configureInterface(config.Config.ClientsSubnet, config.Config.WgDeviceName)
-		if err != nil {
-			log.Fatalf("WG: interface %s could not set IP: %s", config.Config.WgDeviceName, err)
+		if err = configureInterface(subnet, name); err != nil {
+			return fmt.Errorf("interface %s could not set IP: %s", name, err)
 		}
 	}
+	return nil
 }
 
 func Close() {
@@ -58,6 +72,7 @@ func Close() {
 
 	log.Println("Closing device...")
 	wgDevice.Close()
+	stopNetworks()
 	log.Println("WG Closed.")
 }
 
@@ -71,7 +86,7 @@ func Run() {
 	if err != nil {
 		log.Fatalf("Could not connect to WireGuard Controller: %v", err)
 	}
-	allClients := make([]database.Client, 100)
+	var allClients []database.Client
 	database.Connection.Find(&allClients)
 
 	wgDevice, err := client.Device(config.Config.WgDeviceName)
@@ -86,7 +101,7 @@ func Run() {
 
 	cfg := wgtypes.Config{
 		PrivateKey:   &config.Config.WgPrivateKey,
-		ListenPort:   &config.Config.WgListenPort,
+		ListenPort:   &config.Current().WgListenPort,
 		ReplacePeers: false,
 		Peers:        []wgtypes.PeerConfig{},
 	}
@@ -105,20 +120,15 @@ func Run() {
 	}
 
 	for _, client := range allClients {
-		key, err := wgtypes.ParseKey(client.PublicKey)
+		if !client.Active() || client.NetworkID != 0 {
+			continue
+		}
+		newPeer, err := peerConfig(&client)
 		if err != nil {
 			log.Printf("WG: Could not add missing client %s: %s", client.Name, err)
 			continue
 		}
 
-		newPeer := wgtypes.PeerConfig{
-			PublicKey:         key,
-			Remove:            false,
-			UpdateOnly:        false,
-			ReplaceAllowedIPs: false,
-			AllowedIPs:        getAllowedIpNets(&client),
-		}
-
 		cfg.Peers = append(cfg.Peers, newPeer)
 	}
 
@@ -128,6 +138,192 @@ func Run() {
 	}
 
 	config.Config.WgClient = client
+	startNetworks(client)
+	// Every peer was just replaced, the outbox only has to be cleared
+	if err = retryFailedChanges(); err != nil {
+		log.Printf("WG: Could not retry failed changes: %s", err)
+	}
+	if err = ProcessOutbox(); err != nil {
+		log.Printf("WG: Could not apply the outbox: %s", err)
+	}
+	go processOutbox()
+	go removeExpiredClients()
+	go disableExpiredKeys()
+	config.OnReload(func(changed map[string]bool) error {
+		if !changed["wg-listen-port"] {
+			return nil
+		}
+		return UpdateListenPort()
+	})
+}
+
+// ErrDeviceNotRunning is returned when commands run while the server is stopped, the device is configured on start
+var ErrDeviceNotRunning = errors.New("device is not running")
+
+// controller returns the client of the running server, or connects to the device for commands
+func controller() (*wgctrl.Client, func(), error) {
+	if config.Config.WgClient != nil {
+		return config.Config.WgClient, func() {}, nil
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not connect to WireGuard Controller: %s", err)
+	}
+	if _, err := client.Device(config.Config.WgDeviceName); err != nil {
+		client.Close()
+		return nil, nil, fmt.Errorf("%s: %w", config.Config.WgDeviceName, ErrDeviceNotRunning)
+	}
+	return client, func() { client.Close() }, nil
+}
+
+// RunningDevices lists the devices of every network that are up on this host
+func RunningDevices() ([]string, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to WireGuard Controller: %s", err)
+	}
+	defer client.Close()
+
+	networks, err := GetNetworks()
+	if err != nil {
+		return nil, err
+	}
+	var running []string
+	for _, network := range networks {
+		if _, err := client.Device(network.DeviceName); err == nil {
+			running = append(running, network.DeviceName)
+		}
+	}
+	return running, nil
+}
+
+// Sync replaces the private key and every peer of a running device with the active clients
+func Sync() error {
+	client, done, err := controller()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	peers, err := activePeers(0)
+	if err != nil {
+		return err
+	}
+
+	cfg := wgtypes.Config{
+		ListenPort:   &config.Current().WgListenPort,
+		ReplacePeers: true,
+		Peers:        peers,
+	}
+	// Commands that did not load the keys leave the key of the device alone
+	if config.Config.WgPrivateKey != (wgtypes.Key{}) {
+		cfg.PrivateKey = &config.Config.WgPrivateKey
+	}
+	if err := client.ConfigureDevice(config.Config.WgDeviceName, cfg); err != nil {
+		return fmt.Errorf("could not configure device %s: %s", config.Config.WgDeviceName, err)
+	}
+	log.Printf("WG: Synced %d clients to %s", len(cfg.Peers), config.Config.WgDeviceName)
+
+	networks, err := GetNetworks()
+	if err != nil {
+		return err
+	}
+	for i := range networks[1:] {
+		if err = configureNetwork(client, &networks[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// activePeers are the peers of every client in the network that is not disabled or expired
+func activePeers(networkID uint) ([]wgtypes.PeerConfig, error) {
+	var clients []database.Client
+	if err := database.Connection.Where("network_id = ?", networkID).Find(&clients).Error; err != nil {
+		return nil, err
+	}
+
+	peers := []wgtypes.PeerConfig{}
+	for _, c := range clients {
+		if !c.Active() {
+			continue
+		}
+		peer, err := peerConfig(&c)
+		if err != nil {
+			return nil, fmt.Errorf("client %s: %s", c.Name, err)
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// removeExpiredClients removes clients from the device when they expire, they stay in the database
+func removeExpiredClients() {
+	for range time.Tick(time.Minute) {
+		networks, err := GetNetworks()
+		if err != nil {
+			log.Printf("WG: Could not read networks: %s", err)
+			continue
+		}
+		for i := range networks {
+			removeExpiredPeers(&networks[i])
+		}
+	}
+}
+
+// removeExpiredPeers removes the peers of expired clients from the device of a network
+func removeExpiredPeers(network *Network) {
+	device, err := config.Config.WgClient.Device(network.DeviceName)
+	if err != nil {
+		log.Printf("WG: Could not read device %s: %s", network.DeviceName, err)
+		return
+	}
+	active := map[string]bool{}
+	for _, peer := range device.Peers {
+		active[peer.PublicKey.String()] = true
+	}
+
+	var expired []database.Client
+	database.Connection.Where("network_id = ? AND expires_at <= ?", network.ID, time.Now()).Find(&expired)
+
+	cfg := wgtypes.Config{Peers: []wgtypes.PeerConfig{}}
+	for _, client := range expired {
+		key, err := wgtypes.ParseKey(client.PublicKey)
+		if err != nil || !active[client.PublicKey] {
+			continue
+		}
+		cfg.Peers = append(cfg.Peers, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+		log.Printf("WG: Client %s expired", client.Name)
+	}
+	if len(cfg.Peers) == 0 {
+		return
+	}
+
+	if err = config.Config.WgClient.ConfigureDevice(network.DeviceName, cfg); err != nil {
+		log.Printf("WG: Could not remove expired clients: %s", err)
+	}
+}
+
+// UpdateListenPort applies -wg-listen-port to the running device, peers are kept
+func UpdateListenPort() error {
+	port := config.Current().WgListenPort
+	cfg := wgtypes.Config{
+		ListenPort: &port,
+	}
+
+	err := config.Config.WgClient.ConfigureDevice(config.Config.WgDeviceName, cfg)
+	if err != nil {
+		return fmt.Errorf("could not change listen port of %s: %s", config.Config.WgDeviceName, err)
+	}
+
+	log.Printf("WG: Listening on port %d", port)
+	return nil
+}
+
+// LoadKeys reads the server keys without touching the device, for commands that run next to the server
+func LoadKeys() {
+	initPublicKey()
 }
 
 func initPublicKey() {
@@ -141,6 +337,7 @@ func initPublicKey() {
 	}
 	config.Config.WgPublicKey = key.PublicKey()
 	config.Config.WgPrivateKey = key
+	loadNextKey()
 }
 
 func initPrivateKey() {
@@ -162,97 +359,87 @@ func initPrivateKey() {
 }
 
 func runEmbeddedWireGuard() {
-	tunDevice, err := tun.CreateTUN(config.Config.WgDeviceName, config.MTU)
-
+	var err error
+	wgDevice, uapi, err = embeddedDevice(config.Config.WgDeviceName)
 	if err != nil {
-		log.Fatalf("WG: Could not create interface %s: %s", config.Config.WgDeviceName, err)
+		log.Fatalf("WG: %s", err)
 	}
-	logger := device.NewLogger(1, fmt.Sprintf("WG: (%s) ", config.Config.WgDeviceName))
-	wgDevice = device.NewDevice(tunDevice, logger)
+	log.Println("WG: Running embedded server")
+}
 
-	errs := make(chan error)
+// embeddedDevice creates a userspace WireGuard device, configured through its UAPI socket like a kernel device
+func embeddedDevice(name string) (*device.Device, net.Listener, error) {
+	tunDevice, err := tun.CreateTUN(name, config.MTU)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create interface %s: %s", name, err)
+	}
+	logger := device.NewLogger(1, fmt.Sprintf("WG: (%s) ", name))
+	wgDevice := device.NewDevice(tunDevice, logger)
 
-	fileUapi, err := ipc.UAPIOpen(config.Config.WgDeviceName)
+	fileUapi, err := ipc.UAPIOpen(name)
 	if err != nil {
-		log.Printf("WG: Failed to openuapi socket: %v", err)
-		os.Exit(1)
+		wgDevice.Close()
+		return nil, nil, fmt.Errorf("failed to open uapi socket of %s: %s", name, err)
 	}
-	uapi, err = ipc.UAPIListen(config.Config.WgDeviceName, fileUapi)
+	listener, err := ipc.UAPIListen(name, fileUapi)
 	if err != nil {
-		log.Printf("WG: Failed to listen on uapi socket: %v", err)
-		os.Exit(1)
+		wgDevice.Close()
+		return nil, nil, fmt.Errorf("failed to listen on uapi socket of %s: %s", name, err)
 	}
 
 	go func() {
 		for {
-			conn, err := uapi.Accept()
+			conn, err := listener.Accept()
 			if err != nil {
-				errs <- err
 				return
 			}
 			go wgDevice.IpcHandle(conn)
 		}
 	}()
-
-	log.Println("WG: Running embedded server")
+	return wgDevice, listener, nil
 }
 
-func RemoveClient(client *database.Client) {
-	key, _ := wgtypes.ParseKey(client.PublicKey)
-
-	cfg := wgtypes.Config{
-		PrivateKey:   &config.Config.WgPrivateKey,
-		ListenPort:   &config.Config.WgListenPort,
-		ReplacePeers: false,
-		Peers: []wgtypes.PeerConfig{{
-			PublicKey:         key,
-			Remove:            true,
-			UpdateOnly:        false,
-			ReplaceAllowedIPs: false,
-			AllowedIPs:        getAllowedIpNets(client),
-		}},
-	}
-
-	err := config.Config.WgClient.ConfigureDevice(config.Config.WgDeviceName, cfg)
-	if err != nil {
-		log.Printf("Could not configure device %s: %s", config.Config.WgDeviceName, err)
-	}
-}
-
-func AddClient(client *database.Client) {
-
+// peerConfig adds or updates a client, with its preshared key and keepalive
+func peerConfig(client *database.Client) (wgtypes.PeerConfig, error) {
 	key, err := wgtypes.ParseKey(client.PublicKey)
 	if err != nil {
-		log.Printf("Could not parse client key: %s", err)
+		return wgtypes.PeerConfig{}, err
 	}
-	newPeer := wgtypes.PeerConfig{
+
+	peer := wgtypes.PeerConfig{
 		PublicKey:         key,
 		Remove:            false,
 		UpdateOnly:        false,
-		ReplaceAllowedIPs: false,
+		ReplaceAllowedIPs: true,
 		AllowedIPs:        getAllowedIpNets(client),
 	}
-
-	cfg := wgtypes.Config{
-		PrivateKey:   &config.Config.WgPrivateKey,
-		ListenPort:   &config.Config.WgListenPort,
-		ReplacePeers: false,
-		Peers:        []wgtypes.PeerConfig{newPeer},
+	if client.PresharedKey != "" {
+		psk, err := wgtypes.ParseKey(client.PresharedKey)
+		if err != nil {
+			return wgtypes.PeerConfig{}, fmt.Errorf("invalid preshared key: %s", err)
+		}
+		peer.PresharedKey = &psk
 	}
-
-	err = config.Config.WgClient.ConfigureDevice(config.Config.WgDeviceName, cfg)
-	if err != nil {
-		log.Printf("Could not configure device %s: %s", config.Config.WgDeviceName, err)
+	if client.PersistentKeepalive > 0 {
+		keepalive := time.Duration(client.PersistentKeepalive) * time.Second
+		peer.PersistentKeepaliveInterval = &keepalive
 	}
+	return peer, nil
 }
 
 func getAllowedIpNets(client *database.Client) []net.IPNet {
 	var allowedIps []net.IPNet
-	_, ipNet, err := net.ParseCIDR(client.AllowedIp4)
-	if err != nil {
-		log.Printf("Could not parse client ip (%s): %s", client.AllowedIp4, err)
+	for _, cidr := range append([]string{client.AllowedIp4}, strings.Split(client.AllowedIps, ",")...) {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("Could not parse client ip (%s): %s", cidr, err)
+			continue
+		}
+		allowedIps = append(allowedIps, *ipNet)
 	}
-
-	allowedIps = append(allowedIps, *ipNet)
 	return allowedIps
 }